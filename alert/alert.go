@@ -0,0 +1,123 @@
+// Package alert notifies operators of conditions needing attention, such as
+// the indexer disagreeing with the node.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/log"
+)
+
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert is a single notification. Details are included as they are in the
+// webhook payload.
+type Alert struct {
+	Source   string                 `json:"source"`
+	Severity string                 `json:"severity"`
+	Summary  string                 `json:"summary"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+	Time     time.Time              `json:"time"`
+}
+
+func NewAlert(source string, severity string, summary string, details map[string]interface{}) *Alert {
+	return &Alert{
+		Source:   source,
+		Severity: severity,
+		Summary:  summary,
+		Details:  details,
+		Time:     time.Now().UTC(),
+	}
+}
+
+type Alerter interface {
+	Alert(a *Alert) error
+}
+
+// LogAlerter writes alerts to the log.
+type LogAlerter struct {
+	log log.LoggerInterface
+}
+
+func NewLogAlerter() *LogAlerter {
+	return &LogAlerter{log: log.GetLogger()}
+}
+
+func (l *LogAlerter) Alert(a *Alert) error {
+	keyvals := []interface{}{
+		"Source", a.Source,
+		"Severity", a.Severity,
+	}
+	for k, v := range a.Details {
+		keyvals = append(keyvals, k, v)
+	}
+	l.log.Warn("[Alert] "+a.Summary, keyvals...)
+	return nil
+}
+
+// WebhookAlerter posts alerts as JSON to a URL.
+type WebhookAlerter struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookAlerter(url string) *WebhookAlerter {
+	return &WebhookAlerter{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (w *WebhookAlerter) Alert(a *Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alert webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// MultiAlerter sends alerts to all of its alerters, returning the first
+// error after trying them all.
+type MultiAlerter []Alerter
+
+func (m MultiAlerter) Alert(a *Alert) error {
+	var firstErr error
+	for _, alerter := range m {
+		if err := alerter.Alert(a); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewAlerter returns the alerter configured by c: alerts are always logged,
+// and also posted to AlertWebhookURL if set.
+func NewAlerter(c *config.Config) Alerter {
+	alerters := MultiAlerter{NewLogAlerter()}
+	if c.AlertWebhookURL != "" {
+		alerters = append(alerters, NewWebhookAlerter(c.AlertWebhookURL))
+	}
+	return alerters
+}
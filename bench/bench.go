@@ -0,0 +1,151 @@
+// Package bench measures the throughput of ProcessBlock and RevertLastBlock
+// over synthetic chains, into reports that can be compared across commits.
+package bench
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// Throughput of an operation applied to a number of blocks.
+type Throughput struct {
+	Blocks         int     `json:"blocks"`
+	TokenTxs       int     `json:"tokenTxs"`
+	Seconds        float64 `json:"seconds"`
+	BlocksPerSec   float64 `json:"blocksPerSec"`
+	TokenTxsPerSec float64 `json:"tokenTxsPerSec"`
+}
+
+func newThroughput(blocks []*generated.Block, elapsed time.Duration) *Throughput {
+	t := &Throughput{
+		Blocks:   len(blocks),
+		TokenTxs: CountTokenTxs(blocks),
+		Seconds:  elapsed.Seconds(),
+	}
+	if t.Seconds > 0 {
+		t.BlocksPerSec = float64(t.Blocks) / t.Seconds
+		t.TokenTxsPerSec = float64(t.TokenTxs) / t.Seconds
+	}
+	return t
+}
+
+type HolderCache struct {
+	db.TokenHolderCacheStats
+	HitRate float64 `json:"hitRate"`
+}
+
+type Report struct {
+	// Revision is the commit the binary was built from, if known
+	Revision  string           `json:"revision,omitempty"`
+	GoVersion string           `json:"goVersion"`
+	Store     string           `json:"store"`
+	StartedAt time.Time        `json:"startedAt"`
+	Chain     *chaingen.Config `json:"chain"`
+
+	ProcessBlock    *Throughput  `json:"processBlock"`
+	RevertLastBlock *Throughput  `json:"revertLastBlock"`
+	HolderCache     *HolderCache `json:"holderCache"`
+}
+
+// CountTokenTxs returns the number of token and transfer token txs in blocks.
+func CountTokenTxs(blocks []*generated.Block) int {
+	count := 0
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			switch tx.TransactionType.(type) {
+			case *generated.Transaction_Token_, *generated.Transaction_TransferToken_:
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Run processes the canonical blocks of a chain generated from c into the
+// empty store m, then reverts up to revertBlocks of them. The store must keep
+// the undo records of the blocks to revert, i.e. its ReOrgLimit must be at
+// least revertBlocks.
+func Run(c *chaingen.Config, m db.Store, storeName string, revertBlocks int) (*Report, error) {
+	if _, err := m.GetLastBlock(); err != db.ErrNotFound {
+		if err == nil {
+			return nil, fmt.Errorf("store %s is not empty", storeName)
+		}
+		return nil, err
+	}
+
+	g, err := chaingen.NewGenerator(c)
+	if err != nil {
+		return nil, err
+	}
+	blocks := g.Generate().Blocks
+
+	r := &Report{
+		GoVersion: runtime.Version(),
+		Store:     storeName,
+		StartedAt: time.Now().UTC(),
+		Chain:     c,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				r.Revision = setting.Value
+			}
+		}
+	}
+
+	db.ResetTokenHolderCacheStats()
+	start := time.Now()
+	for _, b := range blocks {
+		if err := m.ProcessBlock(b); err != nil {
+			return nil, fmt.Errorf("failed to process block #%d: %w", b.Header.BlockNumber, err)
+		}
+	}
+	r.ProcessBlock = newThroughput(blocks, time.Since(start))
+	stats := db.GetTokenHolderCacheStats()
+	r.HolderCache = &HolderCache{
+		TokenHolderCacheStats: stats,
+		HitRate:               stats.HitRate(),
+	}
+
+	// The genesis block cannot be reverted
+	if revertBlocks > len(blocks)-1 {
+		revertBlocks = len(blocks) - 1
+	}
+	reverted := blocks[len(blocks)-revertBlocks:]
+	start = time.Now()
+	for i := 0; i < revertBlocks; i++ {
+		if err := m.RevertLastBlock(); err != nil {
+			return nil, fmt.Errorf("failed to revert block #%d: %w",
+				reverted[len(reverted)-1-i].Header.BlockNumber, err)
+		}
+	}
+	r.RevertLastBlock = newThroughput(reverted, time.Since(start))
+	return r, nil
+}
+
+// Compare returns lines describing the relative change of each throughput
+// from a baseline report to r.
+func (r *Report) Compare(baseline *Report) []string {
+	var lines []string
+	change := func(name string, before float64, after float64) {
+		if before == 0 {
+			lines = append(lines, fmt.Sprintf("%-32s %12.1f -> %12.1f", name, before, after))
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%-32s %12.1f -> %12.1f (%+.1f%%)",
+			name, before, after, 100*(after-before)/before))
+	}
+	change("processBlock blocks/s", baseline.ProcessBlock.BlocksPerSec, r.ProcessBlock.BlocksPerSec)
+	change("processBlock token txs/s", baseline.ProcessBlock.TokenTxsPerSec, r.ProcessBlock.TokenTxsPerSec)
+	change("revertLastBlock blocks/s", baseline.RevertLastBlock.BlocksPerSec, r.RevertLastBlock.BlocksPerSec)
+	change("revertLastBlock token txs/s", baseline.RevertLastBlock.TokenTxsPerSec, r.RevertLastBlock.TokenTxsPerSec)
+	lines = append(lines, fmt.Sprintf("%-32s %12.3f -> %12.3f", "holder cache hit rate",
+		baseline.HolderCache.HitRate, r.HolderCache.HitRate))
+	return lines
+}
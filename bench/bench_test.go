@@ -0,0 +1,127 @@
+package bench
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+const benchmarkBlocks = 500
+
+var (
+	chainOnce sync.Once
+	chain     []*generated.Block
+)
+
+// benchmarkChain returns the canonical blocks of a chain of the default
+// shape, generated once for all benchmarks.
+func benchmarkChain() []*generated.Block {
+	chainOnce.Do(func() {
+		c := chaingen.DefaultConfig()
+		c.Blocks = benchmarkBlocks
+		g, err := chaingen.NewGenerator(c)
+		if err != nil {
+			panic(err)
+		}
+		chain = g.Generate().Blocks
+	})
+	return chain
+}
+
+func newStore() *memory.MemoryStore {
+	c := config.DefaultConfig()
+	c.ReOrgLimit = benchmarkBlocks
+	return memory.NewMemoryStore(c)
+}
+
+func processAll(b *testing.B, m db.Store, blocks []*generated.Block) {
+	for _, block := range blocks {
+		if err := m.ProcessBlock(block); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// reportThroughput reports the rates of the blocks processed or reverted in
+// each iteration, given the time spent on them.
+func reportThroughput(b *testing.B, blocks []*generated.Block, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	b.ReportMetric(float64(b.N*len(blocks))/seconds, "blocks/s")
+	b.ReportMetric(float64(b.N*CountTokenTxs(blocks))/seconds, "tokentxs/s")
+}
+
+func BenchmarkProcessBlock(b *testing.B) {
+	blocks := benchmarkChain()
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := newStore()
+		b.StartTimer()
+		start := time.Now()
+		processAll(b, m, blocks)
+		elapsed += time.Since(start)
+	}
+	reportThroughput(b, blocks, elapsed)
+}
+
+func BenchmarkRevertLastBlock(b *testing.B) {
+	blocks := benchmarkChain()
+	// The genesis block cannot be reverted
+	reverted := blocks[1:]
+	var elapsed time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := newStore()
+		processAll(b, m, blocks)
+		b.StartTimer()
+		start := time.Now()
+		for range reverted {
+			if err := m.RevertLastBlock(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		elapsed += time.Since(start)
+	}
+	reportThroughput(b, reverted, elapsed)
+}
+
+// BenchmarkTokenHoldersWithCache reports the hit rate of the per-block token
+// holder cache while processing the chain.
+func BenchmarkTokenHoldersWithCache(b *testing.B) {
+	blocks := benchmarkChain()
+	db.ResetTokenHolderCacheStats()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := newStore()
+		b.StartTimer()
+		processAll(b, m, blocks)
+	}
+	stats := db.GetTokenHolderCacheStats()
+	b.ReportMetric(stats.HitRate(), "hitrate")
+	b.ReportMetric(float64(stats.Hits+stats.Misses)/float64(b.N*len(blocks)), "lookups/block")
+}
+
+func TestRun(t *testing.T) {
+	c := chaingen.DefaultConfig()
+	c.Blocks = 100
+	r, err := Run(c, newStore(), config.StoreBackendMemory, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ProcessBlock.Blocks != 101 || r.RevertLastBlock.Blocks != 50 {
+		t.Fatalf("processed %d and reverted %d blocks, want 101 and 50",
+			r.ProcessBlock.Blocks, r.RevertLastBlock.Blocks)
+	}
+	if r.ProcessBlock.TokenTxs == 0 || r.HolderCache.Hits+r.HolderCache.Misses == 0 {
+		t.Fatal("no token txs processed")
+	}
+	if _, err := Run(c, newStore(), config.StoreBackendMemory, 0); err != nil {
+		t.Fatal(err)
+	}
+}
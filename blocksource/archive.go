@@ -0,0 +1,247 @@
+package blocksource
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/log"
+)
+
+// Name of the manifest file describing the block files of an archive
+const ManifestFileName = "manifest.json"
+
+// Manifest describes a block archive, a directory of gzip compressed block dump
+// files holding a contiguous and hash chained range of blocks.
+type Manifest struct {
+	FirstBlockNumber uint64          `json:"firstBlockNumber"`
+	LastBlockNumber  uint64          `json:"lastBlockNumber"`
+	LastBlockHash    string          `json:"lastBlockHash"`
+	Files            []*ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name               string `json:"name"`
+	FirstBlockNumber   uint64 `json:"firstBlockNumber"`
+	LastBlockNumber    uint64 `json:"lastBlockNumber"`
+	FirstBlockPrevHash string `json:"firstBlockPrevHash"`
+	FirstBlockHash     string `json:"firstBlockHash"`
+	LastBlockHash      string `json:"lastBlockHash"`
+	SHA256             string `json:"sha256"` // Checksum of the compressed file
+}
+
+// ReadManifest reads the manifest of the archive in dir. It returns
+// os.ErrNotExist if dir has no manifest.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Write atomically replaces the manifest in dir.
+func (m *Manifest) Write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, ManifestFileName), data)
+}
+
+// Verify checks the checksum of every file listed in the manifest and that
+// the files are hash chained to each other.
+func (m *Manifest) Verify(dir string) error {
+	for i, file := range m.Files {
+		checksum, err := fileSHA256(filepath.Join(dir, file.Name))
+		if err != nil {
+			return err
+		}
+		if checksum != file.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s, expected %s found %s",
+				file.Name, file.SHA256, checksum)
+		}
+		if i > 0 && m.Files[i-1].LastBlockHash != file.FirstBlockPrevHash {
+			return fmt.Errorf("%s is not chained to %s", file.Name, m.Files[i-1].Name)
+		}
+	}
+	return nil
+}
+
+// Exporter pulls blocks from a BlockSource into a block archive.
+type Exporter struct {
+	src           BlockSource
+	dir           string
+	blocksPerFile uint64
+
+	log log.LoggerInterface
+}
+
+func NewExporter(src BlockSource, dir string, blocksPerFile uint64) *Exporter {
+	return &Exporter{
+		src:           src,
+		dir:           dir,
+		blocksPerFile: blocksPerFile,
+		log:           log.GetLogger(),
+	}
+}
+
+// Export writes the blocks from..to (inclusive) into the archive. If the
+// archive already has blocks, the export resumes after its last block, which
+// must then be within from..to+1.
+func (e *Exporter) Export(from uint64, to uint64) error {
+	if from > to {
+		return fmt.Errorf("invalid block range %d..%d", from, to)
+	}
+	err := os.MkdirAll(e.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := ReadManifest(e.dir)
+	if os.IsNotExist(err) {
+		manifest = &Manifest{FirstBlockNumber: from}
+	} else if err != nil {
+		return err
+	} else {
+		if err := manifest.Verify(e.dir); err != nil {
+			return err
+		}
+		if len(manifest.Files) > 0 {
+			if from < manifest.FirstBlockNumber || from > manifest.LastBlockNumber+1 {
+				return fmt.Errorf("block range %d..%d doesn't continue archive %d..%d",
+					from, to, manifest.FirstBlockNumber, manifest.LastBlockNumber)
+			}
+			from = manifest.LastBlockNumber + 1
+			e.log.Info("Resuming export", "from", from)
+		}
+	}
+
+	for start := from; start <= to; start += e.blocksPerFile {
+		end := start + e.blocksPerFile - 1
+		if end > to {
+			end = to
+		}
+		file, err := e.exportFile(start, end, manifest.LastBlockHash)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+		manifest.LastBlockNumber = file.LastBlockNumber
+		manifest.LastBlockHash = file.LastBlockHash
+		if err := manifest.Write(e.dir); err != nil {
+			return err
+		}
+		e.log.Info("Exported blocks",
+			"from", file.FirstBlockNumber,
+			"to", file.LastBlockNumber,
+			"file", file.Name)
+	}
+	return nil
+}
+
+func (e *Exporter) exportFile(start uint64, end uint64, prevHash string) (*ManifestFile, error) {
+	file := &ManifestFile{
+		Name:             fmt.Sprintf("%012d-%012d%s%s", start, end, BlockFileExtension, GzipExtension),
+		FirstBlockNumber: start,
+		LastBlockNumber:  end,
+	}
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	for blockNumber := start; blockNumber <= end; blockNumber++ {
+		b, err := e.src.GetBlockByNumber(blockNumber)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil || b.Header == nil {
+			return nil, fmt.Errorf("block #%d not found", blockNumber)
+		}
+		if b.Header.BlockNumber != blockNumber {
+			return nil, fmt.Errorf("requested block #%d but received #%d",
+				blockNumber, b.Header.BlockNumber)
+		}
+		if err := verifyPrevHash(b, prevHash); err != nil {
+			return nil, err
+		}
+		if blockNumber == start {
+			file.FirstBlockPrevHash = hex.EncodeToString(b.Header.HashHeaderPrev)
+			file.FirstBlockHash = hex.EncodeToString(b.Header.HashHeader)
+		}
+		prevHash = hex.EncodeToString(b.Header.HashHeader)
+
+		if err := WriteDelimitedBlock(gw, b); err != nil {
+			return nil, err
+		}
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	file.LastBlockHash = prevHash
+
+	checksum := sha256.Sum256(buf.Bytes())
+	file.SHA256 = hex.EncodeToString(checksum[:])
+
+	err := writeFileAtomic(filepath.Join(e.dir, file.Name), buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func verifyPrevHash(b *generated.Block, prevHash string) error {
+	if prevHash == "" {
+		return nil
+	}
+	if hex.EncodeToString(b.Header.HashHeaderPrev) != prevHash {
+		return fmt.Errorf("block #%d prev hash %s doesn't match hash %s of its parent",
+			b.Header.BlockNumber, hex.EncodeToString(b.Header.HashHeaderPrev), prevHash)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
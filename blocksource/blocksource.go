@@ -0,0 +1,16 @@
+package blocksource
+
+import (
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// BlockSource provides the blocks of a chain to the indexer.
+// Lookups for a block that the source doesn't have return a nil block and a
+// nil error, so that callers can tell the end of the chain apart from failures.
+type BlockSource interface {
+	GetBlockByNumber(blockNumber uint64) (*generated.Block, error)
+	GetBlockByHash(hash common.Hash) (*generated.Block, error)
+	GetHeight() (uint64, error)
+	Close() error
+}
@@ -0,0 +1,64 @@
+package blocksource
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// Block dump files are a sequence of generated.Block protobufs, each prefixed
+// with its size as a varint. Files with the GzipExtension are gzip compressed.
+const GzipExtension = ".gz"
+
+func WriteDelimitedBlock(w io.Writer, b *generated.Block) error {
+	_, err := protodelim.MarshalTo(w, b)
+	return err
+}
+
+// ReadDelimitedBlock reads the next block from r. It returns io.EOF once r has
+// no more blocks.
+func ReadDelimitedBlock(r *bufio.Reader) (*generated.Block, error) {
+	b := &generated.Block{}
+	err := protodelim.UnmarshalFrom(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ReadBlockFile reads all the blocks stored in the dump file at path.
+func ReadBlockFile(path string) ([]*generated.Block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, GzipExtension) {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	var blocks []*generated.Block
+	br := bufio.NewReader(r)
+	for {
+		b, err := ReadDelimitedBlock(br)
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+}
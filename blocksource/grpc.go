@@ -0,0 +1,69 @@
+package blocksource
+
+import (
+	"context"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// GRPCBlockSource reads blocks from a QRL node through its PublicAPI.
+type GRPCBlockSource struct {
+	conn *grpc.ClientConn
+	pac  generated.PublicAPIClient
+}
+
+func NewGRPCBlockSource(target string) (*GRPCBlockSource, error) {
+	conn, err := grpc.Dial(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCBlockSource{
+		conn: conn,
+		pac:  generated.NewPublicAPIClient(conn),
+	}, nil
+}
+
+// GetPublicAPIClient returns the underlying client, for the node APIs that
+// aren't part of BlockSource.
+func (g *GRPCBlockSource) GetPublicAPIClient() generated.PublicAPIClient {
+	return g.pac
+}
+
+func (g *GRPCBlockSource) GetBlockByNumber(blockNumber uint64) (*generated.Block, error) {
+	resp, err := g.pac.GetBlockByNumber(context.Background(),
+		&generated.GetBlockByNumberReq{BlockNumber: blockNumber})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Block, nil
+}
+
+func (g *GRPCBlockSource) GetBlockByHash(hash common.Hash) (*generated.Block, error) {
+	resp, err := g.pac.GetBlock(context.Background(),
+		&generated.GetBlockReq{HeaderHash: hash[:]})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Block, nil
+}
+
+func (g *GRPCBlockSource) GetHeight() (uint64, error) {
+	resp, err := g.pac.GetHeight(context.Background(),
+		&generated.GetHeightReq{})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Height, nil
+}
+
+func (g *GRPCBlockSource) Close() error {
+	return g.conn.Close()
+}
@@ -0,0 +1,73 @@
+package chaingen
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// Chain is the outcome of a generator.
+type Chain struct {
+	// Blocks is the canonical chain, by block number
+	Blocks []*generated.Block
+	// Segments are the runs of blocks in the order they were generated,
+	// including the branches abandoned by forks. Replaying them in order,
+	// each segment replacing the blocks at its heights, ends on Blocks.
+	Segments [][]*generated.Block
+}
+
+func (c *Chain) Height() uint64 {
+	return uint64(len(c.Blocks) - 1)
+}
+
+// WriteDump writes the segments into block dump files in dir, created if
+// missing, with at most blocksPerFile blocks per file. Files are named after
+// their segment so that a blocksource.FileBlockSource reading dir serves the
+// canonical chain, while the abandoned blocks stay reachable by hash.
+func (c *Chain) WriteDump(dir string, blocksPerFile uint64) error {
+	if blocksPerFile == 0 {
+		return fmt.Errorf("invalid blocks per file %d", blocksPerFile)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, segment := range c.Segments {
+		for start := uint64(0); start < uint64(len(segment)); start += blocksPerFile {
+			end := start + blocksPerFile
+			if end > uint64(len(segment)) {
+				end = uint64(len(segment))
+			}
+			blocks := segment[start:end]
+			name := fmt.Sprintf("%06d-%012d-%012d%s", i,
+				blocks[0].Header.BlockNumber, blocks[len(blocks)-1].Header.BlockNumber,
+				blocksource.BlockFileExtension)
+			if err := writeBlockFile(filepath.Join(dir, name), blocks); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeBlockFile(path string, blocks []*generated.Block) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, b := range blocks {
+		if err := blocksource.WriteDelimitedBlock(w, b); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
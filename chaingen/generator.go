@@ -0,0 +1,476 @@
+// Package chaingen generates synthetic chains of token workloads, to test and
+// benchmark the indexer on realistic blocks without a QRL node. A generator
+// always produces the same chain from the same Config.
+package chaingen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/xmss"
+)
+
+// GenesisTimestamp is the timestamp of the genesis block. Each following
+// block is about a minute later.
+const GenesisTimestamp = 1530004179
+
+type Config struct {
+	Seed int64 `json:"seed"`
+	// Blocks is the height of the generated canonical chain
+	Blocks uint64 `json:"blocks"`
+	// Accounts is the number of addresses sending and receiving tokens
+	Accounts int `json:"accounts"`
+	// MaxTxsPerBlock is the maximum number of token txs in a block
+	MaxTxsPerBlock int `json:"maxTxsPerBlock"`
+	// MaxRecipients is the maximum number of initial holders of a token and of
+	// recipients of a transfer
+	MaxRecipients int `json:"maxRecipients"`
+	// TokenRatio is the fraction of token txs creating a token rather than
+	// transferring one
+	TokenRatio float64 `json:"tokenRatio"`
+	// SlaveSignedRatio is the fraction of txs carrying only the public key
+	// they are signed with, without a MasterAddr, so that their sender is
+	// derived from the key
+	SlaveSignedRatio float64 `json:"slaveSignedRatio"`
+	// RepeatedRecipientRatio is the fraction of tokens and transfers listing
+	// one of their initial holders or recipients twice, and SelfTransferRatio
+	// the fraction of transfers listing their sender among the recipients
+	RepeatedRecipientRatio float64 `json:"repeatedRecipientRatio"`
+	SelfTransferRatio      float64 `json:"selfTransferRatio"`
+	// ForkRatio is the probability for each block to be preceded by a fork
+	// abandoning up to MaxForkDepth blocks for a competing branch
+	ForkRatio    float64 `json:"forkRatio"`
+	MaxForkDepth uint64  `json:"maxForkDepth"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Seed:             1,
+		Blocks:           1000,
+		Accounts:         100,
+		MaxTxsPerBlock:   10,
+		MaxRecipients:    5,
+		TokenRatio:       0.05,
+		SlaveSignedRatio: 0.2,
+		ForkRatio:        0.01,
+		MaxForkDepth:     5,
+
+		RepeatedRecipientRatio: 0.05,
+		SelfTransferRatio:      0.05,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Accounts < 2 {
+		return fmt.Errorf("at least 2 accounts are needed, got %d", c.Accounts)
+	}
+	if c.MaxRecipients < 1 || c.MaxRecipients >= c.Accounts {
+		return fmt.Errorf("max recipients %d must be within 1..%d", c.MaxRecipients, c.Accounts-1)
+	}
+	if c.MaxTxsPerBlock < 0 {
+		return fmt.Errorf("invalid max txs per block %d", c.MaxTxsPerBlock)
+	}
+	return nil
+}
+
+type account struct {
+	// publicKey is the extended XMSS public key the address is derived from
+	publicKey []byte
+	address   common.Address
+	// slavePublicKey signs the txs carrying the address as MasterAddr
+	slavePublicKey []byte
+	nonce          uint64
+}
+
+type holderKey struct {
+	tokenTxHash common.Hash
+	account     int
+}
+
+// undoEntry restores a balance, or the token list, when a block is abandoned
+// by a fork.
+type undoEntry struct {
+	key     holderKey
+	prev    uint64
+	existed bool
+	// createdToken is set for the token creations, undone by removing the
+	// last token
+	createdToken bool
+}
+
+// Generator builds a chain block by block, tracking the token balances of the
+// current branch so that every transfer is covered by the sender's balance.
+type Generator struct {
+	c   *Config
+	rng *rand.Rand
+
+	accounts []*account
+
+	// blocks is the current branch, by block number
+	blocks []*generated.Block
+	undo   [][]undoEntry
+	// branch is changed by every fork, so that the blocks of a competing
+	// branch differ from those they replace
+	branch uint64
+
+	balances map[holderKey]uint64
+	// holders are the accounts that ever held each token on the current
+	// branch, to draw transfer senders from
+	holders map[common.Hash][]int
+	tokens  []common.Hash
+
+	// segments are the runs of blocks appended between forks
+	segments [][]*generated.Block
+}
+
+// NewGenerator returns a generator whose chain only has the genesis block.
+func NewGenerator(c *Config) (*Generator, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	g := &Generator{
+		c:        c,
+		rng:      rand.New(rand.NewSource(c.Seed)),
+		balances: make(map[holderKey]uint64),
+		holders:  make(map[common.Hash][]int),
+	}
+	for i := 0; i < c.Accounts; i++ {
+		a := &account{
+			publicKey:      g.newPublicKey(),
+			slavePublicKey: g.newPublicKey(),
+		}
+		a.address = xmss.GetXMSSAddressFromPK(a.publicKey)
+		g.accounts = append(g.accounts, a)
+	}
+	g.segments = append(g.segments, nil)
+	g.appendBlock(nil, nil)
+	return g, nil
+}
+
+// newPublicKey returns an extended XMSS public key of height 10 using
+// SHA2-256, with a random root and public seed.
+func (g *Generator) newPublicKey() []byte {
+	pk := make([]byte, xmss.ExtendedPKSize)
+	desc := xmss.NewQRLDescriptor(10, xmss.SHA2_256, xmss.XMSSSig, xmss.SHA256_2X).GetBytes()
+	copy(pk, desc[:])
+	g.rng.Read(pk[xmss.DescriptorSize:])
+	return pk
+}
+
+func (g *Generator) Height() uint64 {
+	return uint64(len(g.blocks) - 1)
+}
+
+// Address returns the address of the i-th account.
+func (g *Generator) Address(i int) common.Address {
+	return g.accounts[i].address
+}
+
+// Balance returns the balance of the i-th account in a token, as of the last
+// block of the current branch.
+func (g *Generator) Balance(tokenTxHash common.Hash, i int) uint64 {
+	return g.balances[holderKey{tokenTxHash, i}]
+}
+
+// Tokens returns the tokens created on the current branch.
+func (g *Generator) Tokens() []common.Hash {
+	return append([]common.Hash(nil), g.tokens...)
+}
+
+// Next appends a block with random token txs to the current branch, and
+// returns it.
+func (g *Generator) Next() *generated.Block {
+	var txs []*generated.Transaction
+	var undo []undoEntry
+
+	miner := g.rng.Intn(len(g.accounts))
+	txs = append(txs, g.newCoinbaseTx(miner))
+
+	count := 0
+	if g.c.MaxTxsPerBlock > 0 {
+		count = g.rng.Intn(g.c.MaxTxsPerBlock + 1)
+	}
+	for i := 0; i < count; i++ {
+		var tx *generated.Transaction
+		if len(g.tokens) == 0 || g.rng.Float64() < g.c.TokenRatio {
+			tx = g.newTokenTx(&undo)
+		} else {
+			tx = g.newTransferTokenTx(&undo)
+		}
+		if tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+
+	return g.appendBlock(txs, undo)
+}
+
+// Fork abandons the last depth blocks of the current branch, keeping at least
+// the genesis block. The blocks appended next form a competing branch.
+func (g *Generator) Fork(depth uint64) {
+	if depth > g.Height() {
+		depth = g.Height()
+	}
+	for i := uint64(0); i < depth; i++ {
+		g.revertBlock()
+	}
+	g.branch++
+	g.segments = append(g.segments, nil)
+}
+
+// Generate appends blocks, forking at random, until the current branch
+// reaches the configured height, and returns the resulting chain. A fork only
+// happens once the branch is longer than the one abandoned by the previous
+// fork, so that each competing branch overtakes the one it replaces.
+func (g *Generator) Generate() *Chain {
+	forkTip := g.Height()
+	for g.Height() < g.c.Blocks {
+		height := g.Height()
+		if height > forkTip && g.c.MaxForkDepth > 0 && g.rng.Float64() < g.c.ForkRatio {
+			depth := uint64(1 + g.rng.Int63n(int64(g.c.MaxForkDepth)))
+			forkTip = height
+			g.Fork(depth)
+		}
+		g.Next()
+	}
+	return g.Chain()
+}
+
+// Chain returns the blocks generated so far.
+func (g *Generator) Chain() *Chain {
+	c := &Chain{
+		Blocks: append([]*generated.Block(nil), g.blocks...),
+	}
+	for _, segment := range g.segments {
+		if len(segment) > 0 {
+			c.Segments = append(c.Segments, append([]*generated.Block(nil), segment...))
+		}
+	}
+	return c
+}
+
+func (g *Generator) appendBlock(txs []*generated.Transaction, undo []undoEntry) *generated.Block {
+	number := uint64(len(g.blocks))
+	var prevHash []byte
+	timestamp := uint64(GenesisTimestamp)
+	if number > 0 {
+		prev := g.blocks[number-1].Header
+		prevHash = prev.HashHeader
+		timestamp = prev.TimestampSeconds + 30 + uint64(g.rng.Intn(60))
+	}
+
+	merkleRoot := sha256.New()
+	for _, tx := range txs {
+		merkleRoot.Write(tx.TransactionHash)
+	}
+	header := &generated.BlockHeader{
+		BlockNumber:      number,
+		TimestampSeconds: timestamp,
+		HashHeaderPrev:   prevHash,
+		RewardBlock:      6656349462,
+		MerkleRoot:       merkleRoot.Sum(nil),
+		MiningNonce:      g.rng.Uint32(),
+		ExtraNonce:       g.branch,
+	}
+
+	h := sha256.New()
+	h.Write(prevHash)
+	binary.Write(h, binary.BigEndian, number)
+	binary.Write(h, binary.BigEndian, timestamp)
+	h.Write(header.MerkleRoot)
+	binary.Write(h, binary.BigEndian, header.MiningNonce)
+	binary.Write(h, binary.BigEndian, header.ExtraNonce)
+	header.HashHeader = h.Sum(nil)
+
+	b := &generated.Block{
+		Header:       header,
+		Transactions: txs,
+	}
+	g.blocks = append(g.blocks, b)
+	g.undo = append(g.undo, undo)
+	g.segments[len(g.segments)-1] = append(g.segments[len(g.segments)-1], b)
+	return b
+}
+
+func (g *Generator) revertBlock() {
+	last := len(g.blocks) - 1
+	undo := g.undo[last]
+	for i := len(undo) - 1; i >= 0; i-- {
+		e := undo[i]
+		if e.createdToken {
+			delete(g.holders, g.tokens[len(g.tokens)-1])
+			g.tokens = g.tokens[:len(g.tokens)-1]
+			continue
+		}
+		if !e.existed {
+			delete(g.balances, e.key)
+			holders := g.holders[e.key.tokenTxHash]
+			g.holders[e.key.tokenTxHash] = holders[:len(holders)-1]
+			continue
+		}
+		g.balances[e.key] = e.prev
+	}
+	g.blocks = g.blocks[:last]
+	g.undo = g.undo[:last]
+}
+
+// credit adds amount to the balance of an account, recording how to undo it.
+func (g *Generator) credit(key holderKey, amount uint64, undo *[]undoEntry) {
+	prev, existed := g.balances[key]
+	*undo = append(*undo, undoEntry{key: key, prev: prev, existed: existed})
+	if !existed {
+		g.holders[key.tokenTxHash] = append(g.holders[key.tokenTxHash], key.account)
+	}
+	g.balances[key] = prev + amount
+}
+
+func (g *Generator) debit(key holderKey, amount uint64, undo *[]undoEntry) {
+	prev := g.balances[key]
+	*undo = append(*undo, undoEntry{key: key, prev: prev, existed: true})
+	g.balances[key] = prev - amount
+}
+
+// newTx returns a tx sent by the i-th account, either with only the public
+// key it is signed with or on behalf of its MasterAddr.
+func (g *Generator) newTx(i int) *generated.Transaction {
+	a := g.accounts[i]
+	a.nonce++
+	tx := &generated.Transaction{
+		Fee:             uint64(g.rng.Intn(1000000)),
+		Nonce:           a.nonce,
+		TransactionHash: make([]byte, 32),
+	}
+	g.rng.Read(tx.TransactionHash)
+	if g.rng.Float64() < g.c.SlaveSignedRatio {
+		tx.PublicKey = a.publicKey
+	} else {
+		tx.MasterAddr = a.address[:]
+		tx.PublicKey = a.slavePublicKey
+	}
+	return tx
+}
+
+func (g *Generator) newCoinbaseTx(miner int) *generated.Transaction {
+	tx := g.newTx(miner)
+	tx.MasterAddr = make([]byte, len(common.Address{}))
+	tx.PublicKey = nil
+	tx.Fee = 0
+	tx.TransactionType = &generated.Transaction_Coinbase{
+		Coinbase: &generated.Transaction_CoinBase{
+			AddrTo: g.accounts[miner].address[:],
+			Amount: 6656349462,
+		},
+	}
+	return tx
+}
+
+// recipients returns up to MaxRecipients distinct accounts other than sender.
+func (g *Generator) recipients(sender int) []int {
+	count := 1 + g.rng.Intn(g.c.MaxRecipients)
+	recipients := make([]int, 0, count)
+	for _, i := range g.rng.Perm(len(g.accounts)) {
+		if len(recipients) == count {
+			break
+		}
+		if i != sender {
+			recipients = append(recipients, i)
+		}
+	}
+	return recipients
+}
+
+func (g *Generator) newTokenTx(undo *[]undoEntry) *generated.Transaction {
+	owner := g.rng.Intn(len(g.accounts))
+	tx := g.newTx(owner)
+	tokenTxHash := misc.ToSizedHash(tx.TransactionHash)
+
+	symbol := make([]byte, 3+g.rng.Intn(3))
+	for i := range symbol {
+		symbol[i] = byte('A' + g.rng.Intn(26))
+	}
+	token := &generated.Transaction_Token{
+		Symbol:   symbol,
+		Name:     []byte(fmt.Sprintf("%s Token", symbol)),
+		Owner:    g.accounts[owner].address[:],
+		Decimals: uint64(g.rng.Intn(10)),
+	}
+
+	*undo = append(*undo, undoEntry{createdToken: true})
+	g.tokens = append(g.tokens, tokenTxHash)
+	holders := g.recipients(-1)
+	// The initial balances may list the same address several times too,
+	// which then holds the sum of its amounts
+	if g.rng.Float64() < g.c.RepeatedRecipientRatio {
+		holders = append(holders, holders[g.rng.Intn(len(holders))])
+	}
+	for _, i := range holders {
+		amount := uint64(1 + g.rng.Int63n(1000000000000))
+		token.InitialBalances = append(token.InitialBalances, &generated.AddressAmount{
+			Address: g.accounts[i].address[:],
+			Amount:  amount,
+		})
+		g.credit(holderKey{tokenTxHash, i}, amount, undo)
+	}
+	tx.TransactionType = &generated.Transaction_Token_{Token: token}
+	return tx
+}
+
+// newTransferTokenTx returns a transfer of a random token from one of its
+// holders, or nil if the holders drawn have nothing left to send.
+func (g *Generator) newTransferTokenTx(undo *[]undoEntry) *generated.Transaction {
+	tokenTxHash := g.tokens[g.rng.Intn(len(g.tokens))]
+	holders := g.holders[tokenTxHash]
+
+	sender := -1
+	var balance uint64
+	for attempt := 0; attempt < 3 && sender < 0; attempt++ {
+		i := holders[g.rng.Intn(len(holders))]
+		balance = g.balances[holderKey{tokenTxHash, i}]
+		if balance > 0 {
+			sender = i
+		}
+	}
+	if sender < 0 {
+		return nil
+	}
+
+	recipients := g.recipients(sender)
+	// A transfer may list the same address several times, including its
+	// sender, which the indexer must process and revert like distinct ones
+	if g.rng.Float64() < g.c.RepeatedRecipientRatio {
+		recipients = append(recipients, recipients[g.rng.Intn(len(recipients))])
+	}
+	if g.rng.Float64() < g.c.SelfTransferRatio {
+		recipients = append(recipients, sender)
+	}
+	g.rng.Shuffle(len(recipients), func(i, j int) {
+		recipients[i], recipients[j] = recipients[j], recipients[i]
+	})
+	if uint64(len(recipients)) > balance {
+		recipients = recipients[:balance]
+	}
+	// Every amount is at most balance / len(recipients), so the sum is
+	// covered by the balance
+	share := balance / uint64(len(recipients))
+	transfer := &generated.Transaction_TransferToken{
+		TokenTxhash: append([]byte(nil), tokenTxHash[:]...),
+	}
+	var total uint64
+	for _, i := range recipients {
+		amount := uint64(1 + g.rng.Int63n(int64(share)))
+		transfer.AddrsTo = append(transfer.AddrsTo, g.accounts[i].address[:])
+		transfer.Amounts = append(transfer.Amounts, amount)
+		g.credit(holderKey{tokenTxHash, i}, amount, undo)
+		total += amount
+	}
+	g.debit(holderKey{tokenTxHash, sender}, total, undo)
+
+	tx := g.newTx(sender)
+	tx.TransactionType = &generated.Transaction_TransferToken_{TransferToken: transfer}
+	return tx
+}
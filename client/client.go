@@ -1,7 +1,6 @@
 package client
 
 import (
-	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,20 +8,22 @@ import (
 	"sync"
 	"time"
 
+	"github.com/cyyber/qrl-token-indexer/alert"
+	"github.com/cyyber/qrl-token-indexer/blocksource"
 	"github.com/cyyber/qrl-token-indexer/common"
 	"github.com/cyyber/qrl-token-indexer/config"
 	"github.com/cyyber/qrl-token-indexer/db"
 	"github.com/cyyber/qrl-token-indexer/db/models"
 	"github.com/cyyber/qrl-token-indexer/generated"
 	"github.com/cyyber/qrl-token-indexer/log"
-	"go.mongodb.org/mongo-driver/mongo"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"github.com/cyyber/qrl-token-indexer/mempool"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/reconcile"
+	"github.com/cyyber/qrl-token-indexer/snapshot"
 )
 
 type QRLIndexer struct {
-	conn *grpc.ClientConn
-	pac  generated.PublicAPIClient
+	src blocksource.BlockSource
 
 	lock sync.Mutex
 	wg   sync.WaitGroup
@@ -31,38 +32,58 @@ type QRLIndexer struct {
 
 	config *config.Config
 
-	m *db.MongoDBProcessor
+	m db.Store
+
+	alerter alert.Alerter
+
+	// pendingPool is only available when blocks are read from a node
+	pendingPool *mempool.Pool
+	// reconciler is only available when blocks are read from a node and the
+	// store keeps the data needed to reconcile
+	reconciler *reconcile.Reconciler
 
 	quit       chan struct{}
 	disconnect bool
 }
 
-func ConnectServer(m *db.MongoDBProcessor) (*QRLIndexer, error) {
-	c := config.GetConfig()
+func ConnectServer(m db.Store, c *config.Config) (*QRLIndexer, error) {
 	qrlNodeConfig := c.GetQRLNodeConfig()
-	conn, err := grpc.Dial(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	src, err := blocksource.NewGRPCBlockSource(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort))
 	if err != nil {
 		return nil, err
 	}
 
-	pac := generated.NewPublicAPIClient(conn)
-
-	nc := &QRLIndexer{
-		conn:   conn,
-		pac:    pac,
-		config: c,
-		log:    log.GetLogger(),
-		m:      m,
-		quit:   make(chan struct{}),
+	nc := NewQRLIndexer(src, m, c)
+	nc.pendingPool = mempool.NewPool(src.GetPublicAPIClient(), c)
+	if s, ok := m.(reconcile.Store); ok && c.ReconcileInterval > 0 {
+		nc.reconciler = reconcile.NewReconciler(src.GetPublicAPIClient(), s, nc.alerter, c)
 	}
 	return nc, nil
 }
 
+// NewQRLIndexer creates an indexer that reads blocks from src, e.g. from a
+// blocksource.FileBlockSource to reindex from archived block dumps.
+func NewQRLIndexer(src blocksource.BlockSource, m db.Store, c *config.Config) *QRLIndexer {
+	return &QRLIndexer{
+		src:     src,
+		config:  c,
+		log:     log.GetLogger(),
+		m:       m,
+		alerter: alert.NewAlerter(c),
+		quit:    make(chan struct{}),
+	}
+}
+
 func (qi *QRLIndexer) Start() {
 	qi.lock.Lock()
 	defer qi.lock.Unlock()
 
+	if qi.pendingPool != nil {
+		qi.pendingPool.Start()
+	}
+	if qi.reconciler != nil {
+		qi.reconciler.Start()
+	}
 	go qi.run()
 }
 
@@ -75,8 +96,14 @@ func (qi *QRLIndexer) close() {
 	defer qi.lock.Unlock()
 
 	close(qi.quit)
+	if qi.pendingPool != nil {
+		qi.pendingPool.Stop()
+	}
+	if qi.reconciler != nil {
+		qi.reconciler.Stop()
+	}
 
-	qi.conn.Close()
+	qi.src.Close()
 }
 
 func (qi *QRLIndexer) Disconnect() {
@@ -92,11 +119,11 @@ func (qi *QRLIndexer) run() (err error) {
 loop:
 	for {
 		select {
-		case <-time.After(10 * time.Second):
+		case <-time.After(qi.config.BlockPollInterval):
 			height := uint64(common.BLOCKZERO)
 			b, err := qi.m.GetLastBlock()
 			// If last block not found, then request for genesis block and process it
-			if err == mongo.ErrNoDocuments {
+			if err == db.ErrNotFound {
 				block, err := qi.requestForBlockByNumber(height)
 				if err != nil {
 					qi.log.Error("[run] Error requestForBlockByNumber",
@@ -104,7 +131,15 @@ loop:
 						"Error", err.Error())
 					return err
 				}
-				err = qi.m.ProcessBlock(block)
+				// A source such as the blocks exported from a later height
+				// may not have the genesis block, which the chain is
+				// indexed from
+				if block == nil {
+					err = errors.New("genesis block not found in the block source")
+					qi.log.Error("[run] Unexpected Error", "Error", err.Error())
+					return err
+				}
+				processed, err := qi.processBlock(block)
 				if err != nil {
 					qi.log.Error("[run] Failed to ProcessBlock (genesis)",
 						"#", block.Header.BlockNumber,
@@ -112,6 +147,10 @@ loop:
 						"Error", err.Error())
 					return err
 				}
+				if !processed {
+					continue
+				}
+				qi.removeMinedPendingTxs(block)
 				qi.log.Info("Successfully Processed Genesis Block")
 				continue
 			} else if err != nil {
@@ -174,7 +213,7 @@ loop:
 					break
 				}
 
-				err = qi.m.ProcessBlock(block)
+				processed, err := qi.processBlock(block)
 				if err != nil {
 					qi.log.Error("[run] Failed to ProcessBlock",
 						"#", block.Header.BlockNumber,
@@ -182,7 +221,12 @@ loop:
 						"Error", err.Error())
 					return err
 				}
+				if !processed {
+					break
+				}
+				qi.removeMinedPendingTxs(block)
 				height = block.Header.BlockNumber
+				qi.snapshotIfDue(height)
 			}
 		case <-qi.quit:
 			break loop
@@ -191,36 +235,158 @@ loop:
 	return err
 }
 
-func (qi *QRLIndexer) GetAddrFromTx(tx *generated.Transaction) []byte {
-	if tx.MasterAddr != nil {
-		return tx.MasterAddr
+// processBlock processes block, unless it is quarantined by an unresolved
+// processing failure. A block failing with a db.ProcessingError is
+// quarantined, so that indexing waits for an operator to resolve the failure
+// instead of stopping. The failure of a quarantined block replaced by a fork
+// is resolved once its replacement is processed. It reports whether the
+// block was processed.
+func (qi *QRLIndexer) processBlock(block *generated.Block) (bool, error) {
+	f, err := qi.m.GetProcessingFailure(int64(block.Header.BlockNumber))
+	if err == nil && f.BlockHash == misc.ToSizedHash(block.Header.HashHeader) {
+		qi.log.Warn("[processBlock] Block quarantined until its processing failure is resolved",
+			"#", f.BlockNumber,
+			"Hash", f.BlockHash.ToString(),
+			"Error", f.Error)
+		return false, nil
+	} else if err == db.ErrNotFound {
+		f = nil
+	} else if err != nil {
+		return false, err
+	}
+
+	err = qi.m.ProcessBlock(block)
+	var processingErr *db.ProcessingError
+	if errors.As(err, &processingErr) {
+		return false, qi.quarantine(processingErr.Failure)
+	} else if err != nil {
+		return false, err
+	}
+	if f != nil {
+		qi.log.Info("[processBlock] Quarantined block replaced",
+			"#", f.BlockNumber,
+			"Hash", f.BlockHash.ToString())
+		err = qi.m.ResolveProcessingFailure(f.BlockNumber, models.ProcessingFailureResolutionReplaced)
+		if err != nil && err != db.ErrNotFound {
+			qi.log.Error("[processBlock] Failed to resolve processing failure",
+				"#", f.BlockNumber,
+				"Error", err.Error())
+		}
+	}
+	return true, nil
+}
+
+// quarantine records the processing failure and alerts on its first attempt.
+func (qi *QRLIndexer) quarantine(f *models.ProcessingFailure) error {
+	recorded, err := qi.m.RecordProcessingFailure(f)
+	if err != nil {
+		return err
+	}
+	qi.log.Error("[quarantine] Quarantined block failing to be processed",
+		"#", recorded.BlockNumber,
+		"Hash", recorded.BlockHash.ToString(),
+		"TxHash", recorded.TxHash.ToString(),
+		"Error", recorded.Error)
+	if recorded.Attempts > 1 {
+		return nil
+	}
+	err = qi.alerter.Alert(alert.NewAlert("indexer", alert.SeverityCritical,
+		fmt.Sprintf("Block #%d quarantined, indexing stopped until resolved", recorded.BlockNumber),
+		map[string]interface{}{
+			"BlockNumber": recorded.BlockNumber,
+			"BlockHash":   recorded.BlockHash.ToString(),
+			"TxHash":      recorded.TxHash.ToString(),
+			"TokenTxHash": recorded.TokenTxHash.ToString(),
+			"Error":       recorded.Error,
+		}))
+	if err != nil {
+		qi.log.Error("[quarantine] Failed to send alert",
+			"Error", err.Error())
 	}
-	//return misc.UCharVectorToBytes(goqrllib.QRLHelperGetAddress(misc.BytesToUCharVector(tx.PublicKey)))
 	return nil
+}
 
+// GetPendingPool returns the pool of unconfirmed token transactions seen by the node.
+func (qi *QRLIndexer) GetPendingPool() *mempool.Pool {
+	return qi.pendingPool
 }
 
-func (qi *QRLIndexer) requestForBlockByNumber(blockNumber uint64) (*generated.Block, error) {
-	qi.log.Info("Request block ", "#", blockNumber)
-	resp, err := qi.pac.GetBlockByNumber(context.Background(),
-		&generated.GetBlockByNumberReq{BlockNumber: blockNumber})
+func (qi *QRLIndexer) removeMinedPendingTxs(block *generated.Block) {
+	if qi.pendingPool != nil {
+		qi.pendingPool.RemoveMinedTxs(block)
+	}
+}
 
+// getTokenTxHashes returns the hashes of the token txs of the indexed block
+// blockNumber, if the pending pool needs them.
+func (qi *QRLIndexer) getTokenTxHashes(blockNumber int64) ([]common.Hash, error) {
+	if qi.pendingPool == nil {
+		return nil, nil
+	}
+	tokenTxs, err := qi.m.GetTokenTxsByBlockNumber(blockNumber)
 	if err != nil {
 		return nil, err
 	}
-
-	return resp.Block, err
+	transferTokenTxs, err := qi.m.GetTransferTokenTxsByBlockNumber(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	txHashes := make([]common.Hash, 0, len(tokenTxs)+len(transferTokenTxs))
+	for _, tokenTx := range tokenTxs {
+		txHashes = append(txHashes, tokenTx.TxHash)
+	}
+	for _, transferTokenTx := range transferTokenTxs {
+		txHashes = append(txHashes, transferTokenTx.TxHash)
+	}
+	return txHashes, nil
 }
 
-func (qi *QRLIndexer) requestForBlockHeight() (uint64, error) {
-	resp, err := qi.pac.GetHeight(context.Background(),
-		&generated.GetHeightReq{})
+func (qi *QRLIndexer) restoreRevertedPendingTxs(txHashes []common.Hash) {
+	if qi.pendingPool != nil {
+		qi.pendingPool.RestoreRevertedTxs(txHashes)
+	}
+}
 
+// snapshotIfDue writes a state snapshot every SnapshotInterval blocks. It is
+// called between blocks, so that snapshots are consistent. Failures are only
+// logged, as they don't affect indexing.
+func (qi *QRLIndexer) snapshotIfDue(blockNumber uint64) {
+	interval := qi.config.SnapshotInterval
+	if interval == 0 || blockNumber%interval != 0 {
+		return
+	}
+	path, err := snapshot.Create(qi.m, qi.config.SnapshotDir)
 	if err != nil {
-		return 0, err
+		qi.log.Error("[snapshotIfDue] Failed to create snapshot",
+			"#", blockNumber,
+			"Error", err.Error())
+		return
+	}
+	qi.log.Info("Created snapshot",
+		"#", blockNumber,
+		"Path", path)
+	if err := snapshot.Prune(qi.config.SnapshotDir, qi.config.SnapshotsRetained); err != nil {
+		qi.log.Error("[snapshotIfDue] Failed to prune snapshots",
+			"Error", err.Error())
+	}
+}
+
+func (qi *QRLIndexer) GetAddrFromTx(tx *generated.Transaction) []byte {
+	if tx.MasterAddr != nil {
+		return tx.MasterAddr
 	}
+	//return misc.UCharVectorToBytes(goqrllib.QRLHelperGetAddress(misc.BytesToUCharVector(tx.PublicKey)))
+	return nil
 
-	return resp.Height, err
+}
+
+func (qi *QRLIndexer) requestForBlockByNumber(blockNumber uint64) (*generated.Block, error) {
+	qi.log.Info("Request block ", "#", blockNumber)
+	return qi.src.GetBlockByNumber(blockNumber)
+}
+
+func (qi *QRLIndexer) requestForBlockHeight() (uint64, error) {
+	return qi.src.GetHeight()
 }
 
 func (qi *QRLIndexer) Rollback(b *models.Block) error {
@@ -229,11 +395,19 @@ func (qi *QRLIndexer) Rollback(b *models.Block) error {
 		"hash", b.Hash.ToString())
 
 	for b.Number != common.BLOCKZERO {
-		err := qi.m.RevertLastBlock()
+		txHashes, err := qi.getTokenTxHashes(b.Number)
+		if err != nil {
+			qi.log.Error("[Rollback] Error in getTokenTxHashes",
+				"Error", err)
+			return err
+		}
+		err = qi.m.RevertLastBlock()
 		if err != nil {
 			qi.log.Error("[Rollback] Error in RevertLastBlock",
 				"Error", err)
+			return err
 		}
+		qi.restoreRevertedPendingTxs(txHashes)
 
 		b, err = qi.m.GetLastBlock()
 		if err != nil {
@@ -250,7 +424,7 @@ func (qi *QRLIndexer) Rollback(b *models.Block) error {
 			return err
 		}
 
-		if reflect.DeepEqual(block.Header.HashHeader, b.Hash[:]) {
+		if block != nil && reflect.DeepEqual(block.Header.HashHeader, b.Hash[:]) {
 			break
 		}
 	}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/mempool"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+	"google.golang.org/grpc"
+)
+
+var (
+	alice = testutil.Alice
+	bob   = testutil.Bob
+	carol = testutil.Carol
+)
+
+// newIndexer returns an indexer, not started yet, of the chain of a started
+// fake node into a memory store.
+func newIndexer(t *testing.T, node *fakenode.Node) *QRLIndexer {
+	t.Helper()
+
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Stop)
+
+	src, err := blocksource.NewGRPCBlockSource(node.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.DefaultConfig()
+	c.BlockPollInterval = 5 * time.Millisecond
+	c.PendingTxPollInterval = 5 * time.Millisecond
+	return NewQRLIndexer(src, memory.NewMemoryStore(c), c)
+}
+
+// startIndexer indexes the chain of a started fake node into a memory store.
+func startIndexer(t *testing.T, node *fakenode.Node) *memory.MemoryStore {
+	t.Helper()
+
+	qi := newIndexer(t, node)
+	qi.Start()
+	t.Cleanup(qi.Stop)
+	return qi.m.(*memory.MemoryStore)
+}
+
+// waitForSync waits until the last indexed block is the last block of node.
+func waitForSync(t *testing.T, m db.Store, node *fakenode.Node) {
+	t.Helper()
+
+	want := misc.ToSizedHash(node.Block(node.Height()).Header.HashHeader)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b, err := m.GetLastBlock()
+		if err == nil && b.Hash == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	b, err := m.GetLastBlock()
+	if err != nil {
+		t.Fatalf("indexer not synced to #%d: %v", node.Height(), err)
+	}
+	t.Fatalf("indexer not synced to #%d, last block #%d %s", node.Height(), b.Number, b.Hash.ToString())
+}
+
+func assertChain(t *testing.T, m db.Store, node *fakenode.Node) {
+	t.Helper()
+
+	for n := uint64(0); n <= node.Height(); n++ {
+		b, err := m.GetBlockByNumber(int64(n))
+		if err != nil {
+			t.Fatalf("block #%d: %v", n, err)
+		}
+		if b.Hash != misc.ToSizedHash(node.Block(n).Header.HashHeader) {
+			t.Fatalf("block #%d: hash %s differs from the node", n, b.Hash.ToString())
+		}
+	}
+	if _, err := m.GetBlockByNumber(int64(node.Height() + 1)); err != db.ErrNotFound {
+		t.Fatalf("block #%d above the node height is indexed", node.Height()+1)
+	}
+}
+
+func TestFullSync(t *testing.T) {
+	node := fakenode.NewNode()
+	token := fakenode.NewTokenTx("token", "TST", 2, alice,
+		[]common.Address{alice, bob}, []uint64{1000, 500})
+	tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+	node.Append(token)
+	node.AppendEmpty(3)
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob, carol}, []uint64{100, 200}))
+
+	m := startIndexer(t, node)
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, alice, 700)
+	testutil.AssertBalance(t, m, tokenTxHash, bob, 600)
+	testutil.AssertBalance(t, m, tokenTxHash, carol, 200)
+
+	// Blocks appended later are indexed too
+	node.Append(fakenode.NewTransferTokenTx("transfer2", tokenTxHash, carol,
+		[]common.Address{alice}, []uint64{50}))
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, alice, 750)
+	testutil.AssertBalance(t, m, tokenTxHash, carol, 150)
+}
+
+func TestForkRollback(t *testing.T) {
+	node := fakenode.NewNode()
+	token := fakenode.NewTokenTx("token", "TST", 0, alice,
+		[]common.Address{alice}, []uint64{1000})
+	tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+	node.Append(token)
+	node.AppendEmpty(2)
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+	node.Append(fakenode.NewTransferTokenTx("transfer2", tokenTxHash, bob,
+		[]common.Address{carol}, []uint64{100}))
+
+	m := startIndexer(t, node)
+	waitForSync(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, carol, 100)
+
+	// Replace the last two blocks with a longer branch sending elsewhere
+	node.Fork(node.Height() - 2)
+	node.Append(fakenode.NewTransferTokenTx("transfer3", tokenTxHash, alice,
+		[]common.Address{carol}, []uint64{400}))
+	node.AppendEmpty(2)
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, alice, 600)
+	testutil.AssertBalance(t, m, tokenTxHash, bob, 0)
+	testutil.AssertBalance(t, m, tokenTxHash, carol, 400)
+}
+
+func TestDropRollback(t *testing.T) {
+	node := fakenode.NewNode()
+	token := fakenode.NewTokenTx("token", "TST", 0, alice,
+		[]common.Address{alice}, []uint64{1000})
+	tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+	node.Append(token)
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+
+	m := startIndexer(t, node)
+	waitForSync(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, bob, 300)
+
+	// The node losing blocks makes the indexer revert to its height
+	node.Drop(1)
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, alice, 1000)
+	testutil.AssertBalance(t, m, tokenTxHash, bob, 0)
+
+	// Appending the same tx again yields the dropped block
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, bob, 300)
+}
+
+// waitForFailure waits until the block at blockNumber of node is quarantined.
+func waitForFailure(t *testing.T, m db.Store, node *fakenode.Node, blockNumber uint64) *models.ProcessingFailure {
+	t.Helper()
+
+	want := misc.ToSizedHash(node.Block(blockNumber).Header.HashHeader)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		f, err := m.GetProcessingFailure(int64(blockNumber))
+		if err == nil && f.BlockHash == want {
+			return f
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("block #%d not quarantined", blockNumber)
+	return nil
+}
+
+func TestQuarantine(t *testing.T) {
+	node := fakenode.NewNode()
+	token := fakenode.NewTokenTx("token", "TST", 0, alice,
+		[]common.Address{alice}, []uint64{1000})
+	tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+	node.Append(token)
+	// bob holds none of the token
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, bob,
+		[]common.Address{carol}, []uint64{300}))
+	node.AppendEmpty(1)
+
+	m := startIndexer(t, node)
+	f := waitForFailure(t, m, node, 2)
+	if f.TxHash != fakenode.NewTxHash("transfer") || f.Attempts != 1 {
+		t.Fatalf("failure of tx %s after %d attempts, want the transfer after 1",
+			f.TxHash.ToString(), f.Attempts)
+	}
+
+	// Indexing waits at the quarantined block, which isn't attempted again
+	time.Sleep(50 * time.Millisecond)
+	b, err := m.GetLastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Number != 1 {
+		t.Fatalf("indexed up to block #%d past the quarantined block", b.Number)
+	}
+	if f := waitForFailure(t, m, node, 2); f.Attempts != 1 {
+		t.Fatalf("quarantined block attempted %d times", f.Attempts)
+	}
+
+	// A fork replacing the quarantined block resolves its failure
+	node.Fork(1)
+	node.Append(fakenode.NewTransferTokenTx("transfer2", tokenTxHash, alice,
+		[]common.Address{carol}, []uint64{300}))
+	node.AppendEmpty(1)
+	waitForSync(t, m, node)
+
+	assertChain(t, m, node)
+	testutil.AssertBalance(t, m, tokenTxHash, carol, 300)
+	failures, err := m.GetProcessingFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 0 {
+		t.Fatalf("failure of block #%d %s still unresolved", failures[0].BlockNumber,
+			failures[0].BlockHash.ToString())
+	}
+}
+
+// laterBlocksSource is a source of the blocks of node from #2, such as blocks
+// exported from that height.
+type laterBlocksSource struct {
+	blocksource.BlockSource
+	node *fakenode.Node
+}
+
+func (s *laterBlocksSource) GetBlockByNumber(blockNumber uint64) (*generated.Block, error) {
+	if blockNumber < 2 || blockNumber > s.node.Height() {
+		return nil, nil
+	}
+	return s.node.Block(blockNumber), nil
+}
+
+func TestMissingGenesisBlock(t *testing.T) {
+	node := fakenode.NewNode()
+	node.AppendEmpty(3)
+	c := config.DefaultConfig()
+	c.BlockPollInterval = time.Millisecond
+	m := memory.NewMemoryStore(c)
+	qi := NewQRLIndexer(&laterBlocksSource{node: node}, m, c)
+
+	if err := qi.run(); err == nil || !strings.Contains(err.Error(), "genesis block not found") {
+		t.Fatalf("run without a genesis block: %v", err)
+	}
+	if _, err := m.GetLastBlock(); err != db.ErrNotFound {
+		t.Fatalf("block indexed without the genesis block: %v", err)
+	}
+}
+
+// unconfirmedClient reports txs as the unconfirmed txs of the node.
+type unconfirmedClient struct {
+	generated.PublicAPIClient
+	txs []*generated.Transaction
+}
+
+func (c *unconfirmedClient) GetLatestData(_ context.Context, req *generated.GetLatestDataReq,
+	_ ...grpc.CallOption) (*generated.GetLatestDataResp, error) {
+	resp := &generated.GetLatestDataResp{}
+	if req.Offset == 0 {
+		for _, tx := range c.txs {
+			resp.TransactionsUnconfirmed = append(resp.TransactionsUnconfirmed,
+				&generated.TransactionExtended{Tx: tx})
+		}
+	}
+	return resp, nil
+}
+
+// waitForPending waits until the tx txHash is pending in p, or isn't.
+func waitForPending(t *testing.T, p *mempool.Pool, txHash common.Hash, want bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for (p.Get(txHash) != nil) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("tx %s pending %v, want %v", txHash.ToString(), !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestPendingTxOfForkedBlock checks that a tx whose block is forked away is
+// pending again, as the node keeps reporting it as unconfirmed.
+func TestPendingTxOfForkedBlock(t *testing.T) {
+	node := fakenode.NewNode()
+	token := fakenode.NewTokenTx("token", "TST", 0, alice,
+		[]common.Address{alice}, []uint64{1000})
+	tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+	transfer := fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300})
+	node.Append(token)
+	node.Append(transfer)
+
+	qi := newIndexer(t, node)
+	qi.pendingPool = mempool.NewPool(&unconfirmedClient{txs: []*generated.Transaction{transfer}}, qi.config)
+	qi.Start()
+	t.Cleanup(qi.Stop)
+	waitForSync(t, qi.m, node)
+	transferTxHash := misc.ToSizedHash(transfer.TransactionHash)
+	waitForPending(t, qi.pendingPool, transferTxHash, false)
+
+	node.Fork(1)
+	node.AppendEmpty(2)
+	waitForSync(t, qi.m, node)
+	waitForPending(t, qi.pendingPool, transferTxHash, true)
+}
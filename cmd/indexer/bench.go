@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cyyber/qrl-token-indexer/bench"
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/config"
+)
+
+// benchmark measures the throughput of the store over a synthetic chain, and
+// writes a JSON report to compare against the report of another commit.
+func benchmark(args []string) error {
+	c := chaingen.DefaultConfig()
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	chainFlags(fs, c)
+	revertBlocks := fs.Int("revert-blocks", -1, "Number of blocks to revert, defaults to the reorg limit")
+	out := fs.String("out", "", "File the JSON report is written to, defaults to stdout")
+	baseline := fs.String("baseline", "", "JSON report of a previous run to compare with")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var baselineReport *bench.Report
+	if *baseline != "" {
+		data, err := os.ReadFile(*baseline)
+		if err != nil {
+			return err
+		}
+		baselineReport = &bench.Report{}
+		if err := json.Unmarshal(data, baselineReport); err != nil {
+			return fmt.Errorf("failed to read baseline %s: %w", *baseline, err)
+		}
+	}
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	// Benchmark an empty memory store, unless a store is chosen explicitly.
+	// A MongoDB database must then be empty.
+	if !configFlags.IsSet("storeBackend") {
+		cfg.StoreBackend = config.StoreBackendMemory
+	}
+	cfg.MemoryStoreDumpPath = ""
+	if *revertBlocks < 0 || uint64(*revertBlocks) > cfg.ReOrgLimit {
+		*revertBlocks = int(cfg.ReOrgLimit)
+	}
+	m, err := createStore(cfg)
+	if err != nil {
+		return err
+	}
+
+	r, err := bench.Run(c, m, cfg.StoreBackend, *revertBlocks)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*out, data, 0644); err != nil {
+		return err
+	}
+
+	if baselineReport != nil {
+		for _, line := range r.Compare(baselineReport) {
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/log"
+	"github.com/cyyber/qrl-token-indexer/snapshot"
+)
+
+func bootstrap(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	fromSnapshot := fs.String("from-snapshot", "", "Snapshot archive to restore")
+	resume := fs.Bool("resume", false, "Complete a restore which was interrupted")
+	fs.StringVar(blocksDir, "blocks-dir", "",
+		"Check the snapshot against and index from the block dump files in this directory instead of the QRL node")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fromSnapshot == "" {
+		return errors.New("-from-snapshot is required")
+	}
+	logger := log.GetLogger()
+
+	manifest, err := snapshot.Verify(*fromSnapshot)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", *fromSnapshot, err)
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	var src blocksource.BlockSource
+	if *blocksDir != "" {
+		src, err = blocksource.NewFileBlockSource(*blocksDir)
+	} else {
+		qrlNodeConfig := c.GetQRLNodeConfig()
+		src, err = blocksource.NewGRPCBlockSource(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort))
+	}
+	if err != nil {
+		return err
+	}
+	err = snapshot.CheckBlockHash(src, manifest)
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+	logger.Info("Restoring snapshot",
+		"#", manifest.BlockNumber,
+		"Hash", manifest.BlockHash,
+		"ContentHash", manifest.ContentHash)
+	if _, err := snapshot.Restore(*fromSnapshot, m, *resume); err != nil {
+		return err
+	}
+	logger.Info("Restored snapshot, syncing from it",
+		"#", manifest.BlockNumber)
+
+	return index(c, m)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/config"
+)
+
+func exportBlocks(args []string) error {
+	fs := flag.NewFlagSet("export-blocks", flag.ExitOnError)
+	from := fs.Uint64("from", 0, "First block number to export")
+	to := fs.Int64("to", -1, "Last block number to export, defaults to the node height")
+	out := fs.String("out", "", "Directory of the block archive, created if missing")
+	blocksPerFile := fs.Uint64("blocks-per-file", 1000, "Number of blocks in each archive file")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+	if *blocksPerFile == 0 {
+		return errors.New("-blocks-per-file must be greater than 0")
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	qrlNodeConfig := c.GetQRLNodeConfig()
+	src, err := blocksource.NewGRPCBlockSource(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	last := uint64(*to)
+	if *to < 0 {
+		last, err = src.GetHeight()
+		if err != nil {
+			return err
+		}
+	}
+
+	return blocksource.NewExporter(src, *out, *blocksPerFile).Export(*from, last)
+}
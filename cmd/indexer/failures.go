@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/verify"
+	"google.golang.org/protobuf/proto"
+)
+
+const failuresUsage = `Usage: failures [action] [flags]
+
+Actions:
+  list           List the unresolved processing failures (default)
+  retry          Process the quarantined block again, as it was received
+  refetch        Fetch the block from the node again and process it
+  rebuild-token  Rebuild the holders of the failing token from its txs, then retry
+`
+
+// failures lists and resolves the blocks quarantined by processing failures.
+// The indexer waits while a block is quarantined, so the block can be
+// processed from here, after which the indexer carries on from it.
+func failures(args []string) error {
+	action := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action = args[0]
+		args = args[1:]
+	}
+	fs := flag.NewFlagSet("failures", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), failuresUsage+"\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	blockNumber := fs.Int64("block", -1, "Block number of the failure to resolve, defaults to the first unresolved failure")
+	fs.StringVar(blocksDir, "blocks-dir", "",
+		"Refetch blocks from the block dump files in this directory instead of the QRL node")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+
+	if action == "list" {
+		return listFailures(m)
+	}
+
+	f, err := selectFailure(m, *blockNumber)
+	if err != nil {
+		return err
+	}
+	var block *generated.Block
+	var resolution string
+	switch action {
+	case "retry":
+		block, err = decodeFailedBlock(f)
+		resolution = models.ProcessingFailureResolutionRetried
+	case "refetch":
+		block, err = refetchBlock(c, m, f)
+		resolution = models.ProcessingFailureResolutionRefetched
+	case "rebuild-token":
+		if err = rebuildTokenHolders(m, f); err == nil {
+			block, err = decodeFailedBlock(f)
+		}
+		resolution = models.ProcessingFailureResolutionRebuiltToken
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %s", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := m.ProcessBlock(block); err != nil {
+		var processingErr *db.ProcessingError
+		if errors.As(err, &processingErr) {
+			if _, recordErr := m.RecordProcessingFailure(processingErr.Failure); recordErr != nil {
+				return recordErr
+			}
+		}
+		return fmt.Errorf("block #%d still fails: %w", f.BlockNumber, err)
+	}
+	if err := m.ResolveProcessingFailure(f.BlockNumber, resolution); err != nil {
+		return err
+	}
+	if s, ok := m.(*memory.MemoryStore); ok && c.MemoryStoreDumpPath != "" {
+		if err := s.Dump(c.MemoryStoreDumpPath); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Processed block #%d, failure resolved as %s\n", f.BlockNumber, resolution)
+	return nil
+}
+
+func listFailures(m db.Store) error {
+	failures, err := m.GetProcessingFailures()
+	if err != nil {
+		return err
+	}
+	if len(failures) == 0 {
+		fmt.Println("No unresolved processing failures")
+		return nil
+	}
+	for _, f := range failures {
+		fmt.Printf("block #%d %s: %s\n", f.BlockNumber, f.BlockHash.ToString(), f.Error)
+		fmt.Printf("  tx=%s token=%s attempts=%d first=%s last=%s\n",
+			f.TxHash.ToString(), f.TokenTxHash.ToString(), f.Attempts,
+			f.FirstFailedAt.Format("2006-01-02T15:04:05Z"), f.LastFailedAt.Format("2006-01-02T15:04:05Z"))
+		for _, tokenHolder := range f.TokenHolders {
+			fmt.Printf("  holder %s amount=%d@#%d\n",
+				tokenHolder.Address.ToString(), tokenHolder.Amount, tokenHolder.BlockNumber)
+		}
+	}
+	return nil
+}
+
+func selectFailure(m db.Store, blockNumber int64) (*models.ProcessingFailure, error) {
+	if blockNumber >= 0 {
+		f, err := m.GetProcessingFailure(blockNumber)
+		if err == db.ErrNotFound {
+			return nil, fmt.Errorf("no unresolved processing failure at block #%d", blockNumber)
+		}
+		return f, err
+	}
+	failures, err := m.GetProcessingFailures()
+	if err != nil {
+		return nil, err
+	}
+	if len(failures) == 0 {
+		return nil, errors.New("no unresolved processing failures")
+	}
+	return failures[0], nil
+}
+
+func decodeFailedBlock(f *models.ProcessingFailure) (*generated.Block, error) {
+	if len(f.Block) == 0 {
+		return nil, fmt.Errorf("block #%d wasn't recorded, refetch it instead", f.BlockNumber)
+	}
+	block := &generated.Block{}
+	if err := proto.Unmarshal(f.Block, block); err != nil {
+		return nil, fmt.Errorf("failed to decode block #%d: %w", f.BlockNumber, err)
+	}
+	return block, nil
+}
+
+// refetchBlock fetches the block of the failure again, which must still
+// extend the indexed chain.
+func refetchBlock(c *config.Config, m db.Store, f *models.ProcessingFailure) (*generated.Block, error) {
+	var src blocksource.BlockSource
+	var err error
+	if *blocksDir != "" {
+		src, err = blocksource.NewFileBlockSource(*blocksDir)
+	} else {
+		qrlNodeConfig := c.GetQRLNodeConfig()
+		src, err = blocksource.NewGRPCBlockSource(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	block, err := src.GetBlockByNumber(uint64(f.BlockNumber))
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block #%d not found", f.BlockNumber)
+	}
+	last, err := m.GetLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	if last.Number != f.BlockNumber-1 || !bytes.Equal(block.Header.HashHeaderPrev, last.Hash[:]) {
+		return nil, fmt.Errorf("block #%d doesn't extend the indexed chain, which the indexer reorganizes by itself",
+			f.BlockNumber)
+	}
+	return block, nil
+}
+
+// rebuildTokenHolders replaces the holders and stats of the failing token
+// with those replayed from its token txs.
+func rebuildTokenHolders(m db.Store, f *models.ProcessingFailure) error {
+	if f.TokenTxHash == (common.Hash{}) {
+		return fmt.Errorf("failure at block #%d isn't related to a token", f.BlockNumber)
+	}
+	r, err := verify.Verify(m)
+	if err != nil {
+		return err
+	}
+	tokenReport := &verify.Report{CheckpointBlockNumber: r.CheckpointBlockNumber}
+	for _, d := range r.Discrepancies {
+		if d.TokenTxHash == f.TokenTxHash {
+			tokenReport.Discrepancies = append(tokenReport.Discrepancies, d)
+			fmt.Println(d)
+		}
+	}
+	repaired, err := verify.Repair(m, tokenReport)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Repaired %d of %d discrepancies of token %s\n",
+		repaired, len(tokenReport.Discrepancies), f.TokenTxHash.ToString())
+	return nil
+}
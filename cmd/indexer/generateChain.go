@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/log"
+)
+
+// generateChain writes a synthetic chain into block dump files, which the
+// indexer can then index with -blocks-dir.
+func generateChain(args []string) error {
+	c := chaingen.DefaultConfig()
+	fs := flag.NewFlagSet("generate-chain", flag.ExitOnError)
+	chainFlags(fs, c)
+	out := fs.String("out", "", "Directory of the block dump files, created if missing")
+	blocksPerFile := fs.Uint64("blocks-per-file", 1000, "Maximum number of blocks in each dump file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-out is required")
+	}
+
+	g, err := chaingen.NewGenerator(c)
+	if err != nil {
+		return err
+	}
+	chain := g.Generate()
+	if err := chain.WriteDump(*out, *blocksPerFile); err != nil {
+		return err
+	}
+
+	txs := 0
+	for _, b := range chain.Blocks {
+		txs += len(b.Transactions)
+	}
+	log.GetLogger().Info("Generated chain",
+		"height", chain.Height(),
+		"txs", txs,
+		"tokens", len(g.Tokens()),
+		"forks", len(chain.Segments)-1,
+		"out", *out)
+	return nil
+}
+
+// chainFlags defines the flags shaping a synthetic chain.
+func chainFlags(fs *flag.FlagSet, c *chaingen.Config) {
+	fs.Int64Var(&c.Seed, "seed", c.Seed, "Seed of the generator, the same seed always yields the same chain")
+	fs.Uint64Var(&c.Blocks, "blocks", c.Blocks, "Height of the canonical chain")
+	fs.IntVar(&c.Accounts, "accounts", c.Accounts, "Number of addresses sending and receiving tokens")
+	fs.IntVar(&c.MaxTxsPerBlock, "max-txs-per-block", c.MaxTxsPerBlock, "Maximum number of token txs in a block")
+	fs.IntVar(&c.MaxRecipients, "max-recipients", c.MaxRecipients, "Maximum number of initial holders or transfer recipients")
+	fs.Float64Var(&c.TokenRatio, "token-ratio", c.TokenRatio, "Fraction of token txs creating a token")
+	fs.Float64Var(&c.SlaveSignedRatio, "slave-signed-ratio", c.SlaveSignedRatio, "Fraction of txs carrying only a public key, without master address")
+	fs.Float64Var(&c.RepeatedRecipientRatio, "repeated-recipient-ratio", c.RepeatedRecipientRatio, "Fraction of tokens and transfers listing one holder or recipient twice")
+	fs.Float64Var(&c.SelfTransferRatio, "self-transfer-ratio", c.SelfTransferRatio, "Fraction of transfers listing their sender among the recipients")
+	fs.Float64Var(&c.ForkRatio, "fork-ratio", c.ForkRatio, "Probability for each block to be preceded by a competing fork")
+	fs.Uint64Var(&c.MaxForkDepth, "max-fork-depth", c.MaxForkDepth, "Maximum number of blocks abandoned by a fork")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/holders"
+	"github.com/cyyber/qrl-token-indexer/misc"
+)
+
+func holdersSnapshot(args []string) error {
+	fs := flag.NewFlagSet("holders-snapshot", flag.ExitOnError)
+	token := fs.String("token", "", "Hash of the tx that created the token, in hex")
+	height := fs.Int64("height", -1, "Block number of the snapshot")
+	format := fs.String("format", "csv", "Output format, either csv or json")
+	out := fs.String("out", "", "Output file, defaults to stdout")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	tokenTxHash, err := hex.DecodeString(*token)
+	if err != nil || len(tokenTxHash) != 32 {
+		return errors.New("-token must be a 32 byte hash in hex")
+	}
+	if *height < 0 {
+		return errors.New("-height is required")
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %s", *format)
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+
+	s, err := holders.NewSnapshot(m, misc.ToSizedHash(tokenTxHash), *height)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		return s.WriteJSON(w)
+	}
+	return s.WriteCSV(w)
+}
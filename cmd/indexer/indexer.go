@@ -1,25 +1,106 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 
+	"github.com/cyyber/qrl-token-indexer/blocksource"
 	"github.com/cyyber/qrl-token-indexer/client"
+	"github.com/cyyber/qrl-token-indexer/config"
 	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
 	"github.com/cyyber/qrl-token-indexer/log"
 )
 
-func run() error {
-	// Create MongoDB Processor
-	m, err := db.CreateMongoDBProcessor()
+// command is an operator subcommand, invoked as `indexer <name> [flags]`.
+// Without a subcommand the indexer runs and keeps syncing.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []*command{
+	{"export-blocks", "Export a range of blocks from the QRL node into a block archive", exportBlocks},
+	{"migrate", "Apply pending MongoDB schema migrations", migrate},
+	{"holders-snapshot", "Export the holders of a token at a block height as CSV or JSON", holdersSnapshot},
+	{"bootstrap", "Restore a state snapshot into an empty store and continue syncing from it", bootstrap},
+	{"verify", "Check the token holders and related txs against a replay of all token txs", verifyIndex},
+	{"reconcile", "Compare the indexed token balances of addresses with the node", reconcileBalances},
+	{"failures", "List the blocks quarantined by processing failures, and retry, refetch or rebuild them", failures},
+	{"state-hash", "Print the state hash at a height, to compare indexers", stateHash},
+	{"generate-chain", "Write a seeded synthetic chain of token txs into block dump files", generateChain},
+	{"bench", "Measure the throughput of processing and reverting a synthetic chain", benchmark},
+	{"config", "Validate and print the configuration, with secrets redacted", printConfig},
+}
+
+var blocksDir = flag.String("blocks-dir", "",
+	"Index blocks from the block dump files in this directory instead of the QRL node")
+
+func createStore(c *config.Config) (db.Store, error) {
+	switch c.StoreBackend {
+	case config.StoreBackendMongoDB:
+		// Create MongoDB Processor
+		return db.CreateMongoDBProcessor(c)
+	case config.StoreBackendMemory:
+		if c.MemoryStoreDumpPath == "" {
+			return memory.NewMemoryStore(c), nil
+		}
+		s, err := memory.LoadMemoryStore(c, c.MemoryStoreDumpPath)
+		if os.IsNotExist(err) {
+			return memory.NewMemoryStore(c), nil
+		}
+		return s, err
+	default:
+		return nil, fmt.Errorf("unknown store backend %s", c.StoreBackend)
+	}
+}
+
+func run(configFlags *config.Flags) error {
+	c, err := configFlags.Load()
 	if err != nil {
 		return err
 	}
+	logger := log.GetLogger()
+	for _, line := range strings.Split(strings.TrimSpace(c.String()), "\n") {
+		logger.Info("Config " + line)
+	}
 
-	nc, err := client.ConnectServer(m)
+	m, err := createStore(c)
 	if err != nil {
 		return err
 	}
+	return index(c, m)
+}
+
+// index keeps syncing m until interrupted.
+func index(c *config.Config, m db.Store) error {
+	var err error
+	if s, ok := m.(*memory.MemoryStore); ok && c.MemoryStoreDumpPath != "" {
+		defer func() {
+			if err := s.Dump(c.MemoryStoreDumpPath); err != nil {
+				log.GetLogger().Error("Failed to dump memory store",
+					"Error", err.Error())
+			}
+		}()
+	}
+
+	var nc *client.QRLIndexer
+	if *blocksDir != "" {
+		src, err := blocksource.NewFileBlockSource(*blocksDir)
+		if err != nil {
+			return err
+		}
+		nc = client.NewQRLIndexer(src, m, c)
+	} else {
+		nc, err = client.ConnectServer(m, c)
+		if err != nil {
+			return err
+		}
+	}
 	go nc.Start()
 	defer nc.Stop()
 	quit := make(chan os.Signal, 1)
@@ -28,10 +109,10 @@ func run() error {
 	return nil
 }
 
-func start() {
+func start(configFlags *config.Flags) {
 	logger := log.GetLogger()
 
-	err := run()
+	err := run(configFlags)
 	if err != nil {
 		logger.Error("Error while starting Indexer",
 			"Error", err.Error())
@@ -39,11 +120,39 @@ func start() {
 	}
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-16s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags when running the indexer:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
 	logger := log.GetLogger()
+
+	if len(os.Args) > 1 {
+		for _, c := range commands {
+			if c.name != os.Args[1] {
+				continue
+			}
+			if err := c.run(os.Args[2:]); err != nil {
+				logger.Error("Error while running command",
+					"Command", c.name,
+					"Error", err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	configFlags := config.NewFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
 	logger.Info("Starting Indexer")
 
-	start()
+	start(configFlags)
 
 	logger.Info("Shutting Down Indexer")
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+)
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only list the migrations that would be applied")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	m, err := db.ConnectMongoDBProcessor(c)
+	if err != nil {
+		return err
+	}
+	version, err := m.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database schema version %d, latest schema version %d\n", version, db.LatestSchemaVersion())
+
+	if !*dryRun {
+		// Migrations expect the collections and their indexes to exist, and
+		// no block left half applied
+		if err := m.ReconcileIndexes(); err != nil {
+			return err
+		}
+		if err := m.RecoverJournal(); err != nil {
+			return err
+		}
+	}
+	applied, err := m.Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("Database schema is up to date")
+		return nil
+	}
+	for _, migration := range applied {
+		if *dryRun {
+			fmt.Printf("Would apply migration %d: %s\n", migration.Version, migration.Description)
+		} else {
+			fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Description)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+)
+
+// printConfig prints the configuration layered from the defaults, the config
+// file, the environment and the flags, to check it before starting.
+func printConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	fmt.Print(c.String())
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/cyyber/qrl-token-indexer/alert"
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/reconcile"
+)
+
+func reconcileBalances(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	addressList := fs.String("addresses", "",
+		"Comma separated addresses in hex, optionally Q prefixed, defaults to a sample of token holders")
+	sampleSize := fs.Int("sample", 0, "Number of token holders sampled, defaults to ReconcileSampleSize")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	addresses, err := parseAddresses(*addressList)
+	if err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	if c.StoreBackend != config.StoreBackendMongoDB {
+		return errors.New("reconcile requires the mongodb store")
+	}
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+	s, ok := m.(reconcile.Store)
+	if !ok {
+		return errors.New("store cannot be reconciled")
+	}
+
+	qrlNodeConfig := c.GetQRLNodeConfig()
+	src, err := blocksource.NewGRPCBlockSource(fmt.Sprintf("%s:%d", qrlNodeConfig.IP, qrlNodeConfig.PublicAPIPort))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	r := reconcile.NewReconciler(src.GetPublicAPIClient(), s, alert.NewAlerter(c), c)
+	var report *models.ReconciliationReport
+	if len(addresses) > 0 {
+		report, err = r.Reconcile(addresses)
+	} else {
+		size := c.ReconcileSampleSize
+		if *sampleSize > 0 {
+			size = *sampleSize
+		}
+		report, err = r.ReconcileSample(size)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, a := range report.Addresses {
+		fmt.Printf("Q%s at block #%d: %s", hex.EncodeToString(a.Address[:]), a.BlockNumber, a.Status)
+		if a.Detail != "" {
+			fmt.Printf(" (%s)", a.Detail)
+		}
+		fmt.Println()
+		for _, mismatch := range a.Mismatches {
+			fmt.Printf("  token %s: node %d, indexer %d\n",
+				hex.EncodeToString(mismatch.TokenTxHash[:]), mismatch.NodeBalance, mismatch.IndexerBalance)
+		}
+	}
+	fmt.Printf("Matched %d, mismatched %d, skipped %d\n", report.Matched, report.Mismatched, report.Skipped)
+	if report.Mismatched > 0 {
+		return fmt.Errorf("%d addresses disagree with the node", report.Mismatched)
+	}
+	return nil
+}
+
+func parseAddresses(list string) ([]common.Address, error) {
+	var addresses []common.Address
+	if list == "" {
+		return addresses, nil
+	}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "Q")
+		address, err := hex.DecodeString(s)
+		if err != nil || len(address) != len(common.Address{}) {
+			return nil, fmt.Errorf("invalid address %s", s)
+		}
+		addresses = append(addresses, misc.ToSizedAddress(address))
+	}
+	return addresses, nil
+}
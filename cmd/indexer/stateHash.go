@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+)
+
+// stateHash prints the state hash at a height, which matches between
+// indexers agreeing on every token holder balance up to that height.
+func stateHash(args []string) error {
+	fs := flag.NewFlagSet("state-hash", flag.ExitOnError)
+	height := fs.Int64("height", -1, "Block number of the state hash, defaults to the last processed block")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := m.GetCheckpoint()
+	if err != nil {
+		return fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	blockNumber := *height
+	if blockNumber < 0 {
+		blockNumber = checkpoint.BlockNumber
+	}
+	if blockNumber > checkpoint.BlockNumber {
+		return fmt.Errorf("block #%d not processed yet, last processed block is #%d",
+			blockNumber, checkpoint.BlockNumber)
+	}
+
+	stateCommitment, err := m.GetStateCommitment(blockNumber)
+	if err == db.ErrNotFound {
+		var zero common.Hash
+		fmt.Printf("#%d %s (no balance changed yet)\n", blockNumber, zero.ToString())
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("#%d %s (last changed at block #%d)\n",
+		blockNumber, stateCommitment.Hash.ToString(), stateCommitment.BlockNumber)
+	return nil
+}
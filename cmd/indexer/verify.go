@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/verify"
+)
+
+func verifyIndex(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Fix the discrepancies found")
+	configFlags := config.NewFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := configFlags.Load()
+	if err != nil {
+		return err
+	}
+	m, err := createStore(c)
+	if err != nil {
+		return err
+	}
+
+	r, err := verify.Verify(m)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Verified %d token txs, %d transfer token txs and %d token holders up to block #%d\n",
+		r.TokenTxs, r.TransferTokenTxs, r.TokenHolders, r.CheckpointBlockNumber)
+	for _, d := range r.Discrepancies {
+		fmt.Println(d)
+	}
+	if len(r.Discrepancies) == 0 {
+		fmt.Println("No discrepancies found")
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d discrepancies found", len(r.Discrepancies))
+	}
+
+	repaired, err := verify.Repair(m, r)
+	if err != nil {
+		return err
+	}
+	if s, ok := m.(*memory.MemoryStore); ok && c.MemoryStoreDumpPath != "" {
+		if err := s.Dump(c.MemoryStoreDumpPath); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Repaired %d of %d discrepancies\n", repaired, len(r.Discrepancies))
+	if repaired < len(r.Discrepancies) {
+		return fmt.Errorf("%d discrepancies cannot be repaired", len(r.Discrepancies)-repaired)
+	}
+	return nil
+}
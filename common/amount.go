@@ -0,0 +1,57 @@
+package common
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrAmountOverflow  = errors.New("token amount overflows uint64")
+	ErrAmountUnderflow = errors.New("token amount underflows zero")
+)
+
+// Amount is a token amount in the smallest unit of the token. The chain allows
+// any uint64 amount, so amounts must never be converted to int64.
+type Amount uint64
+
+// Add returns a + b, or ErrAmountOverflow if the sum doesn't fit in an Amount.
+func (a Amount) Add(b Amount) (Amount, error) {
+	if uint64(b) > math.MaxUint64-uint64(a) {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// Sub returns a - b, or ErrAmountUnderflow if b is greater than a.
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, ErrAmountUnderflow
+	}
+	return a - b, nil
+}
+
+// Format returns the amount in whole tokens of a token with the given decimals.
+func (a Amount) Format(decimals uint64) string {
+	return FormatUnits(new(big.Int).SetUint64(uint64(a)), decimals)
+}
+
+// FormatUnits returns value, in the smallest unit of a token with the given
+// decimals, as a decimal string in whole tokens, such as "12.050" for 12050
+// with 3 decimals.
+func FormatUnits(value *big.Int, decimals uint64) string {
+	digits := new(big.Int).Abs(value).String()
+	sign := ""
+	if value.Sign() < 0 {
+		sign = "-"
+	}
+	if decimals == 0 {
+		return sign + digits
+	}
+	if uint64(len(digits)) <= decimals {
+		digits = strings.Repeat("0", int(decimals)-len(digits)+1) + digits
+	}
+	point := len(digits) - int(decimals)
+	return sign + digits[:point] + "." + digits[point:]
+}
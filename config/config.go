@@ -1,10 +1,46 @@
 package config
 
+import "time"
+
+const (
+	StoreBackendMongoDB = "mongodb"
+	StoreBackendMemory  = "memory"
+)
+
+// Config is layered from the defaults of DefaultConfig, a config file, the
+// QRLTI_* environment variables and the command line flags, see Load.
 type Config struct {
-	qrlNodeConfig *QRLNodeConfig
-	mongoDBConfig *MongoDBConfig
+	QRLNode QRLNodeConfig
+	MongoDB MongoDBConfig
+
+	// StoreBackend is either StoreBackendMongoDB or StoreBackendMemory
+	StoreBackend string
+	// MemoryStoreDumpPath is where the memory store is loaded from at startup
+	// and dumped to at shutdown. Empty to keep the store purely in memory.
+	MemoryStoreDumpPath string
+
+	ReOrgLimit        uint64
+	FinalityThreshold uint64
+
+	// BlockPollInterval is the time between polls of the node for new blocks
+	BlockPollInterval time.Duration
+
+	PendingTxPollInterval time.Duration
+	PendingTxExpiry       time.Duration
 
-	ReOrgLimit uint64
+	// SnapshotInterval is the number of blocks between state snapshots
+	// written to SnapshotDir, or 0 to disable them
+	SnapshotInterval  uint64
+	SnapshotDir       string
+	SnapshotsRetained int
+
+	// ReconcileInterval is the time between reconciliations of a sample of
+	// ReconcileSampleSize token holders against the node, or 0 to disable them
+	ReconcileInterval   time.Duration
+	ReconcileSampleSize int
+
+	// AlertWebhookURL receives alerts as JSON, in addition to the log
+	AlertWebhookURL string
 }
 
 type QRLNodeConfig struct {
@@ -18,30 +54,51 @@ type MongoDBConfig struct {
 	Port     uint16
 	Username string
 	Password string
+	// Standalone is set for a MongoDB without replica set, which doesn't
+	// support transactions. Block changes are then written through a journal.
+	Standalone bool
+	// DropObsoleteIndexes drops indexes found at startup which are not part
+	// of the index spec. Otherwise they are only reported.
+	DropObsoleteIndexes bool
 }
 
-func GetConfig() *Config {
+// DefaultConfig returns the built-in defaults, which Load overrides.
+func DefaultConfig() *Config {
 	c := &Config{
-		qrlNodeConfig: &QRLNodeConfig{
+		QRLNode: QRLNodeConfig{
 			IP:            "127.0.0.1", // IP address of Python QRL node with PublicAPI support
 			PublicAPIPort: 19009,
 		},
-		mongoDBConfig: &MongoDBConfig{
+		MongoDB: MongoDBConfig{
 			DBName:   "QRLTokenIndexer",
 			Host:     "127.0.0.1",
 			Port:     27017, // Default MongoDB port
 			Username: "",
 			Password: "",
 		},
-		ReOrgLimit: 350,
+		StoreBackend:      StoreBackendMongoDB,
+		ReOrgLimit:        350,
+		FinalityThreshold: 350, // Confirmations after which an indexed record is treated as final
+
+		BlockPollInterval: 10 * time.Second,
+
+		PendingTxPollInterval: 5 * time.Second,
+		PendingTxExpiry:       30 * time.Minute, // Unconfirmed txs not mined within this duration are dropped
+
+		SnapshotInterval:  0,
+		SnapshotDir:       "snapshots",
+		SnapshotsRetained: 3, // Older snapshots are removed once a new one is written
+
+		ReconcileInterval:   time.Hour,
+		ReconcileSampleSize: 100,
 	}
 	return c
 }
 
 func (c *Config) GetQRLNodeConfig() *QRLNodeConfig {
-	return c.qrlNodeConfig
+	return &c.QRLNode
 }
 
 func (c *Config) GetMongoDBConfig() *MongoDBConfig {
-	return c.mongoDBConfig
+	return &c.MongoDB
 }
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ConfigEnv names the environment variable giving the config file, when no
+// -config flag is set
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Flags registers the -config flag and a flag per setting on a FlagSet, and
+// loads the config they select.
+type Flags struct {
+	path   string
+	values map[string]string
+}
+
+func NewFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{values: make(map[string]string)}
+	fs.StringVar(&f.path, "config", "",
+		"Config file in YAML, TOML or JSON, defaults to $"+ConfigEnv)
+	defaults := DefaultConfig()
+	for _, s := range settings {
+		usage := s.usage
+		if value := s.get(defaults); value != "" {
+			usage += fmt.Sprintf(" (default %s)", value)
+		}
+		usage += fmt.Sprintf(" [$%s]", s.envName())
+		fs.Var(&settingFlag{s: s, values: f.values}, s.flag, usage)
+	}
+	return f
+}
+
+// IsSet reports whether the setting with key was given as a flag.
+func (f *Flags) IsSet(key string) bool {
+	_, ok := f.values[key]
+	return ok
+}
+
+// Load loads the config from the config file, the environment and the flags
+// parsed.
+func (f *Flags) Load() (*Config, error) {
+	path := f.path
+	if path == "" {
+		path = os.Getenv(ConfigEnv)
+	}
+	return Load(path, f.values)
+}
+
+// settingFlag records the value of a setting given as a flag, to be applied
+// by Load after the config file and the environment.
+type settingFlag struct {
+	s      *setting
+	values map[string]string
+}
+
+func (f *settingFlag) String() string {
+	if f.s == nil {
+		return ""
+	}
+	return f.values[f.s.key]
+}
+
+// Set rejects invalid values while parsing the flags.
+func (f *settingFlag) Set(value string) error {
+	if err := f.s.set(DefaultConfig(), value); err != nil {
+		return err
+	}
+	f.values[f.s.key] = value
+	return nil
+}
+
+// IsBoolFlag allows boolean settings to be set by a flag without value.
+func (f *settingFlag) IsBoolFlag() bool {
+	_, ok := f.s.field(DefaultConfig()).(*bool)
+	return ok
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Load returns the defaults overridden by the config file at path, if any,
+// then by the QRLTI_* environment variables, then by flagValues, keyed by
+// setting. The config is validated.
+func Load(path string, flagValues map[string]string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.envName()); ok {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.envName(), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flagValues[s.key]; ok {
+			if err := s.set(c, value); err != nil {
+				return nil, fmt.Errorf("-%s: %w", s.flag, err)
+			}
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile applies the settings of a YAML, TOML or JSON file, told apart by
+// their extension. Settings are nested by the dots of their keys, e.g.
+// mongoDB.host is the host under mongoDB.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("config file %s is neither .yaml, .yml, .toml nor .json", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	flat := make(map[string]interface{})
+	flatten("", values, flat)
+	for key, value := range flat {
+		s := findSetting(key)
+		if s == nil {
+			return fmt.Errorf("unknown setting %s in config file %s", key, path)
+		}
+		if err := s.set(c, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func flatten(prefix string, values map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range values {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flatten(key, nested, flat)
+			continue
+		}
+		flat[key] = value
+	}
+}
+
+// Validate checks that the settings are consistent, reporting every invalid
+// setting at once.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.StoreBackend == StoreBackendMongoDB || c.StoreBackend == StoreBackendMemory,
+		"storeBackend must be %s or %s, got %q", StoreBackendMongoDB, StoreBackendMemory, c.StoreBackend)
+	check(c.QRLNode.IP != "", "qrlNode.ip is required")
+	check(c.QRLNode.PublicAPIPort != 0, "qrlNode.publicAPIPort is required")
+	if c.StoreBackend == StoreBackendMongoDB {
+		check(c.MongoDB.DBName != "", "mongoDB.dbName is required")
+		check(c.MongoDB.Host != "", "mongoDB.host is required")
+		check(c.MongoDB.Port != 0, "mongoDB.port is required")
+		check(c.MongoDB.Password == "" || c.MongoDB.Username != "",
+			"mongoDB.password is set without mongoDB.username")
+	}
+	check(c.ReOrgLimit > 0, "reOrgLimit must be greater than 0")
+	check(c.FinalityThreshold > 0, "finalityThreshold must be greater than 0")
+	check(c.BlockPollInterval > 0, "blockPollInterval must be greater than 0")
+	check(c.PendingTxPollInterval > 0, "pendingTxPollInterval must be greater than 0")
+	check(c.PendingTxExpiry > 0, "pendingTxExpiry must be greater than 0")
+	if c.SnapshotInterval > 0 {
+		check(c.SnapshotDir != "", "snapshotDir is required when snapshotInterval is set")
+		check(c.SnapshotsRetained > 0, "snapshotsRetained must be greater than 0 when snapshotInterval is set")
+	}
+	check(c.ReconcileInterval >= 0, "reconcileInterval must not be negative")
+	if c.ReconcileInterval > 0 {
+		check(c.ReconcileSampleSize > 0, "reconcileSampleSize must be greater than 0 when reconcileInterval is set")
+	}
+	if c.AlertWebhookURL != "" {
+		u, err := url.Parse(c.AlertWebhookURL)
+		// The URL itself isn't reported, as it usually embeds a token
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"alertWebhookURL must be an http or https URL")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
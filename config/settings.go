@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings
+const EnvPrefix = "QRLTI_"
+
+// setting is a field of Config which can be set from a config file, an
+// environment variable and a flag.
+type setting struct {
+	// key is the path of the setting in config files
+	key string
+	// flag is the name of the flag, and of the environment variable once
+	// upper cased with the EnvPrefix
+	flag  string
+	usage string
+	// secret settings are redacted when printing the config
+	secret bool
+	field  func(c *Config) interface{}
+}
+
+var settings = []*setting{
+	{"qrlNode.ip", "qrl-node-ip", "IP address of the QRL node with PublicAPI support", false,
+		func(c *Config) interface{} { return &c.QRLNode.IP }},
+	{"qrlNode.publicAPIPort", "qrl-node-public-api-port", "PublicAPI port of the QRL node", false,
+		func(c *Config) interface{} { return &c.QRLNode.PublicAPIPort }},
+	{"mongoDB.dbName", "mongodb-db-name", "MongoDB database name", false,
+		func(c *Config) interface{} { return &c.MongoDB.DBName }},
+	{"mongoDB.host", "mongodb-host", "MongoDB host", false,
+		func(c *Config) interface{} { return &c.MongoDB.Host }},
+	{"mongoDB.port", "mongodb-port", "MongoDB port", false,
+		func(c *Config) interface{} { return &c.MongoDB.Port }},
+	{"mongoDB.username", "mongodb-username", "MongoDB username, empty to connect without authentication", false,
+		func(c *Config) interface{} { return &c.MongoDB.Username }},
+	{"mongoDB.password", "mongodb-password", "MongoDB password", true,
+		func(c *Config) interface{} { return &c.MongoDB.Password }},
+	{"mongoDB.standalone", "mongodb-standalone", "Write through a journal for a MongoDB without replica set", false,
+		func(c *Config) interface{} { return &c.MongoDB.Standalone }},
+	{"mongoDB.dropObsoleteIndexes", "mongodb-drop-obsolete-indexes", "Drop the indexes which are not part of the index spec", false,
+		func(c *Config) interface{} { return &c.MongoDB.DropObsoleteIndexes }},
+	{"storeBackend", "store", "Storage backend, either mongodb or memory", false,
+		func(c *Config) interface{} { return &c.StoreBackend }},
+	{"memoryStoreDumpPath", "memory-dump", "File the memory store is loaded from at startup and dumped to at shutdown", false,
+		func(c *Config) interface{} { return &c.MemoryStoreDumpPath }},
+	{"reOrgLimit", "reorg-limit", "Number of blocks which can be reverted by a fork", false,
+		func(c *Config) interface{} { return &c.ReOrgLimit }},
+	{"finalityThreshold", "finality-threshold", "Confirmations after which an indexed record is final", false,
+		func(c *Config) interface{} { return &c.FinalityThreshold }},
+	{"blockPollInterval", "block-poll-interval", "Time between polls of the node for new blocks", false,
+		func(c *Config) interface{} { return &c.BlockPollInterval }},
+	{"pendingTxPollInterval", "pending-tx-poll-interval", "Time between polls of the node for pending txs", false,
+		func(c *Config) interface{} { return &c.PendingTxPollInterval }},
+	{"pendingTxExpiry", "pending-tx-expiry", "Time after which pending txs not mined are dropped", false,
+		func(c *Config) interface{} { return &c.PendingTxExpiry }},
+	{"snapshotInterval", "snapshot-interval", "Number of blocks between state snapshots, 0 to disable them", false,
+		func(c *Config) interface{} { return &c.SnapshotInterval }},
+	{"snapshotDir", "snapshot-dir", "Directory of the state snapshots", false,
+		func(c *Config) interface{} { return &c.SnapshotDir }},
+	{"snapshotsRetained", "snapshots-retained", "Number of state snapshots kept", false,
+		func(c *Config) interface{} { return &c.SnapshotsRetained }},
+	{"reconcileInterval", "reconcile-interval", "Time between reconciliations against the node, 0 to disable them", false,
+		func(c *Config) interface{} { return &c.ReconcileInterval }},
+	{"reconcileSampleSize", "reconcile-sample-size", "Number of token holders reconciled at a time", false,
+		func(c *Config) interface{} { return &c.ReconcileSampleSize }},
+	{"alertWebhookURL", "alert-webhook-url", "URL receiving alerts as JSON", true,
+		func(c *Config) interface{} { return &c.AlertWebhookURL }},
+}
+
+func findSetting(key string) *setting {
+	for _, s := range settings {
+		if s.key == key {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *setting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+// set parses value into the field of the setting in c.
+func (s *setting) set(c *Config, value string) error {
+	var err error
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *uint16:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 16)
+		*field = uint16(v)
+	case *uint64:
+		*field, err = strconv.ParseUint(value, 10, 64)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	default:
+		err = fmt.Errorf("unsupported type %T", field)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", s.key, value, err)
+	}
+	return nil
+}
+
+// get returns the value of the setting in c, redacted if secret.
+func (s *setting) get(c *Config) string {
+	value := fmt.Sprint(fieldValue(s.field(c)))
+	if s.secret && value != "" {
+		return "<redacted>"
+	}
+	return value
+}
+
+func fieldValue(field interface{}) interface{} {
+	switch field := field.(type) {
+	case *string:
+		return *field
+	case *bool:
+		return *field
+	case *int:
+		return *field
+	case *uint16:
+		return *field
+	case *uint64:
+		return *field
+	case *time.Duration:
+		return *field
+	default:
+		return field
+	}
+}
+
+// String returns the settings of c as key = value lines, with the secrets
+// redacted, to be printed or logged.
+func (c *Config) String() string {
+	var b strings.Builder
+	for _, s := range settings {
+		fmt.Fprintf(&b, "%s = %s\n", s.key, s.get(c))
+	}
+	return b.String()
+}
@@ -0,0 +1,470 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// IsBlockProcessed reports whether b has already been applied, so that a block
+// replayed after a crash or restart is not applied twice. It returns an error if
+// a different block has been applied at the same height.
+func IsBlockProcessed(r StoreReader, b *generated.Block) (bool, error) {
+	blockModel := models.NewBlockFromPBData(b)
+	storedBlock, err := r.GetBlockByNumber(blockModel.Number)
+	if err == nil {
+		if storedBlock.Hash != blockModel.Hash {
+			return false, fmt.Errorf("block #%d already processed with hash %s instead of %s",
+				blockModel.Number, storedBlock.Hash.ToString(), blockModel.Hash.ToString())
+		}
+		return true, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+
+	// Blocks beyond the reorg limit are pruned, so the checkpoint is used to
+	// tell whether an older block has been processed
+	checkpoint, err := r.GetCheckpoint()
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return blockModel.Number <= checkpoint.BlockNumber, nil
+}
+
+func GetTokenHoldersWithCache(r StoreReader, transferTokenTx *models.TransferTokenTx, cache models.TokenHoldersCache) (models.TokenHolders, error) {
+	if cache == nil {
+		return nil, errors.New("TokenHoldersCache required")
+	}
+	var err error
+
+	tokenHolders := make(models.TokenHolders)
+
+	fromTokenHolder := cache.Get(transferTokenTx.TokenTxHash, transferTokenTx.From)
+	countTokenHolderCacheLookup(fromTokenHolder != nil)
+	if fromTokenHolder == nil {
+		fromTokenHolder, err = r.GetTokenHolder(transferTokenTx.TokenTxHash, transferTokenTx.From)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tokenHolders[transferTokenTx.From] = fromTokenHolder
+
+	for _, address := range transferTokenTx.Addresses {
+		tokenHolder := cache.Get(transferTokenTx.TokenTxHash, address)
+		countTokenHolderCacheLookup(tokenHolder != nil)
+		if tokenHolder == nil {
+			tokenHolder, err = r.GetTokenHolder(transferTokenTx.TokenTxHash, address)
+			if err != nil {
+				if err != ErrNotFound {
+					return nil, err
+				}
+				tokenHolder = models.NewTokenHolder(transferTokenTx.TokenTxHash, address, 0)
+			}
+		}
+
+		tokenHolders[address] = tokenHolder
+	}
+	return tokenHolders, nil
+}
+
+// touchedTokenHolders keeps the token holders changed by a block, in the order
+// they were first changed.
+type touchedTokenHolders struct {
+	seen         map[*models.TokenHolder]bool
+	tokenHolders []*models.TokenHolder
+}
+
+func newTouchedTokenHolders() *touchedTokenHolders {
+	return &touchedTokenHolders{
+		seen: make(map[*models.TokenHolder]bool),
+	}
+}
+
+func (t *touchedTokenHolders) Add(tokenHolders models.TokenHolders) {
+	for _, tokenHolder := range tokenHolders {
+		if t.seen[tokenHolder] {
+			continue
+		}
+		t.seen[tokenHolder] = true
+		t.tokenHolders = append(t.tokenHolders, tokenHolder)
+	}
+}
+
+// beforeImageRecorder records the before image of every token holder read
+// from the store while processing a block.
+type beforeImageRecorder struct {
+	StoreReader
+	undoRecord *models.UndoRecord
+}
+
+func (b *beforeImageRecorder) GetTokenHolder(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error) {
+	tokenHolder, err := b.StoreReader.GetTokenHolder(tokenTxHash, address)
+	if err == nil || err == ErrNotFound {
+		b.undoRecord.AddBeforeImage(tokenTxHash, address, tokenHolder)
+	}
+	return tokenHolder, err
+}
+
+// NewProcessBlockChanges computes the changes made by processing b on top of
+// the state read from r.
+func NewProcessBlockChanges(r StoreReader, b *generated.Block, reOrgLimit uint64) (*models.BlockChanges, error) {
+	blockModel := models.NewBlockFromPBData(b)
+	changes := &models.BlockChanges{
+		Operation:         models.CheckpointOperationProcessBlock,
+		Block:             blockModel,
+		PrunedBlockNumber: -1,
+		Checkpoint: models.NewCheckpoint(blockModel.Number, blockModel.Hash,
+			models.CheckpointOperationProcessBlock),
+	}
+
+	maxRetained := common.BLOCKZERO + reOrgLimit
+	if uint64(blockModel.Number) > maxRetained {
+		changes.PrunedBlockNumber = int64(uint64(blockModel.Number) - maxRetained)
+	}
+
+	changes.UndoRecord = models.NewUndoRecord(blockModel)
+	r = &beforeImageRecorder{StoreReader: r, undoRecord: changes.UndoRecord}
+
+	tokenHoldersCache := make(models.TokenHoldersCache)
+	touched := newTouchedTokenHolders()
+
+	for txIndex, protoTX := range b.Transactions {
+		switch protoTX.TransactionType.(type) {
+		case *generated.Transaction_Token_:
+			tokenTx := models.NewTokenTxFromPBData(b.Header.BlockNumber, protoTX)
+			tokenTx.BlockHash, tokenTx.TxIndex = blockModel.Hash, txIndex
+			changes.TokenTxs = append(changes.TokenTxs, tokenTx)
+
+			tokenHolders, err := tokenTx.GetTokenHolders()
+			if err != nil {
+				e := newProcessingError(b, err)
+				e.Failure.TxHash, e.Failure.TokenTxHash = tokenTx.TxHash, tokenTx.TxHash
+				return nil, e
+			}
+			for _, tokenHolder := range tokenHolders {
+				changes.UndoRecord.AddBeforeImage(tokenHolder.TokenTxHash, tokenHolder.Address, nil)
+			}
+			tokenHoldersCache.PutFromTokenHolders(tokenHolders)
+			touched.Add(tokenHolders)
+			changes.BalanceChanges = append(changes.BalanceChanges,
+				tokenTx.GetBalanceChanges(txIndex, blockModel.Timestamp, tokenHolders)...)
+		case *generated.Transaction_TransferToken_:
+			transferTokenTx := models.NewTransferTokenTxFromPBData(b.Header.BlockNumber, protoTX)
+			transferTokenTx.BlockHash, transferTokenTx.TxIndex = blockModel.Hash, txIndex
+			changes.TransferTokenTxs = append(changes.TransferTokenTxs, transferTokenTx)
+			changes.TokenRelatedTxs = append(changes.TokenRelatedTxs, transferTokenTx.GetTokenRelatedTx())
+
+			tokenHolders, err := GetTokenHoldersWithCache(r, transferTokenTx, tokenHoldersCache)
+			if err != nil {
+				err = fmt.Errorf("failed to get token holders for txhash %s: %w",
+					transferTokenTx.TxHash.ToString(), err)
+				// The sender holds none of the token
+				if errors.Is(err, ErrNotFound) {
+					return nil, newTransferProcessingError(b, transferTokenTx, nil, err)
+				}
+				return nil, err
+			}
+			states := tokenHolderStates(tokenHolders, transferTokenTx)
+			err = tokenHolders.Apply(transferTokenTx)
+			if err != nil {
+				return nil, newTransferProcessingError(b, transferTokenTx, states, err)
+			}
+			tokenHoldersCache.PutFromTokenHolders(tokenHolders)
+			touched.Add(tokenHolders)
+			changes.BalanceChanges = append(changes.BalanceChanges,
+				transferTokenTx.GetBalanceChanges(txIndex, blockModel.Timestamp, tokenHolders)...)
+		default:
+			continue
+		}
+	}
+
+	changes.TokenHolders = touched.tokenHolders
+	if err := commitState(r, changes); err != nil {
+		return nil, err
+	}
+	tokenTxHash, err := updateTokenStats(r, changes, beforeImageAmounts(changes.UndoRecord))
+	if err != nil {
+		if tokenTxHash == (common.Hash{}) {
+			return nil, err
+		}
+		e := newProcessingError(b, err)
+		e.Failure.TokenTxHash = tokenTxHash
+		return nil, e
+	}
+	return changes, nil
+}
+
+// commitState chains the balance changes of the block to the last state
+// commitment, and sets the resulting state hash on the block.
+func commitState(r StoreReader, changes *models.BlockChanges) error {
+	var prevHash common.Hash
+	prev, err := r.GetStateCommitment(changes.Block.Number - 1)
+	if err == nil {
+		prevHash = prev.Hash
+	} else if err != ErrNotFound {
+		return fmt.Errorf("failed to get state commitment: %w", err)
+	}
+	if len(changes.BalanceChanges) == 0 {
+		changes.Block.StateHash = prevHash
+		return nil
+	}
+	changes.StateCommitment = models.NewStateCommitment(changes.Block.Number, changes.Block.Hash,
+		prevHash, changes.BalanceChanges)
+	changes.Block.StateHash = changes.StateCommitment.Hash
+	return nil
+}
+
+// tokenHolderStates returns copies of the holders of a transfer, sender
+// first, to record their states before the transfer is applied.
+func tokenHolderStates(tokenHolders models.TokenHolders, transferTokenTx *models.TransferTokenTx) []*models.TokenHolder {
+	var states []*models.TokenHolder
+	seen := make(map[common.Address]bool)
+	for _, address := range append([]common.Address{transferTokenTx.From}, transferTokenTx.Addresses...) {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		t := *tokenHolders[address]
+		states = append(states, &t)
+	}
+	return states
+}
+
+// NewRevertBlockChanges computes the changes undoing the last processed block
+// b, based on the state read from r.
+func NewRevertBlockChanges(r StoreReader, b *models.Block) (*models.BlockChanges, error) {
+	tokenTxs, err := r.GetTokenTxsByBlockNumber(b.Number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token txs by block number: %w", err)
+	}
+	transferTokenTxs, err := r.GetTransferTokenTxsByBlockNumber(b.Number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transfer token txs by block number: %w", err)
+	}
+
+	// After the revert, the parent block becomes the last processed block
+	var parentHash common.Hash
+	parent, err := r.GetBlockByNumber(b.Number - 1)
+	if err == nil {
+		parentHash = parent.Hash
+	} else if err != ErrNotFound {
+		return nil, fmt.Errorf("failed to get parent block: %w", err)
+	}
+
+	changes := &models.BlockChanges{
+		Operation:         models.CheckpointOperationRevertLastBlock,
+		Block:             b,
+		PrunedBlockNumber: -1,
+		TokenTxs:          tokenTxs,
+		TransferTokenTxs:  transferTokenTxs,
+		Checkpoint: models.NewCheckpoint(b.Number-1, parentHash,
+			models.CheckpointOperationRevertLastBlock),
+	}
+	for _, transferTokenTx := range transferTokenTxs {
+		changes.TokenRelatedTxs = append(changes.TokenRelatedTxs, transferTokenTx.GetTokenRelatedTx())
+	}
+
+	undoRecord, err := r.GetUndoRecord(b.Number)
+	if err == nil && undoRecord.BlockHash == b.Hash {
+		changes.UndoRecord = undoRecord
+		restoreBeforeImages(changes, undoRecord)
+	} else if err != nil && err != ErrNotFound {
+		return nil, fmt.Errorf("failed to get undo record: %w", err)
+	} else {
+		// Blocks processed before undo records were kept are reverted by
+		// reverting each of their transfers
+		err = revertTokenHolders(r, changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	before, err := storedAmounts(r, changes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := updateTokenStats(r, changes, before); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// restoreBeforeImages restores every token holder changed by the block to its
+// state before the block.
+func restoreBeforeImages(changes *models.BlockChanges, undoRecord *models.UndoRecord) {
+	for _, image := range undoRecord.TokenHolders {
+		if image.TokenHolder != nil {
+			changes.TokenHolders = append(changes.TokenHolders, image.TokenHolder)
+		} else {
+			changes.RemovedTokenHolders = append(changes.RemovedTokenHolders,
+				models.NewTokenHolder(image.TokenTxHash, image.Address, 0))
+		}
+	}
+}
+
+func revertTokenHolders(r StoreReader, changes *models.BlockChanges) error {
+	tokenTxs := changes.TokenTxs
+	transferTokenTxs := changes.TransferTokenTxs
+
+	tokenHoldersCache := make(models.TokenHoldersCache)
+	touched := newTouchedTokenHolders()
+
+	for i := len(transferTokenTxs) - 1; i >= 0; i-- {
+		transferTokenTx := transferTokenTxs[i]
+
+		tokenHolders, err := GetTokenHoldersWithCache(r, transferTokenTx, tokenHoldersCache)
+		if err != nil {
+			return fmt.Errorf("failed to get token holders for txhash %s: %w",
+				transferTokenTx.TxHash.ToString(), err)
+		}
+		err = tokenHolders.Revert(transferTokenTx)
+		if err != nil {
+			return err
+		}
+		tokenHoldersCache.PutFromTokenHolders(tokenHolders)
+		touched.Add(tokenHolders)
+	}
+
+	// Holders of tokens created in this block are removed altogether
+	createdTokens := make(map[common.Hash]bool)
+	for _, tokenTx := range tokenTxs {
+		createdTokens[tokenTx.TxHash] = true
+		tokenHolders, err := tokenTx.GetTokenHolders()
+		if err != nil {
+			return err
+		}
+		for _, tokenHolder := range tokenHolders {
+			if cached := tokenHoldersCache.Get(tokenHolder.TokenTxHash, tokenHolder.Address); cached != nil {
+				continue
+			}
+			tokenHoldersCache.Put(tokenHolder.TokenTxHash, tokenHolder.Address, tokenHolder)
+			touched.Add(models.TokenHolders{tokenHolder.Address: tokenHolder})
+		}
+	}
+
+	for _, tokenHolder := range touched.tokenHolders {
+		if createdTokens[tokenHolder.TokenTxHash] || tokenHolder.Amount == 0 {
+			changes.RemovedTokenHolders = append(changes.RemovedTokenHolders, tokenHolder)
+		} else {
+			changes.TokenHolders = append(changes.TokenHolders, tokenHolder)
+		}
+	}
+	return nil
+}
+
+type tokenHolderKey struct {
+	tokenTxHash common.Hash
+	address     common.Address
+}
+
+// beforeImageAmounts returns the amounts of the token holders before the
+// block, from the first before image of each.
+func beforeImageAmounts(undoRecord *models.UndoRecord) map[tokenHolderKey]common.Amount {
+	amounts := make(map[tokenHolderKey]common.Amount)
+	for _, image := range undoRecord.TokenHolders {
+		key := tokenHolderKey{image.TokenTxHash, image.Address}
+		if _, ok := amounts[key]; ok {
+			continue
+		}
+		var amount common.Amount
+		if image.TokenHolder != nil {
+			amount = image.TokenHolder.Amount
+		}
+		amounts[key] = amount
+	}
+	return amounts
+}
+
+// storedAmounts returns the stored amounts of the token holders changed by a
+// revert.
+func storedAmounts(r StoreReader, changes *models.BlockChanges) (map[tokenHolderKey]common.Amount, error) {
+	amounts := make(map[tokenHolderKey]common.Amount)
+	for _, tokenHolders := range [][]*models.TokenHolder{changes.TokenHolders, changes.RemovedTokenHolders} {
+		for _, tokenHolder := range tokenHolders {
+			stored, err := r.GetTokenHolder(tokenHolder.TokenTxHash, tokenHolder.Address)
+			if err == nil {
+				amounts[tokenHolderKey{tokenHolder.TokenTxHash, tokenHolder.Address}] = stored.Amount
+			} else if err != ErrNotFound {
+				return nil, fmt.Errorf("failed to get token holder: %w", err)
+			}
+		}
+	}
+	return amounts, nil
+}
+
+// updateTokenStats computes the stats of every token created or whose holders
+// are changed by the block, given the amounts of the holders before the
+// changes. It returns an error, along with the token, if the block changes
+// the supply of a token, so that a corrupted state is not committed.
+func updateTokenStats(r StoreReader, changes *models.BlockChanges,
+	before map[tokenHolderKey]common.Amount) (common.Hash, error) {
+	tokenStats := make(map[common.Hash]*models.TokenStats)
+	var tokens []common.Hash
+
+	createdTokens := make(map[common.Hash]bool)
+	for _, tokenTx := range changes.TokenTxs {
+		var s *models.TokenStats
+		var err error
+		if changes.IsRevert() {
+			s, err = r.GetTokenStats(tokenTx.TxHash)
+		} else {
+			s, err = models.NewTokenStatsFromTokenTx(tokenTx)
+		}
+		if err != nil {
+			return common.Hash{}, fmt.Errorf("failed to get token stats for token %s: %w", tokenTx.TxHash.ToString(), err)
+		}
+		createdTokens[tokenTx.TxHash] = true
+		tokenStats[tokenTx.TxHash] = s
+		tokens = append(tokens, tokenTx.TxHash)
+	}
+
+	update := func(tokenHolder *models.TokenHolder, amount common.Amount) (common.Hash, error) {
+		s, ok := tokenStats[tokenHolder.TokenTxHash]
+		if !ok {
+			var err error
+			s, err = r.GetTokenStats(tokenHolder.TokenTxHash)
+			if err != nil {
+				return common.Hash{}, fmt.Errorf("failed to get token stats for token %s: %w",
+					tokenHolder.TokenTxHash.ToString(), err)
+			}
+			tokenStats[tokenHolder.TokenTxHash] = s
+			tokens = append(tokens, tokenHolder.TokenTxHash)
+		}
+		return tokenHolder.TokenTxHash, s.Update(before[tokenHolderKey{tokenHolder.TokenTxHash, tokenHolder.Address}], amount)
+	}
+	for _, tokenHolder := range changes.TokenHolders {
+		if tokenTxHash, err := update(tokenHolder, tokenHolder.Amount); err != nil {
+			return tokenTxHash, err
+		}
+	}
+	for _, tokenHolder := range changes.RemovedTokenHolders {
+		if tokenTxHash, err := update(tokenHolder, 0); err != nil {
+			return tokenTxHash, err
+		}
+	}
+
+	for _, tokenTxHash := range tokens {
+		s := tokenStats[tokenTxHash]
+		if changes.IsRevert() && createdTokens[tokenTxHash] {
+			// Reverting the creation of a token removes all its holders
+			if s.Supply != 0 || s.HolderCount != 0 {
+				return tokenTxHash, fmt.Errorf("block #%d leaves supply %d and %d holders of reverted token %s",
+					changes.Block.Number, s.Supply, s.HolderCount, tokenTxHash.ToString())
+			}
+			changes.RemovedTokenStats = append(changes.RemovedTokenStats, s)
+			continue
+		}
+		if err := s.CheckSupply(); err != nil {
+			return tokenTxHash, fmt.Errorf("block #%d breaks the supply invariant: %w", changes.Block.Number, err)
+		}
+		changes.TokenStats = append(changes.TokenStats, s)
+	}
+	return common.Hash{}, nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyAmountToDecimal converts an amount stored by earlier versions into
+// Decimal128. Those stored the uint64 amount cast to int64, so amounts above
+// math.MaxInt64 wrapped around to negative values, which casting them back
+// recovers. Decimal128 amounts are already converted and kept as they are.
+func legacyAmountToDecimal(v bson.RawValue) (primitive.Decimal128, error) {
+	switch v.Type {
+	case bsontype.Decimal128:
+		d := v.Decimal128()
+		if _, err := decimal128ToAmount(d); err != nil {
+			return primitive.Decimal128{}, err
+		}
+		return d, nil
+	case bsontype.Int64:
+		return amountToDecimal128(common.Amount(uint64(v.Int64()))), nil
+	case bsontype.Int32:
+		i := v.Int32()
+		if i < 0 {
+			return primitive.Decimal128{}, fmt.Errorf("negative amount %d", i)
+		}
+		return amountToDecimal128(common.Amount(i)), nil
+	default:
+		return primitive.Decimal128{}, fmt.Errorf("cannot convert %v into an amount", v.Type)
+	}
+}
+
+// convertLegacyAmounts returns the update converting the amount of doc stored
+// at key, or every amount of the array at key for txs.
+func convertLegacyAmounts(doc bson.Raw, key string) (bson.M, error) {
+	v, err := doc.LookupErr(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	if v.Type != bsontype.Array {
+		d, err := legacyAmountToDecimal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return bson.M{"$set": bson.M{key: d}}, nil
+	}
+
+	values, err := v.Array().Values()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	amounts := make(bson.A, 0, len(values))
+	for i, v := range values {
+		d, err := legacyAmountToDecimal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%d: %w", key, i, err)
+		}
+		amounts = append(amounts, d)
+	}
+	return bson.M{"$set": bson.M{key: amounts}}, nil
+}
+
+// ConvertLegacyAmounts rewrites amounts that were stored as int64 by older
+// versions into Decimal128. Undo records are left as they are, since they
+// are pruned after ReOrgLimit blocks and legacy values are still decoded.
+func (m *MongoDBProcessor) ConvertLegacyAmounts() error {
+	for _, c := range []struct {
+		collection *mongo.Collection
+		key        string
+	}{
+		{m.tokenTxsCollection, "amounts"},
+		{m.transferTokenTxsCollection, "amounts"},
+		{m.tokenHoldersCollection, "amount"},
+	} {
+		count, err := m.convertLegacyAmounts(c.collection, c.key)
+		if err != nil {
+			m.log.Error("[ConvertLegacyAmounts] Failed to convert amounts",
+				"Collection", c.collection.Name(),
+				"Error", err.Error())
+			return err
+		}
+		if count > 0 {
+			m.log.Info("[ConvertLegacyAmounts] Converted amounts",
+				"Collection", c.collection.Name(),
+				"Count", count)
+		}
+	}
+	return nil
+}
+
+// convertLegacyAmounts converts the legacy amounts at key of the documents of
+// collection, and returns the number of documents converted.
+func (m *MongoDBProcessor) convertLegacyAmounts(collection *mongo.Collection, key string) (int, error) {
+	// An array matches if any of its elements does
+	filter := bson.M{key: bson.M{"$type": bson.A{"int", "long"}}}
+	o := options.Find().SetProjection(bson.M{"_id": 1, key: 1})
+	cursor, err := collection.Find(m.ctx, filter, o)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(m.ctx)
+
+	var operations []mongo.WriteModel
+	count := 0
+	write := func() error {
+		if len(operations) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(m.ctx, operations)
+		count += len(operations)
+		operations = operations[:0]
+		return err
+	}
+
+	for cursor.Next(m.ctx) {
+		update, err := convertLegacyAmounts(cursor.Current, key)
+		if err != nil {
+			return count, fmt.Errorf("document %s: %w", cursor.Current.Lookup("_id"), err)
+		}
+		operations = append(operations, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": cursor.Current.Lookup("_id")}).
+			SetUpdate(update))
+		if len(operations) == 1000 {
+			if err := write(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return count, err
+	}
+	return count, write()
+}
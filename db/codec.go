@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var tAmount = reflect.TypeOf(common.Amount(0))
+
+// newRegistry returns the BSON registry used for all collections, which stores
+// common.Amount losslessly as Decimal128.
+func newRegistry() *bsoncodec.Registry {
+	return bson.NewRegistryBuilder().
+		RegisterTypeEncoder(tAmount, bsoncodec.ValueEncoderFunc(amountEncodeValue)).
+		RegisterTypeDecoder(tAmount, bsoncodec.ValueDecoderFunc(amountDecodeValue)).
+		Build()
+}
+
+func amountEncodeValue(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() || val.Type() != tAmount {
+		return bsoncodec.ValueEncoderError{Name: "amountEncodeValue", Types: []reflect.Type{tAmount}, Received: val}
+	}
+	return vw.WriteDecimal128(amountToDecimal128(common.Amount(val.Uint())))
+}
+
+func amountToDecimal128(amount common.Amount) primitive.Decimal128 {
+	// Any uint64 fits in the 113 bit coefficient of a Decimal128
+	d, _ := primitive.ParseDecimal128FromBigInt(new(big.Int).SetUint64(uint64(amount)), 0)
+	return d
+}
+
+// amountDecodeValue decodes Decimal128 amounts, as well as the int64 amounts
+// written by earlier versions. Those were stored by casting the uint64 amount
+// to int64, so casting them back recovers the original amount.
+func amountDecodeValue(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tAmount {
+		return bsoncodec.ValueDecoderError{Name: "amountDecodeValue", Types: []reflect.Type{tAmount}, Received: val}
+	}
+
+	var amount common.Amount
+	switch vr.Type() {
+	case bsontype.Decimal128:
+		d, err := vr.ReadDecimal128()
+		if err != nil {
+			return err
+		}
+		amount, err = decimal128ToAmount(d)
+		if err != nil {
+			return err
+		}
+	case bsontype.Int64:
+		i, err := vr.ReadInt64()
+		if err != nil {
+			return err
+		}
+		amount = common.Amount(uint64(i))
+	case bsontype.Int32:
+		i, err := vr.ReadInt32()
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("negative amount %d", i)
+		}
+		amount = common.Amount(i)
+	default:
+		return fmt.Errorf("cannot decode %v into an Amount", vr.Type())
+	}
+
+	val.SetUint(uint64(amount))
+	return nil
+}
+
+func decimal128ToAmount(d primitive.Decimal128) (common.Amount, error) {
+	coefficient, exp, err := d.BigInt()
+	if err != nil {
+		return 0, err
+	}
+	ten := big.NewInt(10)
+	for ; exp > 0; exp-- {
+		coefficient.Mul(coefficient, ten)
+	}
+	for ; exp < 0; exp++ {
+		var remainder big.Int
+		coefficient.QuoRem(coefficient, ten, &remainder)
+		if remainder.Sign() != 0 {
+			return 0, fmt.Errorf("amount %s is not an integer", d.String())
+		}
+	}
+	if coefficient.Sign() < 0 || !coefficient.IsUint64() {
+		return 0, fmt.Errorf("amount %s out of range", d.String())
+	}
+	return common.Amount(coefficient.Uint64()), nil
+}
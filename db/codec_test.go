@@ -0,0 +1,159 @@
+package db
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var legacyAmounts = []uint64{0, 1, math.MaxInt64, math.MaxInt64 + 1, math.MaxUint64}
+
+// legacyTokenHolder is a token holder as written by versions storing amounts
+// as int64.
+type legacyTokenHolder struct {
+	TokenTxHash common.Hash    `bson:"tokenTxHash"`
+	Address     common.Address `bson:"address"`
+	Amount      int64          `bson:"amount"`
+}
+
+func TestDecodeLegacyAmounts(t *testing.T) {
+	for _, amount := range legacyAmounts {
+		raw, err := bson.Marshal(&legacyTokenHolder{Amount: int64(amount)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenHolder := &models.TokenHolder{}
+		if err := bson.UnmarshalWithRegistry(newRegistry(), raw, tokenHolder); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(tokenHolder.Amount) != amount {
+			t.Errorf("legacy amount %d decoded as %d", int64(amount), tokenHolder.Amount)
+		}
+	}
+}
+
+// convert runs the conversion of the legacy amounts at key of doc, and returns
+// the document as written by the update.
+func convert(t *testing.T, doc interface{}, key string) (bson.Raw, error) {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, err := convertLegacyAmounts(raw, key)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := bson.Marshal(update["$set"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return converted, nil
+}
+
+func TestConvertLegacyAmounts(t *testing.T) {
+	legacy := make(bson.A, 0, len(legacyAmounts)+2)
+	want := make([]common.Amount, 0, len(legacyAmounts)+2)
+	for _, amount := range legacyAmounts {
+		legacy = append(legacy, int64(amount))
+		want = append(want, common.Amount(amount))
+	}
+	// Amounts already converted, and int32 amounts written by other clients
+	legacy = append(legacy, amountToDecimal128(math.MaxUint64), int32(7))
+	want = append(want, math.MaxUint64, 7)
+
+	converted, err := convert(t, bson.D{{Key: "_id", Value: 1}, {Key: "amounts", Value: legacy}}, "amounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := converted.Lookup("amounts").Array().Values()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if v.Type != bsontype.Decimal128 {
+			t.Errorf("amount %v converted to %v, want a Decimal128", legacy[i], v.Type)
+		}
+	}
+	transferTokenTx := &models.TransferTokenTx{}
+	if err := bson.UnmarshalWithRegistry(newRegistry(), converted, transferTokenTx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(transferTokenTx.Amounts, want) {
+		t.Errorf("legacy amounts %v converted to %v, want %v", legacy, transferTokenTx.Amounts, want)
+	}
+
+	for i, amount := range legacyAmounts {
+		converted, err := convert(t, &legacyTokenHolder{Amount: int64(amount)}, "amount")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenHolder := &models.TokenHolder{}
+		if err := bson.UnmarshalWithRegistry(newRegistry(), converted, tokenHolder); err != nil {
+			t.Fatal(err)
+		}
+		if v := converted.Lookup("amount"); v.Type != bsontype.Decimal128 || tokenHolder.Amount != want[i] {
+			t.Errorf("legacy amount %d converted to %v %s, want %d", int64(amount), v.Type, v, want[i])
+		}
+	}
+}
+
+func TestConvertInvalidLegacyAmounts(t *testing.T) {
+	aboveUint64, err := primitive.ParseDecimal128("18446744073709551616")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fraction, err := primitive.ParseDecimal128("1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []interface{}{"1000", aboveUint64, fraction, int32(-1), 1.0, nil} {
+		if _, err := convert(t, bson.M{"amount": amount}, "amount"); err == nil {
+			t.Errorf("amount %v (%T) converted", amount, amount)
+		}
+		// A single invalid amount fails the whole tx
+		if _, err := convert(t, bson.M{"amounts": bson.A{int64(1), amount}}, "amounts"); err == nil {
+			t.Errorf("amounts with %v (%T) converted", amount, amount)
+		}
+	}
+	if _, err := convert(t, bson.M{"other": int64(1)}, "amount"); err == nil {
+		t.Error("document without amount converted")
+	}
+}
+
+func TestDecimal128ToAmount(t *testing.T) {
+	for _, test := range []struct {
+		decimal string
+		want    common.Amount
+		invalid bool
+	}{
+		{decimal: "0", want: 0},
+		{decimal: "18446744073709551615", want: math.MaxUint64},
+		{decimal: "1E+3", want: 1000},
+		{decimal: "1000E-3", want: 1},
+		{decimal: "1.5", invalid: true},
+		{decimal: "-1", invalid: true},
+		{decimal: "18446744073709551616", invalid: true},
+	} {
+		d, err := primitive.ParseDecimal128(test.decimal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount, err := decimal128ToAmount(d)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s decoded as %d, want an error", test.decimal, amount)
+			}
+			continue
+		}
+		if err != nil || amount != test.want {
+			t.Errorf("%s decoded as %d (%v), want %d", test.decimal, amount, err, test.want)
+		}
+	}
+}
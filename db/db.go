@@ -7,7 +7,6 @@ import (
 
 	"github.com/cyyber/qrl-token-indexer/config"
 	"github.com/cyyber/qrl-token-indexer/log"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx"
@@ -27,8 +26,20 @@ type MongoDBProcessor struct {
 	transferTokenTxsCollection *mongo.Collection
 	tokenHoldersCollection     *mongo.Collection
 	tokenRelatedTxsCollection  *mongo.Collection
+	checkpointsCollection      *mongo.Collection
+	journalCollection          *mongo.Collection
+	undoRecordsCollection      *mongo.Collection
+	schemaVersionCollection    *mongo.Collection
+	balanceChangesCollection   *mongo.Collection
+	tokenStatsCollection       *mongo.Collection
+	stateCommitmentsCollection *mongo.Collection
+
+	reconciliationReportsCollection *mongo.Collection
+	processingFailuresCollection    *mongo.Collection
 }
 
+var _ Store = (*MongoDBProcessor)(nil)
+
 func (m *MongoDBProcessor) IsDataBaseExists(dbName string) (bool, error) {
 	databaseNames, err := m.client.ListDatabaseNames(m.ctx, bsonx.Doc{})
 	if err != nil {
@@ -67,127 +78,12 @@ func (m *MongoDBProcessor) IsCollectionExists(collectionName string) (bool, erro
 	return false, nil
 }
 
-func (m *MongoDBProcessor) CreateBlocksIndexes(found bool) error {
-	m.blocksCollection = m.database.Collection("blocks")
-	if found {
-		return nil
-	}
-	_, err := m.blocksCollection.Indexes().CreateMany(context.Background(),
-		[]mongo.IndexModel{
-			{Keys: bson.M{"number": int32(-1)}},
-			{Keys: bson.M{"hash": int32(-1)}},
-		})
-	if err != nil {
-		m.log.Error("Error while modeling index for blocks",
-			"Error", err)
-		return err
-	}
-	return nil
-}
-
-func (m *MongoDBProcessor) CreateTokenTxsIndexes(found bool) error {
-	m.tokenTxsCollection = m.database.Collection("tokenTxs")
-	if found {
-		return nil
-	}
-	_, err := m.tokenTxsCollection.Indexes().CreateMany(context.Background(),
-		[]mongo.IndexModel{
-			{Keys: bson.M{"blockNumber": int32(-1)}},
-			{Keys: bson.M{"txHash": int32(-1)}},
-		})
-	if err != nil {
-		m.log.Error("Error while modeling index for tokenTxs",
-			"Error", err)
-		return err
-	}
-	return nil
-}
-
-func (m *MongoDBProcessor) CreateTransferTokenTxsIndexes(found bool) error {
-	m.transferTokenTxsCollection = m.database.Collection("transferTokenTxs")
-	if found {
-		return nil
-	}
-	_, err := m.transferTokenTxsCollection.Indexes().CreateMany(context.Background(),
-		[]mongo.IndexModel{
-			{Keys: bson.M{"blockNumber": int32(-1)}},
-			{Keys: bson.M{"txHash": int32(-1)}},
-			// tokenTxHash is the tx hash that created the token which act as the unique identifier for that token
-			{Keys: bson.M{"tokenTxHash": int32(-1)}},
-			{Keys: bson.M{"from": int32(-1)}},
-		})
-	if err != nil {
-		m.log.Error("Error while modeling index for transferTokenTxs",
-			"Error", err)
-		return err
-	}
-	return nil
-}
-
-func (m *MongoDBProcessor) CreateTokenHoldersIndexes(found bool) error {
-	m.tokenHoldersCollection = m.database.Collection("tokenHolders")
-	if found {
-		return nil
-	}
-	_, err := m.tokenHoldersCollection.Indexes().CreateMany(context.Background(),
-		[]mongo.IndexModel{
-			// tokenTxHash is the tx hash that created the token which act as the unique identifier for that token
-			{Keys: bson.M{"tokenTxHash": int32(-1)}},
-			{Keys: bson.M{"address": int32(-1)}},
-		})
-	if err != nil {
-		m.log.Error("Error while modeling index for tokenHolders",
-			"Error", err)
-		return err
-	}
-	return nil
-}
-
-func (m *MongoDBProcessor) CreateTokenRelatedTxsIndexes(found bool) error {
-	m.tokenRelatedTxsCollection = m.database.Collection("tokenRelatedTxs")
-	if found {
-		return nil
-	}
-	_, err := m.tokenRelatedTxsCollection.Indexes().CreateMany(context.Background(),
-		[]mongo.IndexModel{
-			// tokenTxHash is the tx hash that created the token which act as the unique identifier for that token
-			{Keys: bson.M{"tokenTxHash": int32(-1)}},
-			{Keys: bson.M{"txHash": int32(-1)}},
-		})
-	if err != nil {
-		m.log.Error("Error while modeling index for tokenRelatedTxs",
-			"Error", err)
-		return err
-	}
-	return nil
-}
-
-func (m *MongoDBProcessor) CreateIndexes() error {
-	collectionsLists := map[string]interface{}{
-		"blocks":           m.CreateBlocksIndexes,
-		"tokenTxs":         m.CreateTokenTxsIndexes,
-		"transferTokenTxs": m.CreateTransferTokenTxsIndexes,
-		"tokenHolders":     m.CreateTokenHoldersIndexes,
-		"tokenRelatedTxs":  m.CreateTokenRelatedTxsIndexes,
-	}
-	for collectionName, indexCreatorFunc := range collectionsLists {
-		found, err := m.IsCollectionExists(collectionName)
-		if err != nil {
-			return err
-		}
-		err = indexCreatorFunc.(func(bool) error)(found)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func CreateMongoDBProcessor() (*MongoDBProcessor, error) {
+// ConnectMongoDBProcessor connects to MongoDB without creating indexes,
+// migrating or recovering the database.
+func ConnectMongoDBProcessor(c *config.Config) (*MongoDBProcessor, error) {
 	m := &MongoDBProcessor{}
 	m.log = log.GetLogger()
-	m.config = config.GetConfig()
+	m.config = c
 
 	mongoDBConfig := m.config.GetMongoDBConfig()
 	dbName := mongoDBConfig.DBName
@@ -203,7 +99,7 @@ func CreateMongoDBProcessor() (*MongoDBProcessor, error) {
 			"mongodb://%s:%s@%s:%d/%s",
 			username, password, host, port, dbName)
 	}
-	clientOptions := options.Client().ApplyURI(mongoURL)
+	clientOptions := options.Client().ApplyURI(mongoURL).SetRegistry(newRegistry())
 	client, err := mongo.NewClient(clientOptions)
 	if err != nil {
 		fmt.Println(err)
@@ -217,7 +113,63 @@ func CreateMongoDBProcessor() (*MongoDBProcessor, error) {
 	m.ctx = context.TODO()
 	m.client = client
 	m.database = m.client.Database(dbName)
-	err = m.CreateIndexes()
+	m.blocksCollection = m.database.Collection("blocks")
+	m.tokenTxsCollection = m.database.Collection("tokenTxs")
+	m.transferTokenTxsCollection = m.database.Collection("transferTokenTxs")
+	m.tokenHoldersCollection = m.database.Collection("tokenHolders")
+	m.tokenRelatedTxsCollection = m.database.Collection("tokenRelatedTxs")
+	m.undoRecordsCollection = m.database.Collection("undoRecords")
+	m.checkpointsCollection = m.database.Collection("checkpoints")
+	m.journalCollection = m.database.Collection("blockJournal")
+	m.schemaVersionCollection = m.database.Collection("schemaVersion")
+	m.balanceChangesCollection = m.database.Collection("balanceChanges")
+	m.tokenStatsCollection = m.database.Collection("tokenStats")
+	m.stateCommitmentsCollection = m.database.Collection("stateCommitments")
+	m.reconciliationReportsCollection = m.database.Collection("reconciliationReports")
+	m.processingFailuresCollection = m.database.Collection("processingFailures")
+
+	return m, nil
+}
+
+func CreateMongoDBProcessor(c *config.Config) (*MongoDBProcessor, error) {
+	m, err := ConnectMongoDBProcessor(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse to touch a database written by a newer indexer
+	if _, err = m.PendingMigrations(); err != nil {
+		m.log.Error("Unsupported database schema",
+			"Error", err.Error())
+		return nil, err
+	}
+	// A database without blocks collection is a new one, which is created
+	// with the latest schema and so needs no migration
+	found, err := m.IsCollectionExists("blocks")
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.ReconcileIndexes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Half applied blocks are finished before migrating, so that migrations
+	// see a consistent state. The journal is recovered even with transactions,
+	// as it may be left by an earlier run on a standalone MongoDB.
+	err = m.RecoverJournal()
+	if err != nil {
+		m.log.Error("Failed to recover from journal",
+			"Error", err)
+		return nil, err
+	}
+
+	if found {
+		_, err = m.Migrate(false)
+	} else {
+		err = m.setSchemaVersion(LatestSchemaVersion())
+	}
 	if err != nil {
 		return nil, err
 	}
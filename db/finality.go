@@ -0,0 +1,189 @@
+package db
+
+import (
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FinalitySource is what the finality queries read.
+type FinalitySource interface {
+	StoreReader
+	GetTransferTokenTx(txHash common.Hash) (*models.TransferTokenTx, error)
+	// GetTransferTokenTxsByAddressAfter returns the transfers of the token
+	// sent or received by address in blocks above blockNumber, latest first
+	GetTransferTokenTxsByAddressAfter(tokenTxHash common.Hash, address common.Address,
+		blockNumber int64) ([]*models.TransferTokenTx, error)
+}
+
+// GetTipNumber returns the number of the highest indexed block, against which
+// the confirmations of all indexed records are counted.
+func GetTipNumber(r StoreReader) (int64, error) {
+	b, err := r.GetLastBlock()
+	if err != nil {
+		return 0, err
+	}
+	return b.Number, nil
+}
+
+func GetTokenTxWithFinality(r FinalitySource, txHash common.Hash, finalityThreshold uint64) (*models.TokenTx, error) {
+	tip, err := GetTipNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.GetTokenTx(txHash)
+	if err != nil {
+		return nil, err
+	}
+	t.SetFinality(t.BlockNumber, tip, finalityThreshold)
+	return t, nil
+}
+
+func GetTransferTokenTxWithFinality(r FinalitySource, txHash common.Hash,
+	finalityThreshold uint64) (*models.TransferTokenTx, error) {
+	tip, err := GetTipNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.GetTransferTokenTx(txHash)
+	if err != nil {
+		return nil, err
+	}
+	t.SetFinality(t.BlockNumber, tip, finalityThreshold)
+	return t, nil
+}
+
+func GetTokenHolderWithFinality(r FinalitySource, tokenTxHash common.Hash, address common.Address,
+	finalityThreshold uint64) (*models.TokenHolder, error) {
+	tip, err := GetTipNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := r.GetTokenHolder(tokenTxHash, address)
+	if err != nil {
+		return nil, err
+	}
+	t.SetFinality(t.BlockNumber, tip, finalityThreshold)
+	return t, nil
+}
+
+// GetTokenHolderBalance returns the balance of address for the token, ignoring
+// every change made in blocks with less than minConfirmations confirmations.
+// A minConfirmations of 0 or 1 returns the balance at the indexed tip.
+func GetTokenHolderBalance(r FinalitySource, tokenTxHash common.Hash, address common.Address,
+	minConfirmations uint64, finalityThreshold uint64) (*models.TokenHolderBalance, error) {
+	tip, err := GetTipNumber(r)
+	if err != nil {
+		return nil, err
+	}
+	tokenHolder, err := r.GetTokenHolder(tokenTxHash, address)
+	if err != nil {
+		return nil, err
+	}
+
+	asOfBlockNumber := tip
+	if minConfirmations > 1 {
+		asOfBlockNumber = tip - int64(minConfirmations) + 1
+	}
+
+	balance := &models.TokenHolderBalance{
+		TokenTxHash:     tokenTxHash,
+		Address:         address,
+		Amount:          tokenHolder.Amount,
+		AsOfBlockNumber: asOfBlockNumber,
+	}
+
+	// Holders written before the last changed block was tracked have it unset,
+	// in which case the recent transfers are always checked.
+	lastChangeBlockNumber := tokenHolder.BlockNumber
+	if lastChangeBlockNumber > asOfBlockNumber || lastChangeBlockNumber == common.BLOCKZERO {
+		tokenTx, err := r.GetTokenTx(tokenTxHash)
+		if err != nil {
+			return nil, err
+		}
+		if tokenTx.BlockNumber > asOfBlockNumber {
+			// Token itself has not been created as of the requested confirmations
+			balance.Amount = 0
+		} else {
+			transferTokenTxs, err := r.GetTransferTokenTxsByAddressAfter(tokenTxHash, address, asOfBlockNumber)
+			if err != nil {
+				return nil, err
+			}
+			// Transfers are undone latest first, so that every intermediate
+			// balance is one the address actually held
+			for _, transferTokenTx := range transferTokenTxs {
+				for i, to := range transferTokenTx.Addresses {
+					// Add back what was sent before taking away what was
+					// received so that transfers to self never underflow.
+					if transferTokenTx.From == address {
+						if balance.Amount, err = balance.Amount.Add(transferTokenTx.Amounts[i]); err != nil {
+							return nil, err
+						}
+					}
+					if to == address {
+						if balance.Amount, err = balance.Amount.Sub(transferTokenTx.Amounts[i]); err != nil {
+							return nil, err
+						}
+					}
+				}
+			}
+		}
+		// The most recent change included is somewhere at or below asOfBlockNumber
+		lastChangeBlockNumber = asOfBlockNumber
+	}
+
+	balance.SetFinality(lastChangeBlockNumber, tip, finalityThreshold)
+	return balance, nil
+}
+
+func (m *MongoDBProcessor) GetTipNumber() (int64, error) {
+	return GetTipNumber(m)
+}
+
+func (m *MongoDBProcessor) GetTokenTxWithFinality(txHash common.Hash) (*models.TokenTx, error) {
+	return GetTokenTxWithFinality(m, txHash, m.config.FinalityThreshold)
+}
+
+func (m *MongoDBProcessor) GetTransferTokenTxWithFinality(txHash common.Hash) (*models.TransferTokenTx, error) {
+	return GetTransferTokenTxWithFinality(m, txHash, m.config.FinalityThreshold)
+}
+
+func (m *MongoDBProcessor) GetTokenHolderWithFinality(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error) {
+	return GetTokenHolderWithFinality(m, tokenTxHash, address, m.config.FinalityThreshold)
+}
+
+func (m *MongoDBProcessor) GetTokenHolderBalance(tokenTxHash common.Hash, address common.Address,
+	minConfirmations uint64) (*models.TokenHolderBalance, error) {
+	return GetTokenHolderBalance(m, tokenTxHash, address, minConfirmations, m.config.FinalityThreshold)
+}
+
+func (m *MongoDBProcessor) GetTransferTokenTxsByAddressAfter(tokenTxHash common.Hash, address common.Address,
+	blockNumber int64) ([]*models.TransferTokenTx, error) {
+	var transferTokenTxs []*models.TransferTokenTx
+
+	o := &options.FindOptions{}
+	o.Sort = bson.D{{Key: "blockNumber", Value: -1}, {Key: "txIndex", Value: -1}}
+	cursor, err := m.transferTokenTxsCollection.Find(m.ctx,
+		bson.M{
+			"tokenTxHash": tokenTxHash,
+			"blockNumber": bson.M{"$gt": blockNumber},
+			"$or": bson.A{
+				bson.M{"from": address},
+				bson.M{"addresses": address},
+			},
+		}, o)
+	if err != nil {
+		return nil, err
+	}
+	for cursor.Next(m.ctx) {
+		t := &models.TransferTokenTx{}
+		err := cursor.Decode(t)
+		if err != nil {
+			return nil, err
+		}
+		transferTokenTxs = append(transferTokenTxs, t)
+	}
+
+	return transferTokenTxs, nil
+}
@@ -0,0 +1,42 @@
+package db
+
+import "sync/atomic"
+
+// Lookups of token holders by GetTokenHoldersWithCache, counted across all
+// blocks processed since the last ResetTokenHolderCacheStats
+var tokenHolderCacheHits, tokenHolderCacheMisses atomic.Uint64
+
+// TokenHolderCacheStats counts the token holder lookups served by the
+// per-block TokenHoldersCache and those read from the store.
+type TokenHolderCacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// HitRate returns the fraction of lookups served by the cache.
+func (s TokenHolderCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func GetTokenHolderCacheStats() TokenHolderCacheStats {
+	return TokenHolderCacheStats{
+		Hits:   tokenHolderCacheHits.Load(),
+		Misses: tokenHolderCacheMisses.Load(),
+	}
+}
+
+func ResetTokenHolderCacheStats() {
+	tokenHolderCacheHits.Store(0)
+	tokenHolderCacheMisses.Store(0)
+}
+
+func countTokenHolderCacheLookup(hit bool) {
+	if hit {
+		tokenHolderCacheHits.Add(1)
+	} else {
+		tokenHolderCacheMisses.Add(1)
+	}
+}
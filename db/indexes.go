@@ -0,0 +1,344 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec is an index wanted on a collection. Indexes are matched by name,
+// which MongoDB derives from the keys, such as "tokenTxHash_-1_address_-1".
+type IndexSpec struct {
+	Collection string
+	Keys       bson.D
+	Unique     bool
+}
+
+func desc(fields ...string) bson.D {
+	keys := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: int32(-1)})
+	}
+	return keys
+}
+
+// indexSpecs are all the indexes of the indexer collections, reconciled at
+// startup by ReconcileIndexes.
+var indexSpecs = []*IndexSpec{
+	{Collection: "blocks", Keys: desc("number"), Unique: true},
+	{Collection: "blocks", Keys: desc("hash"), Unique: true},
+
+	{Collection: "tokenTxs", Keys: desc("blockNumber")},
+	{Collection: "tokenTxs", Keys: desc("txHash"), Unique: true},
+
+	// tokenTxHash is the tx hash that created the token which act as the unique identifier for that token
+	{Collection: "transferTokenTxs", Keys: desc("blockNumber")},
+	{Collection: "transferTokenTxs", Keys: desc("txHash"), Unique: true},
+	{Collection: "transferTokenTxs", Keys: desc("tokenTxHash")},
+	{Collection: "transferTokenTxs", Keys: desc("from")},
+
+	{Collection: "tokenHolders", Keys: desc("tokenTxHash")},
+	{Collection: "tokenHolders", Keys: desc("address")},
+	{Collection: "tokenHolders", Keys: desc("tokenTxHash", "address"), Unique: true},
+
+	{Collection: "tokenRelatedTxs", Keys: desc("tokenTxHash")},
+	{Collection: "tokenRelatedTxs", Keys: desc("txHash")},
+	{Collection: "tokenRelatedTxs", Keys: desc("tokenTxHash", "txHash"), Unique: true},
+
+	{Collection: "undoRecords", Keys: desc("blockNumber"), Unique: true},
+
+	{Collection: "balanceChanges", Keys: desc("tokenTxHash", "address", "blockNumber", "txIndex"), Unique: true},
+	{Collection: "balanceChanges", Keys: desc("tokenTxHash", "address", "timestamp")},
+	{Collection: "balanceChanges", Keys: desc("blockNumber")},
+
+	{Collection: "tokenStats", Keys: desc("tokenTxHash"), Unique: true},
+
+	{Collection: "stateCommitments", Keys: desc("blockNumber"), Unique: true},
+
+	{Collection: "reconciliationReports", Keys: desc("startedAt")},
+
+	{Collection: "processingFailures", Keys: desc("blockNumber", "blockHash")},
+}
+
+// Name returns the name MongoDB gives to an index with the same keys.
+func (s *IndexSpec) Name() string {
+	parts := make([]string, 0, 2*len(s.Keys))
+	for _, key := range s.Keys {
+		parts = append(parts, key.Key, fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (s *IndexSpec) model() mongo.IndexModel {
+	o := options.Index().SetName(s.Name()).SetBackground(true)
+	if s.Unique {
+		o.SetUnique(true)
+	}
+	return mongo.IndexModel{Keys: s.Keys, Options: o}
+}
+
+// existingIndex is the subset of an index listed by Indexes().List()
+type existingIndex struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+// matches reports whether the existing index has the keys and options of the
+// spec. Key directions are compared by value as they may be any numeric type.
+func (e *existingIndex) matches(s *IndexSpec) bool {
+	if e.Unique != s.Unique || len(e.Key) != len(s.Keys) {
+		return false
+	}
+	for i, key := range s.Keys {
+		if e.Key[i].Key != key.Key || fmt.Sprint(e.Key[i].Value) != fmt.Sprint(key.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *MongoDBProcessor) listIndexes(collection *mongo.Collection) (map[string]*existingIndex, error) {
+	cursor, err := collection.Indexes().List(m.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(m.ctx)
+
+	indexes := make(map[string]*existingIndex)
+	for cursor.Next(m.ctx) {
+		index := &existingIndex{}
+		if err := cursor.Decode(index); err != nil {
+			return nil, err
+		}
+		indexes[index.Name] = index
+	}
+	return indexes, cursor.Err()
+}
+
+// ReconcileIndexes diffs indexSpecs against the indexes of each collection.
+// Missing indexes are built in the background, and indexes whose keys or
+// options differ from the spec are rebuilt. Indexes not in the spec are
+// reported, and are dropped when DropObsoleteIndexes is set.
+//
+// Before building a unique index, documents sharing its keys are looked for,
+// as older versions could store them twice on a revert. Copies identical to
+// the first document are removed, and a DuplicateKeysError listing the others
+// is returned, leaving the index as it is.
+func (m *MongoDBProcessor) ReconcileIndexes() error {
+	dropObsolete := m.config.GetMongoDBConfig().DropObsoleteIndexes
+
+	var collectionNames []string
+	specsByCollection := make(map[string][]*IndexSpec)
+	for _, spec := range indexSpecs {
+		if _, ok := specsByCollection[spec.Collection]; !ok {
+			collectionNames = append(collectionNames, spec.Collection)
+		}
+		specsByCollection[spec.Collection] = append(specsByCollection[spec.Collection], spec)
+	}
+
+	for _, collectionName := range collectionNames {
+		collection := m.database.Collection(collectionName)
+		existing, err := m.listIndexes(collection)
+		if err != nil {
+			m.log.Error("[ReconcileIndexes] Failed to list indexes",
+				"Collection", collectionName,
+				"Error", err.Error())
+			return err
+		}
+
+		var missing []mongo.IndexModel
+		wanted := make(map[string]bool)
+		for _, spec := range specsByCollection[collectionName] {
+			name := spec.Name()
+			wanted[name] = true
+			index, ok := existing[name]
+			if ok && index.matches(spec) {
+				continue
+			}
+			if spec.Unique {
+				if err := m.removeDuplicateKeys(collection, spec); err != nil {
+					return err
+				}
+			}
+			if ok {
+				m.log.Warn("[ReconcileIndexes] Rebuilding index differing from spec",
+					"Collection", collectionName,
+					"Index", name)
+				if err := m.dropIndex(collection, name); err != nil {
+					return err
+				}
+			}
+			missing = append(missing, spec.model())
+		}
+
+		for name := range existing {
+			if name == "_id_" || wanted[name] {
+				continue
+			}
+			m.log.Warn("[ReconcileIndexes] Unexpected index",
+				"Collection", collectionName,
+				"Index", name)
+			if dropObsolete {
+				if err := m.dropIndex(collection, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+		m.log.Info("[ReconcileIndexes] Creating missing indexes",
+			"Collection", collectionName,
+			"Count", len(missing))
+		if _, err := collection.Indexes().CreateMany(m.ctx, missing); err != nil {
+			m.log.Error("[ReconcileIndexes] Failed to create indexes",
+				"Collection", collectionName,
+				"Error", err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoDBProcessor) dropIndex(collection *mongo.Collection, name string) error {
+	m.log.Info("[ReconcileIndexes] Dropping index",
+		"Collection", collection.Name(),
+		"Index", name)
+	_, err := collection.Indexes().DropOne(m.ctx, name)
+	if err != nil {
+		m.log.Error("[ReconcileIndexes] Failed to drop index",
+			"Collection", collection.Name(),
+			"Index", name,
+			"Error", err.Error())
+	}
+	return err
+}
+
+// DuplicateKeys are the keys of a unique index shared by several documents.
+type DuplicateKeys struct {
+	Keys bson.M        `bson:"_id"`
+	IDs  []interface{} `bson:"ids"`
+}
+
+// DuplicateKeysError is returned by ReconcileIndexes when a unique index
+// cannot be built, as documents sharing its keys differ otherwise, so that
+// which one to keep must be decided by hand.
+type DuplicateKeysError struct {
+	Collection string
+	Index      string
+	Duplicates []*DuplicateKeys
+}
+
+func (e *DuplicateKeysError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cannot build unique index %s of %s, %d keys are shared by differing documents:",
+		e.Index, e.Collection, len(e.Duplicates))
+	for _, d := range e.Duplicates {
+		fmt.Fprintf(&b, "\n  %v: _id %v", d.Keys, d.IDs)
+	}
+	return b.String()
+}
+
+// removeDuplicateKeys removes the documents sharing the keys of spec which are
+// identical to the first of them, and returns a DuplicateKeysError if
+// differing documents remain.
+func (m *MongoDBProcessor) removeDuplicateKeys(collection *mongo.Collection, spec *IndexSpec) error {
+	group := bson.D{}
+	for _, key := range spec.Keys {
+		group = append(group, bson.E{Key: key.Key, Value: "$" + key.Key})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+	cursor, err := collection.Aggregate(m.ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var duplicates []*DuplicateKeys
+	if err := cursor.All(m.ctx, &duplicates); err != nil {
+		return err
+	}
+
+	var conflicting []*DuplicateKeys
+	for _, d := range duplicates {
+		o := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+		cursor, err := collection.Find(m.ctx, bson.M{"_id": bson.M{"$in": d.IDs}}, o)
+		if err != nil {
+			return err
+		}
+		var documents []bson.Raw
+		if err := cursor.All(m.ctx, &documents); err != nil {
+			return err
+		}
+		if len(documents) < 2 {
+			continue
+		}
+
+		var identical []interface{}
+		for _, document := range documents[1:] {
+			if !sameDocument(documents[0], document) {
+				conflicting = append(conflicting, d)
+				identical = nil
+				break
+			}
+			identical = append(identical, document.Lookup("_id"))
+		}
+		if len(identical) == 0 {
+			continue
+		}
+		m.log.Warn("[ReconcileIndexes] Removing duplicated documents",
+			"Collection", collection.Name(),
+			"Index", spec.Name(),
+			"Keys", fmt.Sprint(d.Keys),
+			"Count", len(identical))
+		if _, err := collection.DeleteMany(m.ctx, bson.M{"_id": bson.M{"$in": identical}}); err != nil {
+			return err
+		}
+	}
+
+	if len(conflicting) == 0 {
+		return nil
+	}
+	err = &DuplicateKeysError{
+		Collection: collection.Name(),
+		Index:      spec.Name(),
+		Duplicates: conflicting,
+	}
+	m.log.Error("[ReconcileIndexes] Failed to build index", "Error", err.Error())
+	return err
+}
+
+// sameDocument reports whether a and b hold the same fields, apart from _id.
+func sameDocument(a, b bson.Raw) bool {
+	fields := func(document bson.Raw) []bson.RawElement {
+		elements, _ := document.Elements()
+		kept := elements[:0]
+		for _, element := range elements {
+			if element.Key() != "_id" {
+				kept = append(kept, element)
+			}
+		}
+		return kept
+	}
+	fa, fb := fields(a), fields(b)
+	if len(fa) != len(fb) {
+		return false
+	}
+	for i := range fa {
+		if !bytes.Equal(fa[i], fb[i]) {
+			return false
+		}
+	}
+	return true
+}
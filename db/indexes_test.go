@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSameDocument(t *testing.T) {
+	document := func(id primitive.ObjectID, fields ...bson.E) bson.Raw {
+		raw, err := bson.Marshal(append(bson.D{{Key: "_id", Value: id}}, fields...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	a, b := primitive.NewObjectID(), primitive.NewObjectID()
+	txHash := bson.E{Key: "txHash", Value: []byte{1, 2, 3}}
+	blockNumber := bson.E{Key: "blockNumber", Value: int64(7)}
+
+	for _, test := range []struct {
+		name string
+		x, y bson.Raw
+		want bool
+	}{
+		{"same fields", document(a, txHash, blockNumber), document(b, txHash, blockNumber), true},
+		{"different value", document(a, txHash, blockNumber),
+			document(b, txHash, bson.E{Key: "blockNumber", Value: int64(8)}), false},
+		{"missing field", document(a, txHash, blockNumber), document(b, txHash), false},
+		{"different order", document(a, txHash, blockNumber), document(b, blockNumber, txHash), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sameDocument(test.x, test.y); got != test.want {
+				t.Fatalf("sameDocument = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// commitWithJournal writes the changes of a block without a transaction. The
+// changes are first recorded in the journal, then written with idempotent
+// operations, and finally removed from the journal. A crash in between leaves
+// the journal entry behind, from which RecoverJournal finishes the block.
+func (m *MongoDBProcessor) commitWithJournal(c *models.BlockChanges) error {
+	entry := models.NewJournalEntry(c, LatestSchemaVersion())
+	_, err := m.journalCollection.ReplaceOne(m.ctx,
+		bson.M{"_id": entry.ID},
+		entry,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		m.log.Error("[commitWithJournal] Failed to write journal entry",
+			"id", entry.ID)
+		return err
+	}
+
+	return m.finishJournalEntry(entry)
+}
+
+func (m *MongoDBProcessor) finishJournalEntry(entry *models.JournalEntry) error {
+	err := m.writeOperations(m.ctx, newBlockOperations(entry.Changes, true))
+	if err != nil {
+		return err
+	}
+
+	_, err = m.journalCollection.DeleteOne(m.ctx, bson.M{"_id": entry.ID})
+	if err != nil {
+		m.log.Error("[finishJournalEntry] Failed to delete journal entry",
+			"id", entry.ID)
+		return err
+	}
+	return nil
+}
+
+// ErrJournalSchemaVersion is returned by RecoverJournal for a journal entry
+// written with another schema version, whose changes this indexer cannot
+// write as they are.
+var ErrJournalSchemaVersion = errors.New("journal entry has another schema version")
+
+// RecoverJournal finishes every block operation left half applied in the
+// journal, in the order they were started. The database is left untouched if
+// any entry was written with another schema version, and must then be
+// recovered by the indexer version which wrote it before migrating.
+func (m *MongoDBProcessor) RecoverJournal() error {
+	o := &options.FindOptions{}
+	o.Sort = bson.D{{Key: "createdAt", Value: 1}}
+	cursor, err := m.journalCollection.Find(m.ctx, bson.M{}, o)
+	if err != nil {
+		return err
+	}
+
+	var entries []*models.JournalEntry
+	for cursor.Next(m.ctx) {
+		entry := &models.JournalEntry{}
+		err := cursor.Decode(entry)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if err := checkJournalSchemaVersions(entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		m.log.Warn("Recovering half applied block from journal",
+			"Operation", entry.Changes.Operation,
+			"Block #", entry.Changes.Block.Number,
+			"HeaderHash", entry.Changes.Block.Hash.ToString())
+		if err := m.finishJournalEntry(entry); err != nil {
+			return fmt.Errorf("failed to finish %s of block #%d %s from the journal, it is left half applied: %w",
+				entry.Changes.Operation, entry.Changes.Block.Number, entry.Changes.Block.Hash.ToString(), err)
+		}
+	}
+	return nil
+}
+
+// checkJournalSchemaVersions returns an ErrJournalSchemaVersion for the first
+// entry not written with the latest schema version.
+func checkJournalSchemaVersions(entries []*models.JournalEntry) error {
+	for _, entry := range entries {
+		if entry.SchemaVersion != LatestSchemaVersion() {
+			return fmt.Errorf("%w: %s of block #%d %s was written with schema version %d, this indexer writes version %d",
+				ErrJournalSchemaVersion, entry.Changes.Operation, entry.Changes.Block.Number,
+				entry.Changes.Block.Hash.ToString(), entry.SchemaVersion, LatestSchemaVersion())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// newJournalChanges returns the changes of a block creating a token whose
+// amounts only fit a Decimal128, and transferring some of it.
+func newJournalChanges() *models.BlockChanges {
+	alice, bob := fakenode.NewAddress("alice"), fakenode.NewAddress("bob")
+	block := &models.Block{Number: 7, Hash: fakenode.NewTxHash("block 7"), Timestamp: fakenode.GenesisTimestamp}
+
+	tokenTx := models.NewTokenTxFromPBData(7, fakenode.NewTokenTx("token", "TKN", 2, alice,
+		[]common.Address{alice}, []uint64{math.MaxUint64}))
+	tokenTx.BlockHash = block.Hash
+	transferTokenTx := models.NewTransferTokenTxFromPBData(7, fakenode.NewTransferTokenTx("transfer",
+		tokenTx.TxHash, alice, []common.Address{bob}, []uint64{300}))
+	transferTokenTx.BlockHash, transferTokenTx.TxIndex = block.Hash, 1
+
+	aliceHolder := models.NewTokenHolder(tokenTx.TxHash, alice, math.MaxUint64-300)
+	aliceHolder.BlockNumber = 7
+	bobHolder := models.NewTokenHolder(tokenTx.TxHash, bob, 300)
+	bobHolder.BlockNumber = 7
+	balanceChanges := []*models.BalanceChange{
+		{TokenTxHash: tokenTx.TxHash, Address: alice, BlockNumber: 7, TxHash: tokenTx.TxHash,
+			Received: math.MaxUint64, Balance: math.MaxUint64, Timestamp: block.Timestamp},
+		{TokenTxHash: tokenTx.TxHash, Address: alice, BlockNumber: 7, TxIndex: 1, TxHash: transferTokenTx.TxHash,
+			Sent: 300, Balance: math.MaxUint64 - 300, Timestamp: block.Timestamp},
+		{TokenTxHash: tokenTx.TxHash, Address: bob, BlockNumber: 7, TxIndex: 1, TxHash: transferTokenTx.TxHash,
+			Received: 300, Balance: 300, Timestamp: block.Timestamp},
+	}
+
+	undoRecord := models.NewUndoRecord(block)
+	undoRecord.TokenHolders = []*models.TokenHolderBeforeImage{
+		{TokenTxHash: tokenTx.TxHash, Address: alice},
+		{TokenTxHash: tokenTx.TxHash, Address: bob},
+	}
+	return &models.BlockChanges{
+		Operation:         models.CheckpointOperationProcessBlock,
+		Block:             block,
+		PrunedBlockNumber: -1,
+		TokenTxs:          []*models.TokenTx{tokenTx},
+		TransferTokenTxs:  []*models.TransferTokenTx{transferTokenTx},
+		TokenRelatedTxs: []*models.TokenRelatedTx{
+			models.NewTokenRelatedTx(tokenTx.TxHash, tokenTx.TxHash),
+			transferTokenTx.GetTokenRelatedTx(),
+		},
+		TokenHolders:   []*models.TokenHolder{aliceHolder, bobHolder},
+		BalanceChanges: balanceChanges,
+		TokenStats: []*models.TokenStats{
+			{TokenTxHash: tokenTx.TxHash, TotalSupply: math.MaxUint64, Supply: math.MaxUint64, HolderCount: 2},
+		},
+		StateCommitment: models.NewStateCommitment(7, block.Hash, common.Hash{}, balanceChanges),
+		UndoRecord:      undoRecord,
+	}
+}
+
+// TestJournalEntryRoundTrip checks that the changes recovered from a journal
+// entry are those which were journaled.
+func TestJournalEntryRoundTrip(t *testing.T) {
+	entry := models.NewJournalEntry(newJournalChanges(), LatestSchemaVersion())
+	// Dates are stored in milliseconds
+	entry.CreatedAt = entry.CreatedAt.Truncate(time.Millisecond)
+
+	raw, err := bson.MarshalWithRegistry(newRegistry(), entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered := &models.JournalEntry{}
+	if err := bson.UnmarshalWithRegistry(newRegistry(), raw, recovered); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recovered, entry) {
+		t.Fatalf("journal entry recovered as\n%+v\nwant\n%+v", recovered, entry)
+	}
+	if err := checkJournalSchemaVersions([]*models.JournalEntry{recovered}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckJournalSchemaVersions(t *testing.T) {
+	current := models.NewJournalEntry(newJournalChanges(), LatestSchemaVersion())
+
+	// Entries written before the schema version was recorded decode as
+	// version 0
+	raw, err := bson.MarshalWithRegistry(newRegistry(), bson.M{
+		"_id":       current.ID,
+		"changes":   current.Changes,
+		"createdAt": current.CreatedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &models.JournalEntry{}
+	if err := bson.UnmarshalWithRegistry(newRegistry(), raw, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.SchemaVersion != 0 {
+		t.Fatalf("legacy journal entry of schema version %d, want 0", legacy.SchemaVersion)
+	}
+
+	previous := models.NewJournalEntry(newJournalChanges(), LatestSchemaVersion()-1)
+	for _, test := range []struct {
+		entries []*models.JournalEntry
+		refused bool
+	}{
+		{nil, false},
+		{[]*models.JournalEntry{current, current}, false},
+		{[]*models.JournalEntry{legacy}, true},
+		// A single entry of another version refuses them all
+		{[]*models.JournalEntry{current, previous}, true},
+	} {
+		err := checkJournalSchemaVersions(test.entries)
+		if refused := errors.Is(err, ErrJournalSchemaVersion); refused != test.refused {
+			t.Errorf("%d journal entries refused %v (%v), want %v", len(test.entries), refused, err, test.refused)
+		}
+	}
+}
+
+// TestJournaledOperationsIdempotent checks that the operations finishing a
+// journal entry can be written again after a partial write.
+func TestJournaledOperationsIdempotent(t *testing.T) {
+	process := newJournalChanges()
+	revert := newJournalChanges()
+	revert.Operation = models.CheckpointOperationRevertLastBlock
+	revert.TokenHolders, revert.RemovedTokenHolders = nil, revert.TokenHolders
+
+	for _, c := range []*models.BlockChanges{process, revert} {
+		o := newBlockOperations(c, true)
+		for _, operations := range [][]mongo.WriteModel{
+			o.blockOperations,
+			o.tokenTxOperations,
+			o.transferTokenTxOperations,
+			o.tokenHolderOperations,
+			o.tokenRelatedTxOperations,
+			o.undoRecordOperations,
+			o.balanceChangeOperations,
+			o.tokenStatsOperations,
+			o.stateCommitmentOperations,
+		} {
+			for _, operation := range operations {
+				switch w := operation.(type) {
+				case *mongo.ReplaceOneModel:
+					if w.Upsert == nil || !*w.Upsert {
+						t.Errorf("%s replaces %T without upsert", c.Operation, w.Replacement)
+					}
+				case *mongo.UpdateOneModel:
+					if w.Upsert == nil || !*w.Upsert {
+						t.Errorf("%s updates without upsert", c.Operation)
+					}
+				case *mongo.DeleteOneModel, *mongo.DeleteManyModel:
+				default:
+					t.Errorf("%s writes %T, which cannot be written again", c.Operation, operation)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (m *MongoDBProcessor) findLastBalanceChange(filter bson.M, sort bson.D) (*models.BalanceChange, error) {
+	result := m.balanceChangesCollection.FindOne(m.ctx, filter, options.FindOne().SetSort(sort))
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	balanceChange := &models.BalanceChange{}
+	if err := result.Decode(balanceChange); err != nil {
+		return nil, err
+	}
+	return balanceChange, nil
+}
+
+func (m *MongoDBProcessor) GetBalanceAtHeight(tokenTxHash common.Hash, address common.Address,
+	blockNumber int64) (common.Amount, error) {
+	balanceChange, err := m.findLastBalanceChange(
+		bson.M{
+			"tokenTxHash": tokenTxHash,
+			"address":     address,
+			"blockNumber": bson.M{"$lte": blockNumber},
+		},
+		bson.D{{Key: "blockNumber", Value: -1}, {Key: "txIndex", Value: -1}})
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return balanceChange.Balance, nil
+}
+
+func (m *MongoDBProcessor) GetBalanceAtTimestamp(tokenTxHash common.Hash, address common.Address,
+	timestamp uint64) (common.Amount, error) {
+	// Backfilled entries have no timestamp, but always precede the
+	// timestamped ones
+	balanceChange, err := m.findLastBalanceChange(
+		bson.M{
+			"tokenTxHash": tokenTxHash,
+			"address":     address,
+			"timestamp":   bson.M{"$gt": 0, "$lte": timestamp},
+		},
+		bson.D{{Key: "timestamp", Value: -1}, {Key: "blockNumber", Value: -1}, {Key: "txIndex", Value: -1}})
+	if err == nil {
+		return balanceChange.Balance, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	_, err = m.findLastBalanceChange(
+		bson.M{
+			"tokenTxHash": tokenTxHash,
+			"address":     address,
+			"txIndex":     models.BackfilledTxIndex,
+		},
+		bson.D{{Key: "blockNumber", Value: -1}})
+	if err == nil {
+		return 0, ErrTimestampUnknown
+	} else if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (m *MongoDBProcessor) GetBalancesAtHeight(tokenTxHash common.Hash,
+	blockNumber int64) ([]*models.BalanceChange, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"tokenTxHash": tokenTxHash,
+			"blockNumber": bson.M{"$lte": blockNumber},
+		}}},
+		{{Key: "$sort", Value: bson.D{
+			{Key: "address", Value: 1},
+			{Key: "blockNumber", Value: -1},
+			{Key: "txIndex", Value: -1},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  "$address",
+			"last": bson.M{"$first": "$$ROOT"},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$last"}}},
+		{{Key: "$match", Value: bson.M{"balance": bson.M{"$ne": 0}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "address", Value: 1}}}},
+	}
+	cursor, err := m.balanceChangesCollection.Aggregate(m.ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var balanceChanges []*models.BalanceChange
+	if err := cursor.All(m.ctx, &balanceChanges); err != nil {
+		return nil, err
+	}
+	return balanceChanges, nil
+}
+
+// BackfillTokenBalanceChanges returns the ledger of the token created by
+// tokenTx, replayed from its creation and its transfers in block order. An
+// entry per holder and block is returned, as the order of txs within a block
+// may not be stored.
+func BackfillTokenBalanceChanges(tokenTx *models.TokenTx,
+	transferTokenTxs []*models.TransferTokenTx) ([]*models.BalanceChange, error) {
+	balances := make(map[common.Address]common.Amount)
+	var balanceChanges []*models.BalanceChange
+
+	// blockChanges accumulates what each holder received and sent in the
+	// current block
+	blockNumber := tokenTx.BlockNumber
+	var addresses []common.Address
+	blockChanges := make(map[common.Address]*models.BalanceChange)
+	change := func(address common.Address) *models.BalanceChange {
+		balanceChange, ok := blockChanges[address]
+		if !ok {
+			balanceChange = &models.BalanceChange{
+				TokenTxHash: tokenTx.TxHash,
+				Address:     address,
+				BlockNumber: blockNumber,
+				TxIndex:     models.BackfilledTxIndex,
+			}
+			blockChanges[address] = balanceChange
+			addresses = append(addresses, address)
+		}
+		return balanceChange
+	}
+	flush := func() error {
+		for _, address := range addresses {
+			balanceChange := blockChanges[address]
+			// Adding what was received first, the balance at the end of the
+			// block covers what was sent
+			balance, err := balances[address].Add(balanceChange.Received)
+			if err != nil {
+				return err
+			}
+			if balance, err = balance.Sub(balanceChange.Sent); err != nil {
+				return err
+			}
+			balances[address] = balance
+			balanceChange.Balance = balance
+			balanceChanges = append(balanceChanges, balanceChange)
+		}
+		addresses = nil
+		blockChanges = make(map[common.Address]*models.BalanceChange)
+		return nil
+	}
+
+	for i, address := range tokenTx.Addresses {
+		received := &change(address).Received
+		var err error
+		if *received, err = received.Add(tokenTx.Amounts[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, transferTokenTx := range transferTokenTxs {
+		if transferTokenTx.BlockNumber != blockNumber {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			blockNumber = transferTokenTx.BlockNumber
+		}
+		for i, address := range transferTokenTx.Addresses {
+			sent := &change(transferTokenTx.From).Sent
+			received := &change(address).Received
+			var err error
+			if *sent, err = sent.Add(transferTokenTx.Amounts[i]); err != nil {
+				return nil, err
+			}
+			if *received, err = received.Add(transferTokenTx.Amounts[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return balanceChanges, nil
+}
+
+// LastChangeBlockNumbers returns the block of the last balance change of each
+// holder in balanceChanges, which are in ledger order.
+func LastChangeBlockNumbers(balanceChanges []*models.BalanceChange) map[common.Address]int64 {
+	blockNumbers := make(map[common.Address]int64)
+	for _, balanceChange := range balanceChanges {
+		blockNumbers[balanceChange.Address] = balanceChange.BlockNumber
+	}
+	return blockNumbers
+}
+
+// getTokenTransferTokenTxs returns the transfers of the token created by
+// tokenTx in block order.
+func (m *MongoDBProcessor) getTokenTransferTokenTxs(tokenTx *models.TokenTx) ([]*models.TransferTokenTx, error) {
+	o := options.Find().SetSort(bson.D{
+		{Key: "blockNumber", Value: 1},
+		{Key: "txIndex", Value: 1},
+	})
+	cursor, err := m.transferTokenTxsCollection.Find(m.ctx, bson.M{"tokenTxHash": tokenTx.TxHash}, o)
+	if err != nil {
+		return nil, err
+	}
+	var transferTokenTxs []*models.TransferTokenTx
+	if err := cursor.All(m.ctx, &transferTokenTxs); err != nil {
+		return nil, err
+	}
+	return transferTokenTxs, nil
+}
+
+// backfillBalanceChanges rebuilds the ledger of the txs indexed before it
+// existed by replaying each token from its creation.
+func (m *MongoDBProcessor) backfillBalanceChanges() error {
+	_, err := m.balanceChangesCollection.DeleteMany(m.ctx, bson.M{"txIndex": models.BackfilledTxIndex})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := m.tokenTxsCollection.Find(m.ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	for cursor.Next(m.ctx) {
+		tokenTx := &models.TokenTx{}
+		if err := cursor.Decode(tokenTx); err != nil {
+			return err
+		}
+		if err := m.backfillTokenBalanceChanges(tokenTx); err != nil {
+			m.log.Error("[backfillBalanceChanges] Failed to backfill token",
+				"Token", tokenTx.TxHash.ToString(),
+				"Error", err.Error())
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *MongoDBProcessor) backfillTokenBalanceChanges(tokenTx *models.TokenTx) error {
+	transferTokenTxs, err := m.getTokenTransferTokenTxs(tokenTx)
+	if err != nil {
+		return err
+	}
+	balanceChanges, err := BackfillTokenBalanceChanges(tokenTx, transferTokenTxs)
+	if err != nil {
+		return err
+	}
+
+	var operations []mongo.WriteModel
+	for _, balanceChange := range balanceChanges {
+		AddReplaceOneModelIntoOperations(&operations, balanceChange)
+		if len(operations) == 1000 {
+			if _, err := m.balanceChangesCollection.BulkWrite(m.ctx, operations); err != nil {
+				return err
+			}
+			operations = operations[:0]
+		}
+	}
+	if len(operations) == 0 {
+		return nil
+	}
+	_, err = m.balanceChangesCollection.BulkWrite(m.ctx, operations)
+	return err
+}
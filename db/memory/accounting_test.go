@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"math"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+// TestProcessRevertTransfer processes a transfer on top of a token, then
+// reverts it, which must restore the balances and stats before the transfer.
+func TestProcessRevertTransfer(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		to      []common.Address
+		amounts []uint64
+		// balances after the transfer of alice, bob and carol
+		after []common.Amount
+	}{
+		{"single recipient", []common.Address{bob}, []uint64{300}, []common.Amount{700, 300, 0}},
+		{"several recipients", []common.Address{bob, carol}, []uint64{300, 200}, []common.Amount{500, 300, 200}},
+		{"repeated recipient", []common.Address{bob, bob}, []uint64{5, 5}, []common.Amount{990, 10, 0}},
+		{"sender as recipient", []common.Address{alice, bob}, []uint64{100, 100}, []common.Amount{900, 100, 0}},
+		{"whole balance", []common.Address{carol}, []uint64{1000}, []common.Amount{0, 0, 1000}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			token := fakenode.NewTokenTx("token", "TST", 0, alice,
+				[]common.Address{alice}, []uint64{1000})
+			tokenTxHash := misc.ToSizedHash(token.TransactionHash)
+			node := fakenode.NewNode()
+			node.Append(token)
+			node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice, test.to, test.amounts))
+
+			s := newTestStore(t)
+			testutil.Index(t, s, node)
+			for i, address := range []common.Address{alice, bob, carol} {
+				testutil.AssertBalance(t, s, tokenTxHash, address, test.after[i])
+			}
+			holders := int64(0)
+			for _, amount := range test.after {
+				if amount > 0 {
+					holders++
+				}
+			}
+			testutil.AssertSupply(t, s, tokenTxHash, 1000, holders)
+
+			undoRecord, err := s.GetUndoRecord(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[common.Address]bool)
+			for _, image := range undoRecord.TokenHolders {
+				if seen[image.Address] {
+					t.Fatalf("several before images of %s", image.Address.ToString())
+				}
+				seen[image.Address] = true
+			}
+
+			if err := s.RevertLastBlock(); err != nil {
+				t.Fatal(err)
+			}
+			testutil.AssertBalance(t, s, tokenTxHash, alice, 1000)
+			testutil.AssertBalance(t, s, tokenTxHash, bob, 0)
+			testutil.AssertBalance(t, s, tokenTxHash, carol, 0)
+			testutil.AssertSupply(t, s, tokenTxHash, 1000, 1)
+
+			// Reverting the token creation removes the token altogether
+			if err := s.RevertLastBlock(); err != nil {
+				t.Fatal(err)
+			}
+			testutil.AssertBalance(t, s, tokenTxHash, alice, 0)
+			if _, err := s.GetTokenStats(tokenTxHash); err == nil {
+				t.Fatal("token stats kept after reverting the token creation")
+			}
+		})
+	}
+}
+
+// TestProcessRepeatedInitialBalance processes a token listing an initial holder
+// twice, who holds the sum of both amounts.
+func TestProcessRepeatedInitialBalance(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice,
+		[]common.Address{alice, bob, alice}, []uint64{1000, 10, 5}))
+	testutil.Index(t, s, node)
+
+	testutil.AssertBalance(t, s, tokenTxHash, alice, 1005)
+	testutil.AssertBalance(t, s, tokenTxHash, bob, 10)
+	testutil.AssertSupply(t, s, tokenTxHash, 1015, 2)
+	var received []common.Amount
+	for _, record := range testutil.Dump(t, s, db.StateBalanceChanges) {
+		if balanceChange := record.(*models.BalanceChange); balanceChange.Address == alice {
+			received = append(received, balanceChange.Received)
+		}
+	}
+	if len(received) != 1 || received[0] != 1005 {
+		t.Fatalf("alice received %v in the ledger, want 1005 once", received)
+	}
+	if balance, err := s.GetBalanceAtHeight(tokenTxHash, alice, 1); err != nil || balance != 1005 {
+		t.Fatalf("balance of alice at #1 %d (%v), want 1005", balance, err)
+	}
+
+	if err := s.RevertLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertBalance(t, s, tokenTxHash, alice, 0)
+	testutil.AssertBalance(t, s, tokenTxHash, bob, 0)
+}
+
+func TestProcessingErrorOfOverflowingInitialBalance(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	testutil.Index(t, s, node)
+
+	b := node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice,
+		[]common.Address{alice, alice}, []uint64{math.MaxUint64, 1}))
+	f := processFailing(t, s, b)
+	if tokenTxHash := fakenode.NewTxHash("token"); f.TxHash != tokenTxHash || f.TokenTxHash != tokenTxHash {
+		t.Fatalf("failure of tx %s of token %s, want the token tx", f.TxHash.ToString(), f.TokenTxHash.ToString())
+	}
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"sort"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+)
+
+func (s *MemoryStore) GetTransferTokenTx(txHash common.Hash) (*models.TransferTokenTx, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.TransferTokenTxs[txHash]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	t := *stored
+	return &t, nil
+}
+
+// GetTransferTokenTxsByAddressAfter returns the transfers of the token sent or
+// received by address in blocks above blockNumber, latest first.
+func (s *MemoryStore) GetTransferTokenTxsByAddressAfter(tokenTxHash common.Hash, address common.Address,
+	blockNumber int64) ([]*models.TransferTokenTx, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var transferTokenTxs []*models.TransferTokenTx
+	blockNumbers := sortedBlockNumbers(s.state.TransferTokenTxsByBlock)
+	for i := len(blockNumbers) - 1; i >= 0 && blockNumbers[i] > blockNumber; i-- {
+		for _, txHash := range s.state.TransferTokenTxsByBlock[blockNumbers[i]] {
+			stored := s.state.TransferTokenTxs[txHash]
+			if stored.TokenTxHash != tokenTxHash || !involves(stored, address) {
+				continue
+			}
+			t := *stored
+			transferTokenTxs = append(transferTokenTxs, &t)
+		}
+	}
+	sort.SliceStable(transferTokenTxs, func(i, j int) bool {
+		if transferTokenTxs[i].BlockNumber != transferTokenTxs[j].BlockNumber {
+			return transferTokenTxs[i].BlockNumber > transferTokenTxs[j].BlockNumber
+		}
+		return transferTokenTxs[i].TxIndex > transferTokenTxs[j].TxIndex
+	})
+	return transferTokenTxs, nil
+}
+
+func involves(t *models.TransferTokenTx, address common.Address) bool {
+	if t.From == address {
+		return true
+	}
+	for _, to := range t.Addresses {
+		if to == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) GetTipNumber() (int64, error) {
+	return db.GetTipNumber(s)
+}
+
+func (s *MemoryStore) GetTokenTxWithFinality(txHash common.Hash) (*models.TokenTx, error) {
+	return db.GetTokenTxWithFinality(s, txHash, s.config.FinalityThreshold)
+}
+
+func (s *MemoryStore) GetTransferTokenTxWithFinality(txHash common.Hash) (*models.TransferTokenTx, error) {
+	return db.GetTransferTokenTxWithFinality(s, txHash, s.config.FinalityThreshold)
+}
+
+func (s *MemoryStore) GetTokenHolderWithFinality(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error) {
+	return db.GetTokenHolderWithFinality(s, tokenTxHash, address, s.config.FinalityThreshold)
+}
+
+func (s *MemoryStore) GetTokenHolderBalance(tokenTxHash common.Hash, address common.Address,
+	minConfirmations uint64) (*models.TokenHolderBalance, error) {
+	return db.GetTokenHolderBalance(s, tokenTxHash, address, minConfirmations, s.config.FinalityThreshold)
+}
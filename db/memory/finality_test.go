@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+func TestFinality(t *testing.T) {
+	c := config.DefaultConfig()
+	c.FinalityThreshold = 3
+	s := NewMemoryStore(c)
+
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+	// bob sends to himself too
+	node.Append(fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, bob,
+		[]common.Address{alice, bob}, []uint64{100, 50}))
+	node.Append()
+	testutil.Index(t, s, node)
+
+	tip, err := s.GetTipNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip != 4 {
+		t.Fatalf("tip %d, want 4", tip)
+	}
+
+	tokenTx, err := s.GetTokenTxWithFinality(tokenTxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenTx.Confirmations != 4 || !tokenTx.Final {
+		t.Fatalf("token tx finality %+v, want 4 confirmations and final", tokenTx.Finality)
+	}
+	transferTokenTx, err := s.GetTransferTokenTxWithFinality(fakenode.NewTxHash("transfer-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transferTokenTx.Confirmations != 2 || transferTokenTx.Final {
+		t.Fatalf("transfer finality %+v, want 2 confirmations and not final", transferTokenTx.Finality)
+	}
+	tokenHolder, err := s.GetTokenHolderWithFinality(tokenTxHash, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenHolder.Amount != 200 || tokenHolder.Confirmations != 2 {
+		t.Fatalf("holder %d with %d confirmations, want 200 with 2", tokenHolder.Amount, tokenHolder.Confirmations)
+	}
+
+	for _, test := range []struct {
+		address          common.Address
+		minConfirmations uint64
+		want             common.Amount
+		asOf             int64
+		final            bool
+	}{
+		{alice, 0, 800, 4, false},
+		{bob, 1, 200, 4, false},
+		{bob, 2, 200, 3, false},
+		{alice, 3, 700, 2, true},
+		{bob, 3, 300, 2, true},
+		{alice, 4, 1000, 1, true},
+		{bob, 4, 0, 1, true},
+		// The token isn't created yet
+		{alice, 5, 0, 0, true},
+	} {
+		balance, err := s.GetTokenHolderBalance(tokenTxHash, test.address, test.minConfirmations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Amount != test.want || balance.AsOfBlockNumber != test.asOf || balance.Final != test.final {
+			t.Errorf("balance of %s with %d confirmations: %d as of #%d final %v, want %d as of #%d final %v",
+				test.address.ToString(), test.minConfirmations, balance.Amount, balance.AsOfBlockNumber,
+				balance.Final, test.want, test.asOf, test.final)
+		}
+	}
+}
+
+// TestFinalityReceivedAndSpentInBlock checks the balance below a block in which
+// the address receives tokens and spends them all.
+func TestFinalityReceivedAndSpentInBlock(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append()
+	node.Append(
+		fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice, []common.Address{bob}, []uint64{300}),
+		fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, bob, []common.Address{carol}, []uint64{300}))
+	testutil.Index(t, s, node)
+
+	for _, test := range []struct {
+		address common.Address
+		want    common.Amount
+	}{
+		{alice, 1000},
+		{bob, 0},
+		{carol, 0},
+	} {
+		balance, err := s.GetTokenHolderBalance(tokenTxHash, test.address, 2)
+		if err != nil {
+			t.Fatalf("balance of %s as of #2: %v", test.address.ToString(), err)
+		}
+		if balance.Amount != test.want || balance.AsOfBlockNumber != 2 {
+			t.Errorf("balance of %s: %d as of #%d, want %d as of #2", test.address.ToString(), balance.Amount,
+				balance.AsOfBlockNumber, test.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+var (
+	alice = testutil.Alice
+	bob   = testutil.Bob
+	carol = testutil.Carol
+)
+
+func newTestStore(t *testing.T) *MemoryStore {
+	t.Helper()
+	return NewMemoryStore(config.DefaultConfig())
+}
+
+// newGeneratedStore returns a store which processed a synthetic chain of
+// blocks, without forks.
+func newGeneratedStore(t *testing.T, seed int64, blocks uint64) *MemoryStore {
+	t.Helper()
+	s := newTestStore(t)
+	testutil.Process(t, s, testutil.GenerateBlocks(t, seed, blocks)...)
+	return s
+}
+
+// tokenTransferTokenTxs returns the transfers of each token dumped by s, in
+// block order.
+func tokenTransferTokenTxs(t *testing.T, s db.StateDumper) map[common.Hash][]*models.TransferTokenTx {
+	t.Helper()
+	transferTokenTxs := make(map[common.Hash][]*models.TransferTokenTx)
+	for _, record := range testutil.Dump(t, s, db.StateTransferTokenTxs) {
+		transferTokenTx := record.(*models.TransferTokenTx)
+		transferTokenTxs[transferTokenTx.TokenTxHash] = append(transferTokenTxs[transferTokenTx.TokenTxHash],
+			transferTokenTx)
+	}
+	return transferTokenTxs
+}
@@ -0,0 +1,141 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+// backfill returns a store holding only the ledger backfilled from the txs of
+// s, as migrating a database indexed before the ledger existed does.
+func backfill(t *testing.T, s *MemoryStore) *MemoryStore {
+	t.Helper()
+	transferTokenTxs := tokenTransferTokenTxs(t, s)
+	var balanceChanges []interface{}
+	for _, record := range testutil.Dump(t, s, db.StateTokenTxs) {
+		tokenTx := record.(*models.TokenTx)
+		backfilled, err := db.BackfillTokenBalanceChanges(tokenTx, transferTokenTxs[tokenTx.TxHash])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, balanceChange := range backfilled {
+			balanceChanges = append(balanceChanges, balanceChange)
+		}
+	}
+	backfilled := newTestStore(t)
+	if err := backfilled.RestoreState(db.StateBalanceChanges, balanceChanges); err != nil {
+		t.Fatal(err)
+	}
+	return backfilled
+}
+
+func TestBackfillBalanceChanges(t *testing.T) {
+	s := newGeneratedStore(t, 11, 200)
+	backfilled := backfill(t, s)
+
+	checkpoint, err := s.GetCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holders := make(map[TokenHolderKey]bool)
+	for _, record := range testutil.Dump(t, s, db.StateBalanceChanges) {
+		balanceChange := record.(*models.BalanceChange)
+		holders[TokenHolderKey{balanceChange.TokenTxHash, balanceChange.Address}] = true
+	}
+	if len(holders) == 0 {
+		t.Fatal("no balance changes")
+	}
+
+	// The backfilled ledger only has an entry per block, so the balances
+	// after every block must match
+	for blockNumber := int64(0); blockNumber <= checkpoint.BlockNumber; blockNumber++ {
+		for holder := range holders {
+			want, err := s.GetBalanceAtHeight(holder.TokenTxHash, holder.Address, blockNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := backfilled.GetBalanceAtHeight(holder.TokenTxHash, holder.Address, blockNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("balance of %s of %s at #%d backfilled as %d, want %d",
+					holder.Address.ToString(), holder.TokenTxHash.ToString(), blockNumber, got, want)
+			}
+		}
+	}
+
+	for _, record := range testutil.Dump(t, s, db.StateTokenTxs) {
+		tokenTxHash := record.(*models.TokenTx).TxHash
+		for _, blockNumber := range []int64{checkpoint.BlockNumber / 2, checkpoint.BlockNumber} {
+			want, err := s.GetBalancesAtHeight(tokenTxHash, blockNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := backfilled.GetBalancesAtHeight(tokenTxHash, blockNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%d holders of %s at #%d backfilled, want %d",
+					len(got), tokenTxHash.ToString(), blockNumber, len(want))
+			}
+			for i := range want {
+				if got[i].Address != want[i].Address || got[i].Balance != want[i].Balance {
+					t.Fatalf("holder of %s at #%d backfilled as %s with %d, want %s with %d",
+						tokenTxHash.ToString(), blockNumber, got[i].Address.ToString(), got[i].Balance,
+						want[i].Address.ToString(), want[i].Balance)
+				}
+			}
+		}
+	}
+}
+
+func TestBackfilledBalanceChangesPerBlock(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	// Two transfers in a block, the second spending what the first received
+	node.Append(
+		fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice, []common.Address{bob}, []uint64{300}),
+		fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, bob, []common.Address{carol, bob}, []uint64{200, 50}))
+	testutil.Index(t, s, node)
+
+	tokenTx, err := s.GetTokenTx(tokenTxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balanceChanges, err := db.BackfillTokenBalanceChanges(tokenTx, tokenTransferTokenTxs(t, s)[tokenTxHash])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.BalanceChange{
+		{Address: alice, BlockNumber: 1, Received: 1000, Balance: 1000},
+		{Address: alice, BlockNumber: 2, Sent: 300, Balance: 700},
+		{Address: bob, BlockNumber: 2, Received: 350, Sent: 250, Balance: 100},
+		{Address: carol, BlockNumber: 2, Received: 200, Balance: 200},
+	}
+	if len(balanceChanges) != len(want) {
+		t.Fatalf("%d balance changes backfilled, want %d", len(balanceChanges), len(want))
+	}
+	for i, balanceChange := range balanceChanges {
+		w := want[i]
+		w.TokenTxHash = tokenTxHash
+		w.TxIndex = models.BackfilledTxIndex
+		if *balanceChange != w {
+			t.Errorf("balance change %+v, want %+v", *balanceChange, w)
+		}
+	}
+
+	// Block timestamps aren't known to the backfilled ledger
+	backfilled := backfill(t, s)
+	_, err = backfilled.GetBalanceAtTimestamp(tokenTxHash, bob, fakenode.GenesisTimestamp+3600)
+	if err != db.ErrTimestampUnknown {
+		t.Fatalf("balance at timestamp from backfilled ledger: %v, want %v", err, db.ErrTimestampUnknown)
+	}
+}
@@ -0,0 +1,788 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/log"
+)
+
+type TokenHolderKey struct {
+	TokenTxHash common.Hash
+	Address     common.Address
+}
+
+type TokenRelatedTxKey struct {
+	TokenTxHash common.Hash
+	TxHash      common.Hash
+}
+
+// State is everything held by a MemoryStore. Txs are additionally indexed by
+// block number, in the order they appear in the block. The balance ledger of
+// each token holder is kept in ledger order, and state commitments in block
+// order.
+type State struct {
+	Blocks           map[int64]*models.Block
+	TokenTxs         map[common.Hash]*models.TokenTx
+	TransferTokenTxs map[common.Hash]*models.TransferTokenTx
+	TokenRelatedTxs  map[TokenRelatedTxKey]*models.TokenRelatedTx
+	TokenHolders     map[TokenHolderKey]*models.TokenHolder
+	UndoRecords      map[int64]*models.UndoRecord
+	Checkpoint       *models.Checkpoint
+	BalanceChanges   map[TokenHolderKey][]*models.BalanceChange
+	TokenStats       map[common.Hash]*models.TokenStats
+	StateCommitments []*models.StateCommitment
+	// ProcessingFailures are kept in the order they were recorded
+	ProcessingFailures []*models.ProcessingFailure
+	// ReconciliationReports are kept in the order they were inserted
+	ReconciliationReports []*models.ReconciliationReport
+
+	TokenTxsByBlock         map[int64][]common.Hash
+	TransferTokenTxsByBlock map[int64][]common.Hash
+}
+
+func newState() *State {
+	return &State{
+		Blocks:                  make(map[int64]*models.Block),
+		TokenTxs:                make(map[common.Hash]*models.TokenTx),
+		TransferTokenTxs:        make(map[common.Hash]*models.TransferTokenTx),
+		TokenRelatedTxs:         make(map[TokenRelatedTxKey]*models.TokenRelatedTx),
+		TokenHolders:            make(map[TokenHolderKey]*models.TokenHolder),
+		UndoRecords:             make(map[int64]*models.UndoRecord),
+		BalanceChanges:          make(map[TokenHolderKey][]*models.BalanceChange),
+		TokenStats:              make(map[common.Hash]*models.TokenStats),
+		TokenTxsByBlock:         make(map[int64][]common.Hash),
+		TransferTokenTxsByBlock: make(map[int64][]common.Hash),
+	}
+}
+
+// MemoryStore is a db.Store keeping the whole index in memory, for tests and
+// ephemeral indexing without a MongoDB replica set. Blocks are applied and
+// reverted atomically: all changes are validated before any is made.
+type MemoryStore struct {
+	// writeLock serializes ProcessBlock and RevertLastBlock, while lock
+	// guards state against concurrent readers
+	writeLock sync.Mutex
+	lock      sync.RWMutex
+
+	config *config.Config
+	log    log.LoggerInterface
+
+	state *State
+}
+
+var _ db.Store = (*MemoryStore)(nil)
+
+func NewMemoryStore(c *config.Config) *MemoryStore {
+	return &MemoryStore{
+		config: c,
+		log:    log.GetLogger(),
+		state:  newState(),
+	}
+}
+
+// LoadMemoryStore creates a MemoryStore from a file written by Dump.
+func LoadMemoryStore(c *config.Config, path string) (*MemoryStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := NewMemoryStore(c)
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(s.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load memory store from %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Dump writes the whole state to path, replacing the file atomically.
+func (s *MemoryStore) Dump(path string) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(s.state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *MemoryStore) GetLastBlock() (*models.Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var last *models.Block
+	for _, b := range s.state.Blocks {
+		if last == nil || b.Number > last.Number {
+			last = b
+		}
+	}
+	if last == nil {
+		return nil, db.ErrNotFound
+	}
+	b := *last
+	return &b, nil
+}
+
+func (s *MemoryStore) GetBlockByNumber(number int64) (*models.Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.Blocks[number]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	b := *stored
+	return &b, nil
+}
+
+func (s *MemoryStore) GetCheckpoint() (*models.Checkpoint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.state.Checkpoint == nil {
+		return nil, db.ErrNotFound
+	}
+	c := *s.state.Checkpoint
+	return &c, nil
+}
+
+func (s *MemoryStore) GetTokenTxsByBlockNumber(blockNumber int64) ([]*models.TokenTx, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var tokenTxs []*models.TokenTx
+	for _, txHash := range s.state.TokenTxsByBlock[blockNumber] {
+		t := *s.state.TokenTxs[txHash]
+		tokenTxs = append(tokenTxs, &t)
+	}
+	sort.SliceStable(tokenTxs, func(i, j int) bool {
+		return tokenTxs[i].TxIndex < tokenTxs[j].TxIndex
+	})
+	return tokenTxs, nil
+}
+
+func (s *MemoryStore) GetTransferTokenTxsByBlockNumber(blockNumber int64) ([]*models.TransferTokenTx, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var transferTokenTxs []*models.TransferTokenTx
+	for _, txHash := range s.state.TransferTokenTxsByBlock[blockNumber] {
+		t := *s.state.TransferTokenTxs[txHash]
+		transferTokenTxs = append(transferTokenTxs, &t)
+	}
+	sort.SliceStable(transferTokenTxs, func(i, j int) bool {
+		return transferTokenTxs[i].TxIndex < transferTokenTxs[j].TxIndex
+	})
+	return transferTokenTxs, nil
+}
+
+func (s *MemoryStore) GetTokenTx(txHash common.Hash) (*models.TokenTx, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.TokenTxs[txHash]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	t := *stored
+	return &t, nil
+}
+
+// GetTokenHolder returns a copy of the stored holder, as the token accounting
+// updates the returned holders in place.
+func (s *MemoryStore) GetTokenHolder(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.TokenHolders[TokenHolderKey{tokenTxHash, address}]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	t := *stored
+	return &t, nil
+}
+
+func (s *MemoryStore) GetTokenStats(tokenTxHash common.Hash) (*models.TokenStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.TokenStats[tokenTxHash]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	t := *stored
+	return &t, nil
+}
+
+func (s *MemoryStore) GetStateCommitment(blockNumber int64) (*models.StateCommitment, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	commitments := s.state.StateCommitments
+	i := sort.Search(len(commitments), func(i int) bool {
+		return commitments[i].BlockNumber > blockNumber
+	})
+	if i == 0 {
+		return nil, db.ErrNotFound
+	}
+	c := *commitments[i-1]
+	return &c, nil
+}
+
+func (s *MemoryStore) GetUndoRecord(blockNumber int64) (*models.UndoRecord, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.state.UndoRecords[blockNumber]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	u := *stored
+	return &u, nil
+}
+
+func (s *MemoryStore) GetBalanceAtHeight(tokenTxHash common.Hash, address common.Address,
+	blockNumber int64) (common.Amount, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ledger := s.state.BalanceChanges[TokenHolderKey{tokenTxHash, address}]
+	i := sort.Search(len(ledger), func(i int) bool {
+		return ledger[i].BlockNumber > blockNumber
+	})
+	if i == 0 {
+		return 0, nil
+	}
+	return ledger[i-1].Balance, nil
+}
+
+func (s *MemoryStore) GetBalanceAtTimestamp(tokenTxHash common.Hash, address common.Address,
+	timestamp uint64) (common.Amount, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Block timestamps don't decrease along the ledger
+	ledger := s.state.BalanceChanges[TokenHolderKey{tokenTxHash, address}]
+	i := sort.Search(len(ledger), func(i int) bool {
+		return ledger[i].Timestamp > timestamp
+	})
+	if i == 0 {
+		return 0, nil
+	}
+	if ledger[i-1].Timestamp == 0 {
+		return 0, db.ErrTimestampUnknown
+	}
+	return ledger[i-1].Balance, nil
+}
+
+func (s *MemoryStore) GetBalancesAtHeight(tokenTxHash common.Hash,
+	blockNumber int64) ([]*models.BalanceChange, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var balanceChanges []*models.BalanceChange
+	for key, ledger := range s.state.BalanceChanges {
+		if key.TokenTxHash != tokenTxHash {
+			continue
+		}
+		i := sort.Search(len(ledger), func(i int) bool {
+			return ledger[i].BlockNumber > blockNumber
+		})
+		if i == 0 || ledger[i-1].Balance == 0 {
+			continue
+		}
+		b := *ledger[i-1]
+		balanceChanges = append(balanceChanges, &b)
+	}
+	sort.Slice(balanceChanges, func(i, j int) bool {
+		return bytes.Compare(balanceChanges[i].Address[:], balanceChanges[j].Address[:]) < 0
+	})
+	return balanceChanges, nil
+}
+
+// DumpState dumps txs in block order, and within a block in the order they
+// appear in the block, so that RestoreState rebuilds the same indexes.
+func (s *MemoryStore) DumpState(collection string, fn func(record interface{}) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	switch collection {
+	case db.StateTokenTxs:
+		for _, blockNumber := range sortedBlockNumbers(s.state.TokenTxsByBlock) {
+			for _, txHash := range s.state.TokenTxsByBlock[blockNumber] {
+				if err := fn(s.state.TokenTxs[txHash]); err != nil {
+					return err
+				}
+			}
+		}
+	case db.StateTransferTokenTxs:
+		for _, blockNumber := range sortedBlockNumbers(s.state.TransferTokenTxsByBlock) {
+			for _, txHash := range s.state.TransferTokenTxsByBlock[blockNumber] {
+				if err := fn(s.state.TransferTokenTxs[txHash]); err != nil {
+					return err
+				}
+			}
+		}
+	case db.StateTokenRelatedTxs:
+		for _, tokenRelatedTx := range s.state.TokenRelatedTxs {
+			if err := fn(tokenRelatedTx); err != nil {
+				return err
+			}
+		}
+	case db.StateTokenHolders:
+		for _, tokenHolder := range s.state.TokenHolders {
+			if err := fn(tokenHolder); err != nil {
+				return err
+			}
+		}
+	case db.StateBalanceChanges:
+		for _, ledger := range s.state.BalanceChanges {
+			for _, balanceChange := range ledger {
+				if err := fn(balanceChange); err != nil {
+					return err
+				}
+			}
+		}
+	case db.StateTokenStats:
+		for _, tokenStats := range s.state.TokenStats {
+			if err := fn(tokenStats); err != nil {
+				return err
+			}
+		}
+	case db.StateStateCommitments:
+		for _, stateCommitment := range s.state.StateCommitments {
+			if err := fn(stateCommitment); err != nil {
+				return err
+			}
+		}
+	case db.StateUndoRecords:
+		for _, undoRecord := range s.state.UndoRecords {
+			if err := fn(undoRecord); err != nil {
+				return err
+			}
+		}
+	case db.StateBlocks:
+		for _, block := range s.state.Blocks {
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+	case db.StateCheckpoint:
+		if s.state.Checkpoint != nil {
+			return fn(s.state.Checkpoint)
+		}
+	default:
+		return fmt.Errorf("unknown state collection %s", collection)
+	}
+	return nil
+}
+
+func sortedBlockNumbers(byBlock map[int64][]common.Hash) []int64 {
+	blockNumbers := make([]int64, 0, len(byBlock))
+	for blockNumber := range byBlock {
+		blockNumbers = append(blockNumbers, blockNumber)
+	}
+	sort.Slice(blockNumbers, func(i, j int) bool {
+		return blockNumbers[i] < blockNumbers[j]
+	})
+	return blockNumbers
+}
+
+func (s *MemoryStore) RestoreState(collection string, records []interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, record := range records {
+		switch t := record.(type) {
+		case *models.TokenTx:
+			if _, ok := s.state.TokenTxs[t.TxHash]; !ok {
+				s.state.TokenTxsByBlock[t.BlockNumber] = append(s.state.TokenTxsByBlock[t.BlockNumber], t.TxHash)
+			}
+			s.state.TokenTxs[t.TxHash] = t
+		case *models.TransferTokenTx:
+			if _, ok := s.state.TransferTokenTxs[t.TxHash]; !ok {
+				s.state.TransferTokenTxsByBlock[t.BlockNumber] = append(s.state.TransferTokenTxsByBlock[t.BlockNumber], t.TxHash)
+			}
+			s.state.TransferTokenTxs[t.TxHash] = t
+		case *models.TokenRelatedTx:
+			s.state.TokenRelatedTxs[TokenRelatedTxKey{t.TokenTxHash, t.TxHash}] = t
+		case *models.TokenHolder:
+			s.state.TokenHolders[TokenHolderKey{t.TokenTxHash, t.Address}] = t
+		case *models.BalanceChange:
+			s.restoreBalanceChange(t)
+		case *models.TokenStats:
+			s.state.TokenStats[t.TokenTxHash] = t
+		case *models.StateCommitment:
+			s.restoreStateCommitment(t)
+		case *models.UndoRecord:
+			s.state.UndoRecords[t.BlockNumber] = t
+		case *models.Block:
+			s.state.Blocks[t.Number] = t
+		case *models.Checkpoint:
+			s.state.Checkpoint = t
+		default:
+			return fmt.Errorf("unexpected %T restoring %s", record, collection)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteState(collection string, records []interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, record := range records {
+		switch t := record.(type) {
+		case *models.TokenTx:
+			delete(s.state.TokenTxs, t.TxHash)
+			s.state.TokenTxsByBlock[t.BlockNumber] = removeHash(s.state.TokenTxsByBlock[t.BlockNumber], t.TxHash)
+		case *models.TransferTokenTx:
+			delete(s.state.TransferTokenTxs, t.TxHash)
+			s.state.TransferTokenTxsByBlock[t.BlockNumber] = removeHash(s.state.TransferTokenTxsByBlock[t.BlockNumber], t.TxHash)
+		case *models.TokenRelatedTx:
+			delete(s.state.TokenRelatedTxs, TokenRelatedTxKey{t.TokenTxHash, t.TxHash})
+		case *models.TokenHolder:
+			delete(s.state.TokenHolders, TokenHolderKey{t.TokenTxHash, t.Address})
+		case *models.TokenStats:
+			delete(s.state.TokenStats, t.TokenTxHash)
+		default:
+			return fmt.Errorf("unexpected %T deleting %s", record, collection)
+		}
+	}
+	return nil
+}
+
+func removeHash(hashes []common.Hash, hash common.Hash) []common.Hash {
+	for i := range hashes {
+		if hashes[i] == hash {
+			return append(hashes[:i], hashes[i+1:]...)
+		}
+	}
+	return hashes
+}
+
+// restoreBalanceChange inserts b into the ledger of its holder in ledger
+// order, replacing an entry for the same tx.
+func (s *MemoryStore) restoreBalanceChange(b *models.BalanceChange) {
+	key := TokenHolderKey{b.TokenTxHash, b.Address}
+	ledger := s.state.BalanceChanges[key]
+	i := sort.Search(len(ledger), func(i int) bool {
+		return !ledger[i].Before(b)
+	})
+	if i < len(ledger) && !b.Before(ledger[i]) {
+		ledger[i] = b
+		return
+	}
+	ledger = append(ledger, nil)
+	copy(ledger[i+1:], ledger[i:])
+	ledger[i] = b
+	s.state.BalanceChanges[key] = ledger
+}
+
+func (s *MemoryStore) RecordProcessingFailure(f *models.ProcessingFailure) (*models.ProcessingFailure, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().UTC()
+	recorded := s.processingFailure(f.BlockNumber)
+	if recorded != nil && recorded.BlockHash != f.BlockHash {
+		recorded.ResolvedAt = &now
+		recorded.Resolution = models.ProcessingFailureResolutionReplaced
+		recorded = nil
+	}
+	if recorded == nil {
+		recorded = &models.ProcessingFailure{
+			BlockNumber:   f.BlockNumber,
+			BlockHash:     f.BlockHash,
+			FirstFailedAt: now,
+		}
+		s.state.ProcessingFailures = append(s.state.ProcessingFailures, recorded)
+	}
+	recorded.Block = f.Block
+	recorded.TxHash = f.TxHash
+	recorded.TokenTxHash = f.TokenTxHash
+	recorded.Error = f.Error
+	recorded.TokenHolders = f.TokenHolders
+	recorded.LastFailedAt = now
+	recorded.Attempts++
+	r := *recorded
+	return &r, nil
+}
+
+// processingFailure returns the unresolved failure at blockNumber, or nil.
+func (s *MemoryStore) processingFailure(blockNumber int64) *models.ProcessingFailure {
+	for _, f := range s.state.ProcessingFailures {
+		if f.BlockNumber == blockNumber && !f.IsResolved() {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetProcessingFailure(blockNumber int64) (*models.ProcessingFailure, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	f := s.processingFailure(blockNumber)
+	if f == nil {
+		return nil, db.ErrNotFound
+	}
+	r := *f
+	return &r, nil
+}
+
+func (s *MemoryStore) GetProcessingFailures() ([]*models.ProcessingFailure, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var failures []*models.ProcessingFailure
+	for _, f := range s.state.ProcessingFailures {
+		if !f.IsResolved() {
+			r := *f
+			failures = append(failures, &r)
+		}
+	}
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].BlockNumber < failures[j].BlockNumber
+	})
+	return failures, nil
+}
+
+func (s *MemoryStore) ResolveProcessingFailure(blockNumber int64, resolution string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f := s.processingFailure(blockNumber)
+	if f == nil {
+		return db.ErrNotFound
+	}
+	now := time.Now().UTC()
+	f.ResolvedAt = &now
+	f.Resolution = resolution
+	return nil
+}
+
+// restoreStateCommitment inserts c in block order, replacing a commitment of
+// the same block.
+func (s *MemoryStore) restoreStateCommitment(c *models.StateCommitment) {
+	commitments := s.state.StateCommitments
+	i := sort.Search(len(commitments), func(i int) bool {
+		return commitments[i].BlockNumber >= c.BlockNumber
+	})
+	if i < len(commitments) && commitments[i].BlockNumber == c.BlockNumber {
+		commitments[i] = c
+		return
+	}
+	commitments = append(commitments, nil)
+	copy(commitments[i+1:], commitments[i:])
+	commitments[i] = c
+	s.state.StateCommitments = commitments
+}
+
+func (s *MemoryStore) ProcessBlock(b *generated.Block) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	processed, err := db.IsBlockProcessed(s, b)
+	if err != nil {
+		return err
+	}
+	if processed {
+		s.log.Warn("[ProcessBlock] Skipping already processed block",
+			"#", b.Header.BlockNumber)
+		return nil
+	}
+
+	changes, err := db.NewProcessBlockChanges(s, b, s.config.ReOrgLimit)
+	if err != nil {
+		s.log.Error("[ProcessBlock] Failed to process block",
+			"#", b.Header.BlockNumber,
+			"Error", err.Error())
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.validateProcess(changes); err != nil {
+		return err
+	}
+	s.applyProcess(changes)
+	return nil
+}
+
+func (s *MemoryStore) RevertLastBlock() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	b, err := s.GetLastBlock()
+	if err != nil {
+		return err
+	}
+
+	changes, err := db.NewRevertBlockChanges(s, b)
+	if err != nil {
+		s.log.Error("[RevertLastBlock] Failed to revert block",
+			"#", b.Number,
+			"Error", err.Error())
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.applyRevert(changes)
+	return nil
+}
+
+// validateProcess enforces the same uniqueness as the MongoDB indexes, before
+// anything is written.
+func (s *MemoryStore) validateProcess(c *models.BlockChanges) error {
+	if _, ok := s.state.Blocks[c.Block.Number]; ok {
+		return fmt.Errorf("duplicate block #%d", c.Block.Number)
+	}
+	for _, tokenTx := range c.TokenTxs {
+		if _, ok := s.state.TokenTxs[tokenTx.TxHash]; ok {
+			return fmt.Errorf("duplicate token tx %s", tokenTx.TxHash.ToString())
+		}
+	}
+	for _, transferTokenTx := range c.TransferTokenTxs {
+		if _, ok := s.state.TransferTokenTxs[transferTokenTx.TxHash]; ok {
+			return fmt.Errorf("duplicate transfer token tx %s", transferTokenTx.TxHash.ToString())
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) applyProcess(c *models.BlockChanges) {
+	block := *c.Block
+	s.state.Blocks[block.Number] = &block
+	undoRecord := *c.UndoRecord
+	s.state.UndoRecords[block.Number] = &undoRecord
+	if c.PrunedBlockNumber >= 0 {
+		delete(s.state.Blocks, c.PrunedBlockNumber)
+		for blockNumber := range s.state.UndoRecords {
+			if blockNumber <= c.PrunedBlockNumber {
+				delete(s.state.UndoRecords, blockNumber)
+			}
+		}
+	}
+
+	for _, tokenTx := range c.TokenTxs {
+		t := *tokenTx
+		s.state.TokenTxs[t.TxHash] = &t
+		s.state.TokenTxsByBlock[t.BlockNumber] = append(s.state.TokenTxsByBlock[t.BlockNumber], t.TxHash)
+	}
+	for _, transferTokenTx := range c.TransferTokenTxs {
+		t := *transferTokenTx
+		s.state.TransferTokenTxs[t.TxHash] = &t
+		s.state.TransferTokenTxsByBlock[t.BlockNumber] = append(s.state.TransferTokenTxsByBlock[t.BlockNumber], t.TxHash)
+	}
+	for _, tokenRelatedTx := range c.TokenRelatedTxs {
+		t := *tokenRelatedTx
+		s.state.TokenRelatedTxs[TokenRelatedTxKey{t.TokenTxHash, t.TxHash}] = &t
+	}
+	for _, balanceChange := range c.BalanceChanges {
+		t := *balanceChange
+		key := TokenHolderKey{t.TokenTxHash, t.Address}
+		s.state.BalanceChanges[key] = append(s.state.BalanceChanges[key], &t)
+	}
+	if c.StateCommitment != nil {
+		t := *c.StateCommitment
+		s.state.StateCommitments = append(s.state.StateCommitments, &t)
+	}
+	s.applyTokenHolders(c)
+	s.applyTokenStats(c)
+	s.applyCheckpoint(c)
+}
+
+func (s *MemoryStore) applyRevert(c *models.BlockChanges) {
+	delete(s.state.Blocks, c.Block.Number)
+	delete(s.state.UndoRecords, c.Block.Number)
+
+	for _, tokenTx := range c.TokenTxs {
+		delete(s.state.TokenTxs, tokenTx.TxHash)
+	}
+	delete(s.state.TokenTxsByBlock, c.Block.Number)
+	for _, transferTokenTx := range c.TransferTokenTxs {
+		delete(s.state.TransferTokenTxs, transferTokenTx.TxHash)
+	}
+	delete(s.state.TransferTokenTxsByBlock, c.Block.Number)
+	if n := len(s.state.StateCommitments); n > 0 && s.state.StateCommitments[n-1].BlockNumber == c.Block.Number {
+		s.state.StateCommitments = s.state.StateCommitments[:n-1]
+	}
+	for _, tokenRelatedTx := range c.TokenRelatedTxs {
+		delete(s.state.TokenRelatedTxs, TokenRelatedTxKey{tokenRelatedTx.TokenTxHash, tokenRelatedTx.TxHash})
+	}
+	// Only the holders restored by the revert have entries in the block
+	for _, tokenHolders := range [][]*models.TokenHolder{c.TokenHolders, c.RemovedTokenHolders} {
+		for _, tokenHolder := range tokenHolders {
+			key := TokenHolderKey{tokenHolder.TokenTxHash, tokenHolder.Address}
+			ledger := s.state.BalanceChanges[key]
+			i := len(ledger)
+			for i > 0 && ledger[i-1].BlockNumber == c.Block.Number {
+				i--
+			}
+			if i == 0 {
+				delete(s.state.BalanceChanges, key)
+			} else if i < len(ledger) {
+				s.state.BalanceChanges[key] = ledger[:i]
+			}
+		}
+	}
+	s.applyTokenHolders(c)
+	s.applyTokenStats(c)
+	s.applyCheckpoint(c)
+}
+
+func (s *MemoryStore) applyTokenHolders(c *models.BlockChanges) {
+	for _, tokenHolder := range c.TokenHolders {
+		t := *tokenHolder
+		s.state.TokenHolders[TokenHolderKey{t.TokenTxHash, t.Address}] = &t
+	}
+	for _, tokenHolder := range c.RemovedTokenHolders {
+		delete(s.state.TokenHolders, TokenHolderKey{tokenHolder.TokenTxHash, tokenHolder.Address})
+	}
+}
+
+func (s *MemoryStore) applyTokenStats(c *models.BlockChanges) {
+	for _, tokenStats := range c.TokenStats {
+		t := *tokenStats
+		s.state.TokenStats[t.TokenTxHash] = &t
+	}
+	for _, tokenStats := range c.RemovedTokenStats {
+		delete(s.state.TokenStats, tokenStats.TokenTxHash)
+	}
+}
+
+func (s *MemoryStore) applyCheckpoint(c *models.BlockChanges) {
+	checkpoint := *c.Checkpoint
+	s.state.Checkpoint = &checkpoint
+}
@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+// The migrations backfilling what older versions didn't track must yield what
+// processing the blocks tracks.
+
+func TestBackfillTokenHolderBlockNumbers(t *testing.T) {
+	s := newGeneratedStore(t, 3, 200)
+	transferTokenTxs := tokenTransferTokenTxs(t, s)
+
+	blockNumbers := make(map[TokenHolderKey]int64)
+	for _, record := range testutil.Dump(t, s, db.StateTokenTxs) {
+		tokenTx := record.(*models.TokenTx)
+		balanceChanges, err := db.BackfillTokenBalanceChanges(tokenTx, transferTokenTxs[tokenTx.TxHash])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for address, blockNumber := range db.LastChangeBlockNumbers(balanceChanges) {
+			blockNumbers[TokenHolderKey{tokenTx.TxHash, address}] = blockNumber
+		}
+	}
+
+	tokenHolders := testutil.Dump(t, s, db.StateTokenHolders)
+	if len(tokenHolders) == 0 {
+		t.Fatal("no token holders")
+	}
+	for _, record := range tokenHolders {
+		tokenHolder := record.(*models.TokenHolder)
+		blockNumber, ok := blockNumbers[TokenHolderKey{tokenHolder.TokenTxHash, tokenHolder.Address}]
+		if !ok || blockNumber != tokenHolder.BlockNumber {
+			t.Errorf("holder %s of %s last changed in block #%d, backfilled #%d",
+				tokenHolder.Address.ToString(), tokenHolder.TokenTxHash.ToString(),
+				tokenHolder.BlockNumber, blockNumber)
+		}
+	}
+}
+
+func TestComputeTokenStats(t *testing.T) {
+	s := newGeneratedStore(t, 5, 200)
+	stored := make(map[string]models.TokenStats)
+	for _, record := range testutil.Dump(t, s, db.StateTokenStats) {
+		tokenStats := record.(*models.TokenStats)
+		stored[tokenStats.TokenTxHash.ToString()] = *tokenStats
+	}
+
+	tokenStats, err := db.ComputeTokenStats(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokenStats) == 0 || len(tokenStats) != len(stored) {
+		t.Fatalf("computed the stats of %d tokens, %d stored", len(tokenStats), len(stored))
+	}
+	for _, computed := range tokenStats {
+		if want := stored[computed.TokenTxHash.ToString()]; *computed != want {
+			t.Errorf("computed stats %+v, stored %+v", *computed, want)
+		}
+	}
+}
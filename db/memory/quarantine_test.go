@@ -0,0 +1,176 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// processFailing processes b, which must fail with a db.ProcessingError
+// leaving the state unchanged.
+func processFailing(t *testing.T, s *MemoryStore, b *generated.Block) *models.ProcessingFailure {
+	t.Helper()
+	before := testutil.Dump(t, s, db.StateCheckpoint)[0].(*models.Checkpoint)
+	err := s.ProcessBlock(b)
+	var processingErr *db.ProcessingError
+	if !errors.As(err, &processingErr) {
+		t.Fatalf("process block #%d: %v, want a processing error", b.Header.BlockNumber, err)
+	}
+	after := testutil.Dump(t, s, db.StateCheckpoint)[0].(*models.Checkpoint)
+	if after.BlockNumber != before.BlockNumber || after.BlockHash != before.BlockHash {
+		t.Fatalf("checkpoint moved to #%d by failing block", after.BlockNumber)
+	}
+
+	f := processingErr.Failure
+	if f.BlockNumber != int64(b.Header.BlockNumber) || f.BlockHash != misc.ToSizedHash(b.Header.HashHeader) ||
+		f.Error != err.Error() {
+		t.Fatalf("failure %+v of block #%d", f, b.Header.BlockNumber)
+	}
+	decoded := &generated.Block{}
+	if err := proto.Unmarshal(f.Block, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, b) {
+		t.Fatal("failed block not recorded as received")
+	}
+	return f
+}
+
+func TestProcessingErrorOfOverspendingTransfer(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice, []common.Address{bob}, []uint64{300}))
+	testutil.Index(t, s, node)
+
+	// The first transfer of the block is valid, the second spends more than
+	// bob holds
+	b := node.Append(
+		fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, alice, []common.Address{bob}, []uint64{100}),
+		fakenode.NewTransferTokenTx("transfer-3", tokenTxHash, bob, []common.Address{carol}, []uint64{500}))
+	f := processFailing(t, s, b)
+	if f.TxHash != fakenode.NewTxHash("transfer-3") || f.TokenTxHash != tokenTxHash {
+		t.Fatalf("failure of tx %s of token %s", f.TxHash.ToString(), f.TokenTxHash.ToString())
+	}
+	// The holders as they were before the failing transfer, after the
+	// valid one
+	states := make(map[common.Address]common.Amount)
+	for _, tokenHolder := range f.TokenHolders {
+		states[tokenHolder.Address] = tokenHolder.Amount
+	}
+	if len(states) != 2 || states[bob] != 400 || states[carol] != 0 {
+		t.Fatalf("holder states %v, want bob with 400 and carol with none", states)
+	}
+
+	testutil.AssertBalance(t, s, tokenTxHash, alice, 700)
+	testutil.AssertBalance(t, s, tokenTxHash, bob, 300)
+	testutil.AssertBalance(t, s, tokenTxHash, carol, 0)
+	testutil.AssertSupply(t, s, tokenTxHash, 1000, 2)
+	if _, err := s.GetTransferTokenTx(fakenode.NewTxHash("transfer-2")); err != db.ErrNotFound {
+		t.Fatalf("transfer of failing block stored: %v", err)
+	}
+}
+
+func TestProcessingErrorOfSenderWithoutTokens(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	testutil.Index(t, s, node)
+
+	b := node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, carol, []common.Address{bob}, []uint64{1}))
+	f := processFailing(t, s, b)
+	if f.TxHash != fakenode.NewTxHash("transfer") || f.TokenTxHash != tokenTxHash || len(f.TokenHolders) != 0 {
+		t.Fatalf("failure %+v, want the transfer without holder states", f)
+	}
+}
+
+func TestRecordProcessingFailure(t *testing.T) {
+	s := newTestStore(t)
+	failure := func(blockNumber int64, seed string) *models.ProcessingFailure {
+		return &models.ProcessingFailure{BlockNumber: blockNumber, BlockHash: fakenode.NewTxHash(seed),
+			Error: seed}
+	}
+
+	first, err := s.RecordProcessingFailure(failure(5, "block 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := s.RecordProcessingFailure(failure(5, "block 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Attempts != 2 || !again.FirstFailedAt.Equal(first.FirstFailedAt) ||
+		again.LastFailedAt.Before(first.LastFailedAt) {
+		t.Fatalf("second attempt recorded as %+v after %+v", again, first)
+	}
+	if _, err := s.RecordProcessingFailure(failure(3, "block 3")); err != nil {
+		t.Fatal(err)
+	}
+
+	failures, err := s.GetProcessingFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 || failures[0].BlockNumber != 3 || failures[1].BlockNumber != 5 {
+		t.Fatalf("failures %+v, want those of blocks #3 and #5", failures)
+	}
+
+	// A failure of another block at the same height replaces the first
+	replacing, err := s.RecordProcessingFailure(failure(5, "fork block 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacing.Attempts != 1 {
+		t.Fatalf("failure of the replacing block has %d attempts, want 1", replacing.Attempts)
+	}
+	replacing, err = s.RecordProcessingFailure(failure(5, "fork block 5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacing.Attempts != 2 {
+		t.Fatalf("failure of the replacing block has %d attempts, want 2", replacing.Attempts)
+	}
+	f, err := s.GetProcessingFailure(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BlockHash != fakenode.NewTxHash("fork block 5") {
+		t.Fatalf("failure of block %s, want the replacing block", f.BlockHash.ToString())
+	}
+	if failures, err := s.GetProcessingFailures(); err != nil || len(failures) != 2 {
+		t.Fatalf("%d unresolved failures (%v), want 2", len(failures), err)
+	}
+
+	if err := s.ResolveProcessingFailure(5, models.ProcessingFailureResolutionRetried); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetProcessingFailure(5); err != db.ErrNotFound {
+		t.Fatalf("resolved failure still unresolved: %v", err)
+	}
+	if err := s.ResolveProcessingFailure(5, models.ProcessingFailureResolutionRetried); err != db.ErrNotFound {
+		t.Fatalf("resolved a failure twice: %v", err)
+	}
+	// The block may fail again once resolved
+	if f, err := s.RecordProcessingFailure(failure(5, "fork block 5")); err != nil || f.Attempts != 1 {
+		t.Fatalf("failure after resolution recorded as %+v (%v), want a first attempt", f, err)
+	}
+
+	resolutions := make(map[string]int)
+	for _, f := range s.state.ProcessingFailures {
+		resolutions[f.Resolution]++
+	}
+	if resolutions[models.ProcessingFailureResolutionReplaced] != 1 ||
+		resolutions[models.ProcessingFailureResolutionRetried] != 1 || resolutions[""] != 2 {
+		t.Fatalf("failures resolved as %v", resolutions)
+	}
+}
@@ -0,0 +1,60 @@
+package memory
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+)
+
+func (s *MemoryStore) GetTokenHoldersByAddress(address common.Address) ([]*models.TokenHolder, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var tokenHolders []*models.TokenHolder
+	for key, stored := range s.state.TokenHolders {
+		if key.Address != address {
+			continue
+		}
+		h := *stored
+		tokenHolders = append(tokenHolders, &h)
+	}
+	sort.Slice(tokenHolders, func(i, j int) bool {
+		return bytes.Compare(tokenHolders[i].TokenTxHash[:], tokenHolders[j].TokenTxHash[:]) < 0
+	})
+	return tokenHolders, nil
+}
+
+// SampleTokenHolderAddresses returns up to size distinct addresses picked at
+// random among those holding a token.
+func (s *MemoryStore) SampleTokenHolderAddresses(size int) ([]common.Address, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	seen := make(map[common.Address]bool)
+	var addresses []common.Address
+	for key, tokenHolder := range s.state.TokenHolders {
+		if tokenHolder.Amount != 0 && !seen[key.Address] {
+			seen[key.Address] = true
+			addresses = append(addresses, key.Address)
+		}
+	}
+	rand.Shuffle(len(addresses), func(i, j int) {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	})
+	if len(addresses) > size {
+		addresses = addresses[:size]
+	}
+	return addresses, nil
+}
+
+func (s *MemoryStore) InsertReconciliationReport(r *models.ReconciliationReport) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored := *r
+	s.state.ReconciliationReports = append(s.state.ReconciliationReports, &stored)
+	return nil
+}
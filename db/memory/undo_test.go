@@ -0,0 +1,180 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+func TestUndoRecordBeforeImages(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	b := node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+	testutil.Index(t, s, node)
+
+	undoRecord, err := s.GetUndoRecord(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockHash := misc.ToSizedHash(b.Header.HashHeader); undoRecord.BlockHash != blockHash {
+		t.Fatalf("undo record of block %s, want %s", undoRecord.BlockHash.ToString(), blockHash.ToString())
+	}
+	images := make(map[common.Address]*models.TokenHolder)
+	for _, image := range undoRecord.TokenHolders {
+		if image.TokenTxHash != tokenTxHash {
+			t.Fatalf("before image of token %s", image.TokenTxHash.ToString())
+		}
+		images[image.Address] = image.TokenHolder
+	}
+	if len(images) != 2 {
+		t.Fatalf("%d before images, want 2", len(images))
+	}
+	if image := images[alice]; image == nil || image.Amount != 1000 || image.BlockNumber != 1 {
+		t.Fatalf("before image of alice %+v, want 1000 changed in block #1", image)
+	}
+	if image, ok := images[bob]; !ok || image != nil {
+		t.Fatalf("before image of bob %+v, want none as bob held nothing", image)
+	}
+}
+
+func TestUndoRecordsPruned(t *testing.T) {
+	c := config.DefaultConfig()
+	c.ReOrgLimit = 2
+	s := NewMemoryStore(c)
+	node := fakenode.NewNode()
+	for i := 0; i < 5; i++ {
+		node.Append()
+	}
+	testutil.Index(t, s, node)
+
+	// Only the blocks which may still be reverted keep their undo record
+	for number := int64(1); number <= 5; number++ {
+		_, err := s.GetUndoRecord(number)
+		if number > 5-int64(c.ReOrgLimit) {
+			if err != nil {
+				t.Fatalf("undo record of block #%d: %v", number, err)
+			}
+		} else if err != db.ErrNotFound {
+			t.Fatalf("undo record of block #%d not pruned: %v", number, err)
+		}
+	}
+}
+
+func TestRevertRestoresLastChangedBlock(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice,
+		[]common.Address{bob}, []uint64{300}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, bob,
+		[]common.Address{carol}, []uint64{100}))
+	testutil.Index(t, s, node)
+
+	if err := s.RevertLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*models.TokenHolder{
+		{TokenTxHash: tokenTxHash, Address: alice, Amount: 700, BlockNumber: 2},
+		{TokenTxHash: tokenTxHash, Address: bob, Amount: 300, BlockNumber: 2},
+	} {
+		tokenHolder, err := s.GetTokenHolder(tokenTxHash, want.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenHolder.Amount != want.Amount || tokenHolder.BlockNumber != want.BlockNumber {
+			t.Fatalf("holder %s has %d changed in block #%d, want %d changed in block #%d",
+				want.Address.ToString(), tokenHolder.Amount, tokenHolder.BlockNumber,
+				want.Amount, want.BlockNumber)
+		}
+	}
+	testutil.AssertBalance(t, s, tokenTxHash, carol, 0)
+	testutil.AssertSupply(t, s, tokenTxHash, 1000, 2)
+	if _, err := s.GetUndoRecord(3); err != db.ErrNotFound {
+		t.Fatalf("undo record of the reverted block kept: %v", err)
+	}
+}
+
+func TestRevertWithoutMatchingUndoRecord(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append(fakenode.NewTransferTokenTx("transfer", tokenTxHash, alice,
+		[]common.Address{bob, carol}, []uint64{300, 200}))
+	testutil.Index(t, s, node)
+
+	// An undo record of another block at the same height, such as one left
+	// by a fork, is ignored and the transfers are reverted one by one
+	stale := &models.UndoRecord{
+		BlockNumber: 2,
+		BlockHash:   fakenode.NewTxHash("other block"),
+		TokenHolders: []*models.TokenHolderBeforeImage{
+			{TokenTxHash: tokenTxHash, Address: alice,
+				TokenHolder: models.NewTokenHolder(tokenTxHash, alice, 1)},
+		},
+	}
+	if err := s.RestoreState(db.StateUndoRecords, []interface{}{stale}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevertLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertBalance(t, s, tokenTxHash, alice, 1000)
+	testutil.AssertBalance(t, s, tokenTxHash, bob, 0)
+	testutil.AssertBalance(t, s, tokenTxHash, carol, 0)
+	testutil.AssertSupply(t, s, tokenTxHash, 1000, 1)
+}
+
+// TestRevertTransfersInBlockOrder reverts, one by one, transfers of a block
+// restored out of order, the second spending what the first received.
+func TestRevertTransfersInBlockOrder(t *testing.T) {
+	s := newTestStore(t)
+	node := fakenode.NewNode()
+	tokenTxHash := fakenode.NewTxHash("token")
+	node.Append(fakenode.NewTokenTx("token", "TKN", 0, alice, []common.Address{alice}, []uint64{1000}))
+	node.Append(
+		fakenode.NewTransferTokenTx("transfer-1", tokenTxHash, alice, []common.Address{bob}, []uint64{300}),
+		fakenode.NewTransferTokenTx("transfer-2", tokenTxHash, bob, []common.Address{carol}, []uint64{300}))
+	testutil.Index(t, s, node)
+
+	restored := newTestStore(t)
+	for _, collection := range db.StateCollections {
+		if collection == db.StateUndoRecords {
+			continue
+		}
+		records := testutil.Dump(t, s, collection)
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+		if err := restored.RestoreState(collection, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transferTokenTxs, err := restored.GetTransferTokenTxsByBlockNumber(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transferTokenTxs) != 2 || transferTokenTxs[0].TxHash != fakenode.NewTxHash("transfer-1") ||
+		transferTokenTxs[1].TxHash != fakenode.NewTxHash("transfer-2") {
+		t.Fatalf("transfers of block #2 %+v, want transfer-1 then transfer-2", transferTokenTxs)
+	}
+
+	if err := restored.RevertLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	testutil.AssertBalance(t, restored, tokenTxHash, alice, 1000)
+	testutil.AssertBalance(t, restored, tokenTxHash, bob, 0)
+	testutil.AssertBalance(t, restored, tokenTxHash, carol, 0)
+	testutil.AssertSupply(t, restored, tokenTxHash, 1000, 1)
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this indexer supports")
+
+// Migration upgrades the database from schema version Version-1 to Version.
+// Migrations must be idempotent, as a migration interrupted before the schema
+// version is updated is run again.
+type Migration struct {
+	Version     uint64
+	Description string
+	Up          func(m *MongoDBProcessor) error
+}
+
+// migrations are applied in order. New migrations are only ever appended.
+var migrations = []*Migration{
+	{1, "Create indexes missing on collections created by older versions", (*MongoDBProcessor).ReconcileIndexes},
+	{2, "Convert int64 token amounts to Decimal128", (*MongoDBProcessor).ConvertLegacyAmounts},
+	{3, "Backfill the block number of the last change of token holders", (*MongoDBProcessor).backfillTokenHolderBlockNumbers},
+	{4, "Backfill the balance ledger from indexed txs, without block timestamps", (*MongoDBProcessor).backfillBalanceChanges},
+	{5, "Backfill the supply and holder count of tokens", (*MongoDBProcessor).backfillTokenStats},
+	{6, "Backfill the state commitments from the balance ledger", (*MongoDBProcessor).backfillStateCommitments},
+}
+
+// LatestSchemaVersion is the schema version this indexer reads and writes.
+func LatestSchemaVersion() uint64 {
+	return migrations[len(migrations)-1].Version
+}
+
+// GetSchemaVersion returns the schema version of the database, which is 0 for
+// databases written before schema versioning was introduced.
+func (m *MongoDBProcessor) GetSchemaVersion() (uint64, error) {
+	result := m.schemaVersionCollection.FindOne(m.ctx, bson.M{"_id": models.SchemaVersionID})
+	if result.Err() != nil {
+		if errors.Is(notFound(result.Err()), ErrNotFound) {
+			return 0, nil
+		}
+		return 0, result.Err()
+	}
+	s := &models.SchemaVersion{}
+	if err := result.Decode(s); err != nil {
+		return 0, err
+	}
+	return s.Version, nil
+}
+
+func (m *MongoDBProcessor) setSchemaVersion(version uint64) error {
+	s := models.NewSchemaVersion(version)
+	_, err := m.schemaVersionCollection.ReplaceOne(m.ctx,
+		bson.M{"_id": s.ID},
+		s,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// PendingMigrations returns the migrations not yet applied to the database.
+func (m *MongoDBProcessor) PendingMigrations() ([]*Migration, error) {
+	version, err := m.GetSchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("%w: database schema version %d, supported schema version %d",
+			ErrSchemaTooNew, version, LatestSchemaVersion())
+	}
+	var pending []*Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, recording the schema
+// version after each one. With dryRun the pending migrations are only
+// returned.
+func (m *MongoDBProcessor) Migrate(dryRun bool) ([]*Migration, error) {
+	pending, err := m.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return pending, nil
+	}
+	for _, migration := range pending {
+		m.log.Info("[Migrate] Applying migration",
+			"Version", migration.Version,
+			"Description", migration.Description)
+		if err := migration.Up(m); err != nil {
+			m.log.Error("[Migrate] Migration failed",
+				"Version", migration.Version,
+				"Error", err.Error())
+			return nil, err
+		}
+		if err := m.setSchemaVersion(migration.Version); err != nil {
+			m.log.Error("[Migrate] Failed to update schema version",
+				"Version", migration.Version,
+				"Error", err.Error())
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// backfillTokenHolderBlockNumbers sets the block number of the last change of
+// token holders written before it was tracked, from the replay of the ledger
+// of their token.
+func (m *MongoDBProcessor) backfillTokenHolderBlockNumbers() error {
+	cursor, err := m.tokenTxsCollection.Find(m.ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	for cursor.Next(m.ctx) {
+		tokenTx := &models.TokenTx{}
+		if err := cursor.Decode(tokenTx); err != nil {
+			return err
+		}
+		if err := m.backfillHolderBlockNumbersOfToken(tokenTx); err != nil {
+			m.log.Error("[backfillTokenHolderBlockNumbers] Failed to backfill token",
+				"Token", tokenTx.TxHash.ToString(),
+				"Error", err.Error())
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *MongoDBProcessor) backfillHolderBlockNumbersOfToken(tokenTx *models.TokenTx) error {
+	filter := bson.M{
+		"tokenTxHash": tokenTx.TxHash,
+		"blockNumber": bson.M{"$exists": false},
+	}
+	var tokenHolders []*models.TokenHolder
+	cursor, err := m.tokenHoldersCollection.Find(m.ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(m.ctx, &tokenHolders); err != nil {
+		return err
+	}
+	if len(tokenHolders) == 0 {
+		return nil
+	}
+
+	transferTokenTxs, err := m.getTokenTransferTokenTxs(tokenTx)
+	if err != nil {
+		return err
+	}
+	balanceChanges, err := BackfillTokenBalanceChanges(tokenTx, transferTokenTxs)
+	if err != nil {
+		return err
+	}
+	blockNumbers := LastChangeBlockNumbers(balanceChanges)
+
+	var operations []mongo.WriteModel
+	for _, tokenHolder := range tokenHolders {
+		blockNumber, ok := blockNumbers[tokenHolder.Address]
+		if !ok {
+			// Not found in the txs, as for holders of a partially indexed
+			// token, so the token creation is the best known
+			blockNumber = tokenTx.BlockNumber
+		}
+		operations = append(operations, mongo.NewUpdateOneModel().
+			SetFilter(tokenHolderFilter(tokenHolder)).
+			SetUpdate(bson.M{"$set": bson.M{"blockNumber": blockNumber}}))
+		if len(operations) == 1000 {
+			if _, err := m.tokenHoldersCollection.BulkWrite(m.ctx, operations); err != nil {
+				return err
+			}
+			operations = operations[:0]
+		}
+	}
+	if len(operations) == 0 {
+		return nil
+	}
+	_, err = m.tokenHoldersCollection.BulkWrite(m.ctx, operations)
+	return err
+}
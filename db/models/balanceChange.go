@@ -0,0 +1,99 @@
+package models
+
+import (
+	"math/big"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+// BackfilledTxIndex is the TxIndex of balance changes backfilled from the txs
+// indexed before the ledger existed, which aggregate all the txs of a block.
+const BackfilledTxIndex = -1
+
+// BalanceChange is an entry of the append-only balance ledger. It records the
+// balance of a token holder after a tx changed it. Entries are only removed
+// when the block containing them is reverted.
+type BalanceChange struct {
+	TokenTxHash common.Hash    `json:"tokenTxHash" bson:"tokenTxHash"`
+	Address     common.Address `json:"address" bson:"address"`
+	BlockNumber int64          `json:"blockNumber" bson:"blockNumber"`
+	TxIndex     int            `json:"txIndex" bson:"txIndex"` // Index of the tx in the block
+	TxHash      common.Hash    `json:"txHash" bson:"txHash"`
+	Received    common.Amount  `json:"received" bson:"received"`
+	Sent        common.Amount  `json:"sent" bson:"sent"`
+	Balance     common.Amount  `json:"balance" bson:"balance"`
+	Timestamp   uint64         `json:"timestamp" bson:"timestamp"` // Block timestamp, 0 if unknown
+}
+
+// Delta is the signed change of the balance, Received - Sent.
+func (b *BalanceChange) Delta() *big.Int {
+	delta := new(big.Int).SetUint64(uint64(b.Received))
+	return delta.Sub(delta, new(big.Int).SetUint64(uint64(b.Sent)))
+}
+
+// Before reports whether b precedes o in the ledger of a token holder.
+func (b *BalanceChange) Before(o *BalanceChange) bool {
+	if b.BlockNumber != o.BlockNumber {
+		return b.BlockNumber < o.BlockNumber
+	}
+	return b.TxIndex < o.TxIndex
+}
+
+// GetBalanceChanges returns the balance changes of the initial holders of the
+// token, whose balances are read from tokenHolders. An address listed several
+// times in the initial balances has a single change, receiving their sum.
+func (t *TokenTx) GetBalanceChanges(txIndex int, timestamp uint64, tokenHolders TokenHolders) []*BalanceChange {
+	var balanceChanges []*BalanceChange
+	seen := make(map[common.Address]bool)
+	for _, address := range t.Addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		tokenHolder := tokenHolders[address]
+		balanceChanges = append(balanceChanges, &BalanceChange{
+			TokenTxHash: t.TxHash,
+			Address:     address,
+			BlockNumber: t.BlockNumber,
+			TxIndex:     txIndex,
+			TxHash:      t.TxHash,
+			Received:    tokenHolder.Amount,
+			Balance:     tokenHolder.Amount,
+			Timestamp:   timestamp,
+		})
+	}
+	return balanceChanges
+}
+
+// GetBalanceChanges returns the balance changes made by the transfer, once
+// applied to tokenHolders.
+func (t *TransferTokenTx) GetBalanceChanges(txIndex int, timestamp uint64, tokenHolders TokenHolders) []*BalanceChange {
+	byAddress := make(map[common.Address]*BalanceChange)
+	var balanceChanges []*BalanceChange
+	get := func(address common.Address) *BalanceChange {
+		balanceChange, ok := byAddress[address]
+		if !ok {
+			balanceChange = &BalanceChange{
+				TokenTxHash: t.TokenTxHash,
+				Address:     address,
+				BlockNumber: t.BlockNumber,
+				TxIndex:     txIndex,
+				TxHash:      t.TxHash,
+				Balance:     tokenHolders[address].Amount,
+				Timestamp:   timestamp,
+			}
+			byAddress[address] = balanceChange
+			balanceChanges = append(balanceChanges, balanceChange)
+		}
+		return balanceChange
+	}
+
+	// Once the transfer has been applied, neither sum can overflow as each
+	// is bounded by the balances of the sender and recipients
+	from := get(t.From)
+	for i, address := range t.Addresses {
+		from.Sent += t.Amounts[i]
+		get(address).Received += t.Amounts[i]
+	}
+	return balanceChanges
+}
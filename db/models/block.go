@@ -7,14 +7,18 @@ import (
 )
 
 type Block struct {
-	Number int64       `json:"number" bson:"number"`
-	Hash   common.Hash `json:"hash" bson:"hash"`
+	Number    int64       `json:"number" bson:"number"`
+	Hash      common.Hash `json:"hash" bson:"hash"`
+	Timestamp uint64      `json:"timestamp" bson:"timestamp"`
+	// StateHash is the hash of the state commitment as of this block
+	StateHash common.Hash `json:"stateHash" bson:"stateHash"`
 }
 
 func NewBlockFromPBData(pbBlock *generated.Block) *Block {
 	return &Block{
-		Number: int64(pbBlock.Header.BlockNumber),
-		Hash:   misc.ToSizedHash(pbBlock.Header.HashHeader),
+		Number:    int64(pbBlock.Header.BlockNumber),
+		Hash:      misc.ToSizedHash(pbBlock.Header.HashHeader),
+		Timestamp: pbBlock.Header.TimestampSeconds,
 	}
 }
 
@@ -0,0 +1,43 @@
+package models
+
+// BlockChanges are all the records written when a block is processed or
+// reverted. Processing a block inserts Block, its txs and UndoRecord, while
+// reverting a block deletes them. In both cases TokenHolders are upserted and
+// RemovedTokenHolders deleted. BalanceChanges are appended to the ledger when
+// processing, while reverting removes the ledger entries of Block. TokenStats
+// are upserted and RemovedTokenStats, of tokens created by a reverted block,
+// deleted. StateCommitment is inserted when processing, and the commitment of
+// Block deleted when reverting.
+type BlockChanges struct {
+	// Operation is either CheckpointOperationProcessBlock or
+	// CheckpointOperationRevertLastBlock
+	Operation string `json:"operation" bson:"operation"`
+
+	Block *Block `json:"block" bson:"block"`
+	// PrunedBlockNumber is the block falling out of the reorg limit when
+	// processing Block, or -1 if none. Its undo record is pruned as well.
+	PrunedBlockNumber int64 `json:"prunedBlockNumber" bson:"prunedBlockNumber"`
+
+	TokenTxs         []*TokenTx         `json:"tokenTxs" bson:"tokenTxs"`
+	TransferTokenTxs []*TransferTokenTx `json:"transferTokenTxs" bson:"transferTokenTxs"`
+	TokenRelatedTxs  []*TokenRelatedTx  `json:"tokenRelatedTxs" bson:"tokenRelatedTxs"`
+
+	TokenHolders        []*TokenHolder `json:"tokenHolders" bson:"tokenHolders"`
+	RemovedTokenHolders []*TokenHolder `json:"removedTokenHolders" bson:"removedTokenHolders"`
+
+	BalanceChanges []*BalanceChange `json:"balanceChanges" bson:"balanceChanges"`
+
+	TokenStats        []*TokenStats `json:"tokenStats" bson:"tokenStats"`
+	RemovedTokenStats []*TokenStats `json:"removedTokenStats" bson:"removedTokenStats"`
+
+	// StateCommitment is nil if the block changes no balance
+	StateCommitment *StateCommitment `json:"stateCommitment" bson:"stateCommitment"`
+
+	UndoRecord *UndoRecord `json:"undoRecord" bson:"undoRecord"`
+
+	Checkpoint *Checkpoint `json:"checkpoint" bson:"checkpoint"`
+}
+
+func (c *BlockChanges) IsRevert() bool {
+	return c.Operation == CheckpointOperationRevertLastBlock
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+const (
+	// CheckpointID is the _id of the single checkpoint document
+	CheckpointID = "indexer"
+
+	CheckpointOperationProcessBlock    = "processBlock"
+	CheckpointOperationRevertLastBlock = "revertLastBlock"
+)
+
+// Checkpoint records the last block operation committed by the indexer. It is
+// written in the same transaction as the block operation itself.
+type Checkpoint struct {
+	ID          string      `json:"id" bson:"_id"`
+	BlockNumber int64       `json:"blockNumber" bson:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash" bson:"blockHash"`
+	Operation   string      `json:"operation" bson:"operation"`
+	UpdatedAt   time.Time   `json:"updatedAt" bson:"updatedAt"`
+}
+
+func NewCheckpoint(blockNumber int64, blockHash common.Hash, operation string) *Checkpoint {
+	return &Checkpoint{
+		ID:          CheckpointID,
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+		Operation:   operation,
+		UpdatedAt:   time.Now().UTC(),
+	}
+}
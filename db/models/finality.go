@@ -0,0 +1,23 @@
+package models
+
+// Finality describes how deep a record is buried below the current indexed tip.
+// It is computed at query time and never persisted.
+type Finality struct {
+	Confirmations uint64 `json:"confirmations"`
+	Final         bool   `json:"final"`
+}
+
+// Confirmations returns the number of indexed blocks from blockNumber up to and
+// including tip. A record in the tip block has 1 confirmation, while a record in
+// a block above the tip (e.g. already reverted) has 0.
+func Confirmations(blockNumber int64, tip int64) uint64 {
+	if blockNumber > tip {
+		return 0
+	}
+	return uint64(tip-blockNumber) + 1
+}
+
+func (f *Finality) SetFinality(blockNumber int64, tip int64, finalityThreshold uint64) {
+	f.Confirmations = Confirmations(blockNumber, tip)
+	f.Final = f.Confirmations >= finalityThreshold
+}
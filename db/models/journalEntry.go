@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// JournalEntry records the changes of a block operation before any of them is
+// written, when writing without transactions. It is removed once all changes
+// are written, so an entry left behind marks a half applied block.
+type JournalEntry struct {
+	ID        string        `json:"id" bson:"_id"`
+	Changes   *BlockChanges `json:"changes" bson:"changes"`
+	CreatedAt time.Time     `json:"createdAt" bson:"createdAt"`
+	// SchemaVersion is the schema version of the changes, 0 for entries
+	// written before it was recorded
+	SchemaVersion uint64 `json:"schemaVersion" bson:"schemaVersion"`
+}
+
+func NewJournalEntry(changes *BlockChanges, schemaVersion uint64) *JournalEntry {
+	return &JournalEntry{
+		ID:            changes.Operation + "-" + changes.Block.Hash.ToString(),
+		Changes:       changes,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: schemaVersion,
+	}
+}
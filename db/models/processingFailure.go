@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+// Resolutions of a processing failure
+const (
+	ProcessingFailureResolutionRetried      = "retried"
+	ProcessingFailureResolutionRefetched    = "refetched"
+	ProcessingFailureResolutionRebuiltToken = "rebuiltToken"
+	// The block was replaced by another block at the same height
+	ProcessingFailureResolutionReplaced = "replaced"
+)
+
+// ProcessingFailure is a block which cannot be applied to the indexed state.
+// The block is quarantined, and indexing waits, until the failure is
+// resolved by an operator.
+type ProcessingFailure struct {
+	BlockNumber int64       `json:"blockNumber" bson:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash" bson:"blockHash"`
+	// Block is the protobuf encoded block, so that it can be retried as it
+	// was received
+	Block []byte `json:"block" bson:"block"`
+
+	// TxHash and TokenTxHash are those of the failing tx, if any
+	TxHash      common.Hash `json:"txHash" bson:"txHash"`
+	TokenTxHash common.Hash `json:"tokenTxHash" bson:"tokenTxHash"`
+	Error       string      `json:"error" bson:"error"`
+	// TokenHolders are the states of the holders involved in the failing tx,
+	// before it was applied
+	TokenHolders []*TokenHolder `json:"tokenHolders" bson:"tokenHolders"`
+
+	Attempts      int       `json:"attempts" bson:"attempts"`
+	FirstFailedAt time.Time `json:"firstFailedAt" bson:"firstFailedAt"`
+	LastFailedAt  time.Time `json:"lastFailedAt" bson:"lastFailedAt"`
+
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+	Resolution string     `json:"resolution,omitempty" bson:"resolution,omitempty"`
+}
+
+func (f *ProcessingFailure) IsResolved() bool {
+	return f.ResolvedAt != nil
+}
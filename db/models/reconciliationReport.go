@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+const (
+	ReconciliationStatusMatch    = "match"
+	ReconciliationStatusMismatch = "mismatch"
+	ReconciliationStatusSkipped  = "skipped"
+)
+
+// BalanceMismatch is a token balance of an address on which the node and the
+// indexer disagree.
+type BalanceMismatch struct {
+	TokenTxHash    common.Hash   `json:"tokenTxHash" bson:"tokenTxHash"`
+	NodeBalance    common.Amount `json:"nodeBalance" bson:"nodeBalance"`
+	IndexerBalance common.Amount `json:"indexerBalance" bson:"indexerBalance"`
+}
+
+// AddressReconciliation is the comparison of all token balances of an
+// address, as of BlockNumber.
+type AddressReconciliation struct {
+	Address     common.Address     `json:"address" bson:"address"`
+	BlockNumber int64              `json:"blockNumber" bson:"blockNumber"`
+	Status      string             `json:"status" bson:"status"`
+	Tokens      int                `json:"tokens" bson:"tokens"` // Number of token balances compared
+	Mismatches  []*BalanceMismatch `json:"mismatches,omitempty" bson:"mismatches,omitempty"`
+	Detail      string             `json:"detail,omitempty" bson:"detail,omitempty"` // Reason for skipping
+}
+
+// ReconciliationReport is the outcome of comparing the token balances of a
+// set of addresses between the node and the indexer.
+type ReconciliationReport struct {
+	StartedAt  time.Time                `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time                `json:"finishedAt" bson:"finishedAt"`
+	Sampled    bool                     `json:"sampled" bson:"sampled"` // Set if the addresses were sampled
+	Matched    int                      `json:"matched" bson:"matched"`
+	Mismatched int                      `json:"mismatched" bson:"mismatched"`
+	Skipped    int                      `json:"skipped" bson:"skipped"`
+	Addresses  []*AddressReconciliation `json:"addresses" bson:"addresses"`
+}
+
+func (r *ReconciliationReport) Add(a *AddressReconciliation) {
+	r.Addresses = append(r.Addresses, a)
+	switch a.Status {
+	case ReconciliationStatusMatch:
+		r.Matched++
+	case ReconciliationStatusMismatch:
+		r.Mismatched++
+	default:
+		r.Skipped++
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// SchemaVersionID is the _id of the single schema version document
+const SchemaVersionID = "schema_version"
+
+// SchemaVersion records the version of the last migration applied to the
+// database.
+type SchemaVersion struct {
+	ID        string    `json:"id" bson:"_id"`
+	Version   uint64    `json:"version" bson:"version"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+func NewSchemaVersion(version uint64) *SchemaVersion {
+	return &SchemaVersion{
+		ID:        SchemaVersionID,
+		Version:   version,
+		UpdatedAt: time.Now().UTC(),
+	}
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+// StateCommitment is the running hash of the token holder balances, as of a
+// block changing any of them. Blocks changing no balance keep the hash of the
+// previous commitment, so the state hash at any height is the hash of the
+// last commitment at or below it.
+//
+// Hash is the SHA-256 of PrevHash, the block number as a big endian uint64,
+// and for every token holder whose balance the block changed, ordered by
+// token tx hash then address, its token tx hash, address and balance after
+// the block as a big endian uint64. The first commitment chains to the zero
+// hash.
+type StateCommitment struct {
+	BlockNumber int64 `json:"blockNumber" bson:"blockNumber"`
+	// BlockHash is unset on commitments backfilled for pruned blocks
+	BlockHash common.Hash `json:"blockHash" bson:"blockHash"`
+	PrevHash  common.Hash `json:"prevHash" bson:"prevHash"`
+	Hash      common.Hash `json:"hash" bson:"hash"`
+}
+
+// NewStateCommitment returns the commitment of the balance changes of the
+// block blockNumber, which can be in any order, on top of prevHash.
+func NewStateCommitment(blockNumber int64, blockHash common.Hash, prevHash common.Hash,
+	balanceChanges []*BalanceChange) *StateCommitment {
+	type key struct {
+		tokenTxHash common.Hash
+		address     common.Address
+	}
+	last := make(map[key]*BalanceChange)
+	for _, balanceChange := range balanceChanges {
+		k := key{balanceChange.TokenTxHash, balanceChange.Address}
+		if l, ok := last[k]; !ok || l.Before(balanceChange) {
+			last[k] = balanceChange
+		}
+	}
+	keys := make([]key, 0, len(last))
+	for k := range last {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := bytes.Compare(keys[i].tokenTxHash[:], keys[j].tokenTxHash[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(keys[i].address[:], keys[j].address[:]) < 0
+	})
+
+	h := sha256.New()
+	h.Write(prevHash[:])
+	binary.Write(h, binary.BigEndian, uint64(blockNumber))
+	for _, k := range keys {
+		h.Write(k.tokenTxHash[:])
+		h.Write(k.address[:])
+		binary.Write(h, binary.BigEndian, uint64(last[k].Balance))
+	}
+
+	c := &StateCommitment{
+		BlockNumber: blockNumber,
+		BlockHash:   blockHash,
+		PrevHash:    prevHash,
+	}
+	copy(c.Hash[:], h.Sum(nil))
+	return c
+}
@@ -5,10 +5,13 @@ import "github.com/cyyber/qrl-token-indexer/common"
 type TokenHolder struct {
 	TokenTxHash common.Hash    `json:"tokenTxHash" bson:"tokenTxHash"`
 	Address     common.Address `json:"address" bson:"address"`
-	Amount      int64          `json:"amount" bson:"amount"`
+	Amount      common.Amount  `json:"amount" bson:"amount"`
+	BlockNumber int64          `json:"blockNumber" bson:"blockNumber"` // Block in which the amount was last changed
+
+	Finality `json:"finality" bson:"-"`
 }
 
-func NewTokenHolder(tokenTxHash common.Hash, address common.Address, amount int64) *TokenHolder {
+func NewTokenHolder(tokenTxHash common.Hash, address common.Address, amount common.Amount) *TokenHolder {
 	return &TokenHolder{
 		TokenTxHash: tokenTxHash,
 		Address:     address,
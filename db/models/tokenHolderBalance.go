@@ -0,0 +1,18 @@
+package models
+
+import "github.com/cyyber/qrl-token-indexer/common"
+
+// TokenHolderBalance is the balance of a token holder as of a given number of
+// confirmations, i.e. ignoring all changes made in the most recent blocks.
+type TokenHolderBalance struct {
+	TokenTxHash common.Hash    `json:"tokenTxHash"`
+	Address     common.Address `json:"address"`
+	Amount      common.Amount  `json:"amount"`
+	// AsOfBlockNumber is the highest block whose changes are included in Amount
+	AsOfBlockNumber int64 `json:"asOfBlockNumber"`
+
+	// Finality of the balance. Confirmations is a lower bound of the confirmations
+	// of the most recent change included in Amount, and Final is false whenever
+	// Amount includes changes from blocks below the finality threshold.
+	Finality `json:"finality"`
+}
@@ -1,8 +1,8 @@
 package models
 
 import (
-	"encoding/hex"
 	"fmt"
+
 	"github.com/cyyber/qrl-token-indexer/common"
 )
 
@@ -17,7 +17,8 @@ func (t TokenHolders) Apply(tx *TransferTokenTx) error {
 
 	for i, address := range tx.Addresses {
 		amount := tx.Amounts[i]
-		if uint64(fromTokenHolder.Amount) < uint64(amount) {
+		remaining, err := fromTokenHolder.Amount.Sub(amount)
+		if err != nil {
 			return fmt.Errorf("from address: %s "+
 				"txhash: %s "+
 				"doesn't have sufficient token: %s "+
@@ -25,9 +26,10 @@ func (t TokenHolders) Apply(tx *TransferTokenTx) error {
 				from.ToString(),
 				tx.TxHash.ToString(),
 				tx.TokenTxHash.ToString(),
-				uint64(fromTokenHolder.Amount), uint64(amount))
+				fromTokenHolder.Amount, amount)
 		}
-		fromTokenHolder.Amount -= amount
+		fromTokenHolder.Amount = remaining
+		fromTokenHolder.BlockNumber = tx.BlockNumber
 		tokenHolder, ok := t[address]
 		if !ok {
 			return fmt.Errorf("address: %s "+
@@ -37,7 +39,18 @@ func (t TokenHolders) Apply(tx *TransferTokenTx) error {
 				tx.TxHash.ToString(),
 				tx.TokenTxHash.ToString())
 		}
-		tokenHolder.Amount += amount
+		received, err := tokenHolder.Amount.Add(amount)
+		if err != nil {
+			return fmt.Errorf("address: %s "+
+				"txhash: %s "+
+				"token: %s balance %d overflows when receiving %d",
+				address.ToString(),
+				tx.TxHash.ToString(),
+				tx.TokenTxHash.ToString(),
+				tokenHolder.Amount, amount)
+		}
+		tokenHolder.Amount = received
+		tokenHolder.BlockNumber = tx.BlockNumber
 	}
 
 	return nil
@@ -48,7 +61,7 @@ func (t TokenHolders) Revert(tx *TransferTokenTx) error {
 	fromTokenHolder, ok := t[from]
 	if !ok {
 		return fmt.Errorf("from address: %s not found for TokenHolder",
-			hex.EncodeToString(from[:]))
+			from.ToString())
 	}
 
 	for i, address := range tx.Addresses {
@@ -63,7 +76,8 @@ func (t TokenHolders) Revert(tx *TransferTokenTx) error {
 				tx.TokenTxHash.ToString())
 		}
 
-		if uint64(tokenHolder.Amount) < uint64(amount) {
+		remaining, err := tokenHolder.Amount.Sub(amount)
+		if err != nil {
 			return fmt.Errorf("from address: %s "+
 				"txhash: %s "+
 				"doesn't have sufficient token: %s "+
@@ -71,11 +85,21 @@ func (t TokenHolders) Revert(tx *TransferTokenTx) error {
 				from.ToString(),
 				tx.TxHash.ToString(),
 				tx.TokenTxHash.ToString(),
-				uint64(tokenHolder.Amount), uint64(amount))
+				tokenHolder.Amount, amount)
+		}
+		returned, err := fromTokenHolder.Amount.Add(amount)
+		if err != nil {
+			return fmt.Errorf("from address: %s "+
+				"txhash: %s "+
+				"token: %s balance %d overflows when reverting %d",
+				from.ToString(),
+				tx.TxHash.ToString(),
+				tx.TokenTxHash.ToString(),
+				fromTokenHolder.Amount, amount)
 		}
 
-		tokenHolder.Amount -= amount
-		fromTokenHolder.Amount += amount
+		tokenHolder.Amount = remaining
+		fromTokenHolder.Amount = returned
 	}
 
 	return nil
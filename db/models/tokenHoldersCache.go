@@ -20,6 +20,11 @@ func (t TokenHoldersCache) Put(tokenTxHash common.Hash, address common.Address,
 	t[key] = value
 }
 
+func (t TokenHoldersCache) Delete(tokenTxHash common.Hash, address common.Address) {
+	key := t.getKey(tokenTxHash, address)
+	delete(t, key)
+}
+
 func (t TokenHoldersCache) Union(tokenTxHash common.Hash, address common.Address, value *TokenHolder) {
 	key := t.getKey(tokenTxHash, address)
 	if _, ok := t[key]; ok {
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+)
+
+// TokenStats are the running totals of a token. As the supply of a token is
+// fixed when it is created, Supply must always equal TotalSupply.
+type TokenStats struct {
+	TokenTxHash common.Hash   `json:"tokenTxHash" bson:"tokenTxHash"`
+	TotalSupply common.Amount `json:"totalSupply" bson:"totalSupply"` // Sum of the initial balances
+	Supply      common.Amount `json:"supply" bson:"supply"`           // Sum of the token holder amounts
+	HolderCount int64         `json:"holderCount" bson:"holderCount"` // Token holders with a non zero amount
+}
+
+// NewTokenStatsFromTokenTx returns the stats of the token created by tokenTx,
+// before any initial balance is credited.
+func NewTokenStatsFromTokenTx(tokenTx *TokenTx) (*TokenStats, error) {
+	s := &TokenStats{TokenTxHash: tokenTx.TxHash}
+	for _, amount := range tokenTx.Amounts {
+		totalSupply, err := s.TotalSupply.Add(amount)
+		if err != nil {
+			return nil, fmt.Errorf("token: %s total supply overflows", tokenTx.TxHash.ToString())
+		}
+		s.TotalSupply = totalSupply
+	}
+	return s, nil
+}
+
+// Update accounts for a token holder amount changing from before to after.
+func (s *TokenStats) Update(before common.Amount, after common.Amount) error {
+	var supply common.Amount
+	var err error
+	if after >= before {
+		supply, err = s.Supply.Add(after - before)
+	} else {
+		supply, err = s.Supply.Sub(before - after)
+	}
+	if err != nil {
+		return fmt.Errorf("token: %s supply %d cannot account for a holder amount changing from %d to %d",
+			s.TokenTxHash.ToString(), s.Supply, before, after)
+	}
+	s.Supply = supply
+	if before == 0 && after != 0 {
+		s.HolderCount++
+	} else if before != 0 && after == 0 {
+		s.HolderCount--
+	}
+	return nil
+}
+
+// CheckSupply returns an error if the supply of the token differs from its
+// total supply.
+func (s *TokenStats) CheckSupply() error {
+	if s.Supply != s.TotalSupply {
+		return fmt.Errorf("token: %s supply %d differs from total supply %d",
+			s.TokenTxHash.ToString(), s.Supply, s.TotalSupply)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"fmt"
+
 	"github.com/cyyber/qrl-token-indexer/common"
 	"github.com/cyyber/qrl-token-indexer/generated"
 	"github.com/cyyber/qrl-token-indexer/misc"
@@ -12,16 +14,34 @@ type TokenTx struct {
 	Name        []byte           `json:"name" bson:"name"`
 	Decimals    int64            `json:"decimals" bson:"decimals"`
 	Addresses   []common.Address `json:"addresses" bson:"addresses"`
-	Amounts     []int64          `json:"amounts" bson:"amounts"`
+	Amounts     []common.Amount  `json:"amounts" bson:"amounts"`
+	// BlockHash and TxIndex locate the tx in its block. They are unset on txs
+	// indexed before they were recorded, and on pending txs
+	BlockHash common.Hash `json:"blockHash" bson:"blockHash"`
+	TxIndex   int         `json:"txIndex" bson:"txIndex"`
+
+	Finality `json:"finality" bson:"-"`
 }
 
-func (t *TokenTx) GetTokenHolders() TokenHolders {
+// GetTokenHolders returns the initial holders of the token. The amounts of an
+// address listed several times in the initial balances are added up.
+func (t *TokenTx) GetTokenHolders() (TokenHolders, error) {
 	tokenHolders := make(TokenHolders)
 	for i, address := range t.Addresses {
-		tokenHolder := NewTokenHolder(t.TxHash, address, t.Amounts[i])
-		tokenHolders[address] = tokenHolder
+		tokenHolder, ok := tokenHolders[address]
+		if !ok {
+			tokenHolder = NewTokenHolder(t.TxHash, address, 0)
+			tokenHolder.BlockNumber = t.BlockNumber
+			tokenHolders[address] = tokenHolder
+		}
+		amount, err := tokenHolder.Amount.Add(t.Amounts[i])
+		if err != nil {
+			return nil, fmt.Errorf("token: %s initial balance of %s overflows", t.TxHash.ToString(),
+				address.ToString())
+		}
+		tokenHolder.Amount = amount
 	}
-	return tokenHolders
+	return tokenHolders, nil
 }
 
 func NewTokenTxFromPBData(blockNumber uint64, pbData *generated.Transaction) *TokenTx {
@@ -34,12 +54,12 @@ func NewTokenTxFromPBData(blockNumber uint64, pbData *generated.Transaction) *To
 	t.Decimals = int64(tt.Decimals)
 
 	t.Addresses = make([]common.Address, 0, len(tt.InitialBalances))
-	t.Amounts = make([]int64, 0, len(tt.InitialBalances))
+	t.Amounts = make([]common.Amount, 0, len(tt.InitialBalances))
 
 	for _, addressAmount := range tt.InitialBalances {
 		sizedAddrTo := misc.ToSizedAddress(addressAmount.Address)
 		t.Addresses = append(t.Addresses, sizedAddrTo)
-		t.Amounts = append(t.Amounts, int64(addressAmount.Amount))
+		t.Amounts = append(t.Amounts, common.Amount(addressAmount.Amount))
 	}
 
 	return t
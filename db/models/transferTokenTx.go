@@ -13,7 +13,13 @@ type TransferTokenTx struct {
 	TokenTxHash common.Hash      `json:"tokenTxHash" bson:"tokenTxHash"`
 	From        common.Address   `json:"from" bson:"from"`
 	Addresses   []common.Address `json:"addresses" bson:"addresses"`
-	Amounts     []int64          `json:"amounts" bson:"amounts"`
+	Amounts     []common.Amount  `json:"amounts" bson:"amounts"`
+	// BlockHash and TxIndex locate the tx in its block. They are unset on txs
+	// indexed before they were recorded, and on pending txs
+	BlockHash common.Hash `json:"blockHash" bson:"blockHash"`
+	TxIndex   int         `json:"txIndex" bson:"txIndex"`
+
+	Finality `json:"finality" bson:"-"`
 }
 
 func (t *TransferTokenTx) GetTokenRelatedTx() *TokenRelatedTx {
@@ -33,12 +39,12 @@ func NewTransferTokenTxFromPBData(blockNumber uint64, pbData *generated.Transact
 		t.From = xmss.GetXMSSAddressFromPK(pbData.PublicKey)
 	}
 	t.Addresses = make([]common.Address, 0, len(tt.AddrsTo))
-	t.Amounts = make([]int64, 0, len(tt.Amounts))
+	t.Amounts = make([]common.Amount, 0, len(tt.Amounts))
 
 	for i, addrTo := range tt.AddrsTo {
 		sizedAddrTo := misc.ToSizedAddress(addrTo)
 		t.Addresses = append(t.Addresses, sizedAddrTo)
-		t.Amounts = append(t.Amounts, int64(tt.Amounts[i]))
+		t.Amounts = append(t.Amounts, common.Amount(tt.Amounts[i]))
 	}
 
 	return t
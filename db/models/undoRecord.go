@@ -0,0 +1,63 @@
+package models
+
+import "github.com/cyyber/qrl-token-indexer/common"
+
+// TokenHolderBeforeImage is the state of a token holder before a block changed
+// it. TokenHolder is nil if the holder didn't exist before the block.
+type TokenHolderBeforeImage struct {
+	TokenTxHash common.Hash    `json:"tokenTxHash" bson:"tokenTxHash"`
+	Address     common.Address `json:"address" bson:"address"`
+	TokenHolder *TokenHolder   `json:"tokenHolder" bson:"tokenHolder"`
+}
+
+// UndoRecord holds the before image of every token holder changed by a block,
+// so the block can be reverted by restoring them.
+type UndoRecord struct {
+	BlockNumber  int64                     `json:"blockNumber" bson:"blockNumber"`
+	BlockHash    common.Hash               `json:"blockHash" bson:"blockHash"`
+	TokenHolders []*TokenHolderBeforeImage `json:"tokenHolders" bson:"tokenHolders"`
+
+	// imaged keys the holders of TokenHolders
+	imaged map[beforeImageKey]bool
+}
+
+type beforeImageKey struct {
+	tokenTxHash common.Hash
+	address     common.Address
+}
+
+func NewUndoRecord(b *Block) *UndoRecord {
+	return &UndoRecord{
+		BlockNumber: b.Number,
+		BlockHash:   b.Hash,
+	}
+}
+
+// AddBeforeImage records tokenHolder as the before image of its holder.
+// A nil tokenHolder records that the holder didn't exist. Only the first image
+// of a holder is kept, as a holder read again within the block, e.g. when a
+// transfer lists it twice, may already be changed by the block.
+func (u *UndoRecord) AddBeforeImage(tokenTxHash common.Hash, address common.Address, tokenHolder *TokenHolder) {
+	if u.imaged == nil {
+		u.imaged = make(map[beforeImageKey]bool, len(u.TokenHolders))
+		for _, image := range u.TokenHolders {
+			u.imaged[beforeImageKey{image.TokenTxHash, image.Address}] = true
+		}
+	}
+	key := beforeImageKey{tokenTxHash, address}
+	if u.imaged[key] {
+		return
+	}
+	u.imaged[key] = true
+
+	var image *TokenHolder
+	if tokenHolder != nil {
+		t := *tokenHolder
+		image = &t
+	}
+	u.TokenHolders = append(u.TokenHolders, &TokenHolderBeforeImage{
+		TokenTxHash: tokenTxHash,
+		Address:     address,
+		TokenHolder: image,
+	})
+}
@@ -1,16 +1,15 @@
 package db
 
 import (
+	"context"
 	"encoding/hex"
-	"go.mongodb.org/mongo-driver/bson"
+	"fmt"
 
-	"github.com/cyyber/qrl-token-indexer/common"
-	"github.com/cyyber/qrl-token-indexer/config"
 	"github.com/cyyber/qrl-token-indexer/db/models"
 	"github.com/cyyber/qrl-token-indexer/generated"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/x/bsonx"
 )
 
 func AddInsertOneModelIntoOperations(operations *[]mongo.WriteModel, model interface{}) {
@@ -25,127 +24,265 @@ func AddDeleteOneModelIntoOperations(operations *[]mongo.WriteModel, model inter
 	*operations = append(*operations, operation)
 }
 
-func (m *MongoDBProcessor) ProcessBlock(b *generated.Block) error {
-	var blockOperations []mongo.WriteModel
-	var tokenTxOperations []mongo.WriteModel
-	var transferTokenTxOperations []mongo.WriteModel
-	var tokenHolderOperations []mongo.WriteModel
-	var tokenRelatedTxOperations []mongo.WriteModel
-
-	blockModel := models.NewBlockFromPBData(b)
-	AddInsertOneModelIntoOperations(&blockOperations, blockModel)
-
-	reOrgLimit := common.BLOCKZERO + config.GetConfig().ReOrgLimit
-	if uint64(blockModel.Number) > reOrgLimit {
-		removeBlockNumber := uint64(blockModel.Number) - reOrgLimit
-		deleteOneOperation := mongo.NewDeleteOneModel()
-		deleteOneOperation.SetFilter(bsonx.Doc{
-			{"number", bsonx.Int64(int64(removeBlockNumber))},
-		})
-		blockOperations = append(blockOperations, deleteOneOperation)
+func AddUpsertTokenHolderIntoOperations(operations *[]mongo.WriteModel, tokenHolder *models.TokenHolder) {
+	operation := mongo.NewUpdateOneModel()
+	operation.SetUpsert(true)
+	operation.SetFilter(tokenHolderFilter(tokenHolder))
+	operation.SetUpdate(bson.M{"$set": tokenHolder})
+	*operations = append(*operations, operation)
+}
+
+func AddReplaceOneModelIntoOperations(operations *[]mongo.WriteModel, model interface{}) {
+	operation := mongo.NewReplaceOneModel()
+	operation.SetUpsert(true)
+	operation.SetFilter(naturalKeyFilter(model))
+	operation.SetReplacement(model)
+	*operations = append(*operations, operation)
+}
+
+func tokenHolderFilter(tokenHolder *models.TokenHolder) bson.M {
+	return bson.M{
+		"tokenTxHash": tokenHolder.TokenTxHash,
+		"address":     tokenHolder.Address,
 	}
+}
 
-	tokenHoldersCache := make(models.TokenHoldersCache)
-
-	for _, protoTX := range b.Transactions {
-		switch protoTX.TransactionType.(type) {
-		case *generated.Transaction_Token_:
-			tokenTx := models.NewTokenTxFromPBData(b.Header.BlockNumber, protoTX)
-			AddInsertOneModelIntoOperations(&tokenTxOperations, tokenTx)
-
-			tokenHolders := tokenTx.GetTokenHolders()
-			tokenHoldersCache.PutFromTokenHolders(tokenHolders)
-
-			for _, tokenHolder := range tokenHolders {
-				AddInsertOneModelIntoOperations(&tokenHolderOperations, tokenHolder)
-			}
-		case *generated.Transaction_TransferToken_:
-			transferTokenTx := models.NewTransferTokenTxFromPBData(b.Header.BlockNumber, protoTX)
-			AddInsertOneModelIntoOperations(&transferTokenTxOperations, transferTokenTx)
-
-			AddInsertOneModelIntoOperations(&tokenRelatedTxOperations, transferTokenTx.GetTokenRelatedTx())
-
-			tokenHolders, err := m.GetTokenHoldersWithCache(transferTokenTx, tokenHoldersCache)
-			if err != nil {
-				m.log.Error("[ProcessBlock] Error calling GetTokenHolders",
-					"Error", err.Error())
-				return err
-			}
-			err = tokenHolders.Apply(transferTokenTx)
-			if err != nil {
-				m.log.Error("[ProcessBlock] Failed to process block",
-					"#", b.Header.BlockNumber,
-					"Hash", hex.EncodeToString(b.Header.HashHeader))
-				return err
-			}
-			tokenHoldersCache.PutFromTokenHolders(tokenHolders)
-
-			var operation *mongo.UpdateOneModel
-			for _, tokenHolder := range tokenHolders {
-				operation = mongo.NewUpdateOneModel()
-				operation.SetUpsert(true)
-				operation.SetFilter(bsonx.Doc{
-					{"tokenTxHash", bsonx.Binary(0, tokenHolder.TokenTxHash[:])},
-					{"address", bsonx.Binary(0, tokenHolder.Address[:])},
-				})
-				operation.SetUpdate(bson.M{"$set": tokenHolder})
-				tokenHolderOperations = append(tokenHolderOperations, operation)
-			}
-
-		default:
-			continue
+// blockOperations are the write models of BlockChanges for each collection
+type blockOperations struct {
+	blockOperations           []mongo.WriteModel
+	tokenTxOperations         []mongo.WriteModel
+	transferTokenTxOperations []mongo.WriteModel
+	tokenHolderOperations     []mongo.WriteModel
+	tokenRelatedTxOperations  []mongo.WriteModel
+	undoRecordOperations      []mongo.WriteModel
+	balanceChangeOperations   []mongo.WriteModel
+	tokenStatsOperations      []mongo.WriteModel
+	stateCommitmentOperations []mongo.WriteModel
+
+	checkpoint *models.Checkpoint
+}
+
+// newBlockOperations converts the changes into write models. Idempotent
+// operations replace documents by their natural key instead of inserting
+// them, so that they can be written again after a partial write.
+func newBlockOperations(c *models.BlockChanges, idempotent bool) *blockOperations {
+	if c.IsRevert() {
+		return newRevertBlockOperations(c)
+	}
+	return newProcessBlockOperations(c, idempotent)
+}
+
+func newProcessBlockOperations(c *models.BlockChanges, idempotent bool) *blockOperations {
+	o := &blockOperations{checkpoint: c.Checkpoint}
+
+	addInsert := AddInsertOneModelIntoOperations
+	if idempotent {
+		addInsert = AddReplaceOneModelIntoOperations
+	}
+
+	addInsert(&o.blockOperations, c.Block)
+	addInsert(&o.undoRecordOperations, c.UndoRecord)
+	if c.PrunedBlockNumber >= 0 {
+		AddDeleteOneModelIntoOperations(&o.blockOperations, bson.M{"number": c.PrunedBlockNumber})
+		operation := mongo.NewDeleteManyModel()
+		operation.SetFilter(bson.M{"blockNumber": bson.M{"$lte": c.PrunedBlockNumber}})
+		o.undoRecordOperations = append(o.undoRecordOperations, operation)
+	}
+	for _, tokenTx := range c.TokenTxs {
+		addInsert(&o.tokenTxOperations, tokenTx)
+	}
+	for _, transferTokenTx := range c.TransferTokenTxs {
+		addInsert(&o.transferTokenTxOperations, transferTokenTx)
+	}
+	for _, tokenRelatedTx := range c.TokenRelatedTxs {
+		addInsert(&o.tokenRelatedTxOperations, tokenRelatedTx)
+	}
+	for _, balanceChange := range c.BalanceChanges {
+		addInsert(&o.balanceChangeOperations, balanceChange)
+	}
+	if c.StateCommitment != nil {
+		addInsert(&o.stateCommitmentOperations, c.StateCommitment)
+	}
+	o.addTokenHolderOperations(c)
+	o.addTokenStatsOperations(c)
+	return o
+}
+
+func newRevertBlockOperations(c *models.BlockChanges) *blockOperations {
+	o := &blockOperations{checkpoint: c.Checkpoint}
+
+	AddDeleteOneModelIntoOperations(&o.blockOperations, bson.M{"number": c.Block.Number})
+	AddDeleteOneModelIntoOperations(&o.undoRecordOperations, bson.M{"blockNumber": c.Block.Number})
+	for _, tokenTx := range c.TokenTxs {
+		AddDeleteOneModelIntoOperations(&o.tokenTxOperations, naturalKeyFilter(tokenTx))
+	}
+	for _, transferTokenTx := range c.TransferTokenTxs {
+		AddDeleteOneModelIntoOperations(&o.transferTokenTxOperations, naturalKeyFilter(transferTokenTx))
+	}
+	for _, tokenRelatedTx := range c.TokenRelatedTxs {
+		AddDeleteOneModelIntoOperations(&o.tokenRelatedTxOperations, naturalKeyFilter(tokenRelatedTx))
+	}
+	operation := mongo.NewDeleteManyModel()
+	operation.SetFilter(bson.M{"blockNumber": c.Block.Number})
+	o.balanceChangeOperations = append(o.balanceChangeOperations, operation)
+	AddDeleteOneModelIntoOperations(&o.stateCommitmentOperations, bson.M{"blockNumber": c.Block.Number})
+	o.addTokenHolderOperations(c)
+	o.addTokenStatsOperations(c)
+	return o
+}
+
+func (o *blockOperations) addTokenHolderOperations(c *models.BlockChanges) {
+	for _, tokenHolder := range c.TokenHolders {
+		AddUpsertTokenHolderIntoOperations(&o.tokenHolderOperations, tokenHolder)
+	}
+	for _, tokenHolder := range c.RemovedTokenHolders {
+		AddDeleteOneModelIntoOperations(&o.tokenHolderOperations, tokenHolderFilter(tokenHolder))
+	}
+}
+
+func (o *blockOperations) addTokenStatsOperations(c *models.BlockChanges) {
+	for _, tokenStats := range c.TokenStats {
+		AddReplaceOneModelIntoOperations(&o.tokenStatsOperations, tokenStats)
+	}
+	for _, tokenStats := range c.RemovedTokenStats {
+		AddDeleteOneModelIntoOperations(&o.tokenStatsOperations, naturalKeyFilter(tokenStats))
+	}
+}
+
+// naturalKeyFilter returns the filter matching the document with the same
+// unique key as model
+func naturalKeyFilter(model interface{}) bson.M {
+	switch t := model.(type) {
+	case *models.Block:
+		return bson.M{"number": t.Number}
+	case *models.TokenTx:
+		return bson.M{"txHash": t.TxHash}
+	case *models.TransferTokenTx:
+		return bson.M{"txHash": t.TxHash}
+	case *models.TokenRelatedTx:
+		return bson.M{"tokenTxHash": t.TokenTxHash, "txHash": t.TxHash}
+	case *models.TokenHolder:
+		return tokenHolderFilter(t)
+	case *models.UndoRecord:
+		return bson.M{"blockNumber": t.BlockNumber}
+	case *models.Checkpoint:
+		return bson.M{"_id": t.ID}
+	case *models.BalanceChange:
+		return bson.M{
+			"tokenTxHash": t.TokenTxHash,
+			"address":     t.Address,
+			"blockNumber": t.BlockNumber,
+			"txIndex":     t.TxIndex,
 		}
+	case *models.TokenStats:
+		return bson.M{"tokenTxHash": t.TokenTxHash}
+	case *models.StateCommitment:
+		return bson.M{"blockNumber": t.BlockNumber}
+	default:
+		panic(fmt.Sprintf("no natural key for %T", model))
 	}
+}
 
+// commit writes all the changes of a block, either in a single transaction or,
+// for a standalone MongoDB, through the journal
+func (m *MongoDBProcessor) commit(c *models.BlockChanges) error {
+	if m.config.GetMongoDBConfig().Standalone {
+		return m.commitWithJournal(c)
+	}
+	return m.commitWithTransaction(newBlockOperations(c, false))
+}
+
+func (m *MongoDBProcessor) commitWithTransaction(o *blockOperations) error {
 	session, err := m.client.StartSession(options.Session())
 	if err != nil {
-		m.log.Error("[ProcessBlock] failed to start session")
+		m.log.Error("[commit] failed to start session")
 		return err
 	}
 	defer session.EndSession(m.ctx)
 
-	err = mongo.WithSession(m.ctx, session, func(sctx mongo.SessionContext) error {
+	return mongo.WithSession(m.ctx, session, func(sctx mongo.SessionContext) error {
 		if err := sctx.StartTransaction(); err != nil {
 			return err
 		}
 
-		if _, err := m.blocksCollection.BulkWrite(sctx, blockOperations); err != nil {
-			m.log.Error("Failed to write in blocksCollection",
-				"total operations", len(blockOperations))
+		if err := m.writeOperations(sctx, o); err != nil {
 			return err
 		}
 
-		if len(tokenTxOperations) > 0 {
-			if _, err := m.tokenTxsCollection.BulkWrite(sctx, tokenTxOperations); err != nil {
-				m.log.Error("Failed to write in tokenTxsCollection",
-					"total operations", len(tokenTxOperations))
-				return err
-			}
-		}
-		if len(transferTokenTxOperations) > 0 {
-			if _, err := m.transferTokenTxsCollection.BulkWrite(sctx, transferTokenTxOperations); err != nil {
-				m.log.Error("Failed to write in transferTokenTxsCollection",
-					"total operations", len(transferTokenTxOperations))
-				return err
-			}
-		}
-		if len(tokenHolderOperations) > 0 {
-			if _, err := m.tokenHoldersCollection.BulkWrite(sctx, tokenHolderOperations); err != nil {
-				m.log.Error("Failed to write in tokenHoldersCollection",
-					"total operations", len(tokenHolderOperations))
-				return err
-			}
+		return sctx.CommitTransaction(sctx)
+	})
+}
+
+// writeOperations writes the operations of each collection, followed by the
+// checkpoint
+func (m *MongoDBProcessor) writeOperations(ctx context.Context, o *blockOperations) error {
+	collectionOperations := []struct {
+		name       string
+		collection *mongo.Collection
+		operations []mongo.WriteModel
+	}{
+		{"blocksCollection", m.blocksCollection, o.blockOperations},
+		{"tokenTxsCollection", m.tokenTxsCollection, o.tokenTxOperations},
+		{"transferTokenTxsCollection", m.transferTokenTxsCollection, o.transferTokenTxOperations},
+		{"tokenHoldersCollection", m.tokenHoldersCollection, o.tokenHolderOperations},
+		{"tokenRelatedTxsCollection", m.tokenRelatedTxsCollection, o.tokenRelatedTxOperations},
+		{"undoRecordsCollection", m.undoRecordsCollection, o.undoRecordOperations},
+		{"balanceChangesCollection", m.balanceChangesCollection, o.balanceChangeOperations},
+		{"tokenStatsCollection", m.tokenStatsCollection, o.tokenStatsOperations},
+		{"stateCommitmentsCollection", m.stateCommitmentsCollection, o.stateCommitmentOperations},
+	}
+
+	for _, c := range collectionOperations {
+		if len(c.operations) == 0 {
+			continue
 		}
-		if len(tokenRelatedTxOperations) > 0 {
-			if _, err := m.tokenRelatedTxsCollection.BulkWrite(sctx, tokenRelatedTxOperations); err != nil {
-				m.log.Error("Failed to write in tokenRelatedTxsCollection",
-					"total operations", len(tokenRelatedTxOperations))
-				return err
-			}
+		if _, err := c.collection.BulkWrite(ctx, c.operations); err != nil {
+			m.log.Error("Failed to write in "+c.name,
+				"total operations", len(c.operations))
+			return err
 		}
+	}
 
-		return sctx.CommitTransaction(sctx)
-	})
+	if err := m.writeCheckpoint(ctx, o.checkpoint); err != nil {
+		m.log.Error("Failed to write checkpoint")
+		return err
+	}
+	return nil
+}
+
+func (m *MongoDBProcessor) writeCheckpoint(ctx context.Context, checkpoint *models.Checkpoint) error {
+	_, err := m.checkpointsCollection.ReplaceOne(ctx,
+		bson.M{"_id": checkpoint.ID},
+		checkpoint,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *MongoDBProcessor) ProcessBlock(b *generated.Block) error {
+	processed, err := IsBlockProcessed(m, b)
+	if err != nil {
+		m.log.Error("[ProcessBlock] Failed to check if block is already processed",
+			"#", b.Header.BlockNumber,
+			"Error", err.Error())
+		return err
+	}
+	if processed {
+		m.log.Warn("[ProcessBlock] Skipping already processed block",
+			"#", b.Header.BlockNumber,
+			"Hash", hex.EncodeToString(b.Header.HashHeader))
+		return nil
+	}
+
+	changes, err := NewProcessBlockChanges(m, b, m.config.ReOrgLimit)
+	if err != nil {
+		m.log.Error("[ProcessBlock] Failed to process block",
+			"#", b.Header.BlockNumber,
+			"Hash", hex.EncodeToString(b.Header.HashHeader),
+			"Error", err.Error())
+		return err
+	}
+
+	err = m.commit(changes)
 	if err != nil {
 		m.log.Info("Failed to Process",
 			"Block #", b.Header.BlockNumber,
@@ -168,154 +305,16 @@ func (m *MongoDBProcessor) RevertLastBlock() error {
 		return err
 	}
 
-	tokenTxs, err := m.GetTokenTxsByBlockNumber(b.Number)
+	changes, err := NewRevertBlockChanges(m, b)
 	if err != nil {
-		m.log.Error("[RevertLastBlock] failed to get token txs by block number",
-			"block number", b.Number,
-			"error", err)
-		return err
-	}
-	transferTokenTxs, err := m.GetTransferTokenTxsByBlockNumber(b.Number)
-	if err != nil {
-		m.log.Error("[RevertLastBlock] failed to get transfer token txs by block number",
-			"block number", b.Number,
-			"error", err)
+		m.log.Error("[RevertLastBlock] Failed to revert block",
+			"#", b.Number,
+			"Hash", b.Hash.ToString(),
+			"Error", err.Error())
 		return err
 	}
 
-	var blockOperations []mongo.WriteModel
-	var tokenTxOperations []mongo.WriteModel
-	var transferTokenTxOperations []mongo.WriteModel
-	var tokenHolderOperations []mongo.WriteModel
-	var tokenRelatedTxOperations []mongo.WriteModel
-
-	tokenHoldersCache := make(models.TokenHoldersCache)
-
-	for i := len(transferTokenTxs) - 1; i >= 0; i-- {
-		tokenHolders, err := m.GetTokenHoldersWithCache(transferTokenTxs[i], tokenHoldersCache)
-		if err != nil {
-			m.log.Error("[RevertLastBlock] Error calling GetTokenHolders",
-				"Error", err.Error())
-			return err
-		}
-
-		transferTokenTx := transferTokenTxs[i]
-		err = tokenHolders.Revert(transferTokenTx)
-		if err != nil {
-			m.log.Error("[RevertLastBlock] Failed to revert block",
-				"#", b.Number,
-				"Hash", b.Hash.ToString())
-			return err
-		}
-		tokenHoldersCache.PutFromTokenHolders(tokenHolders)
-
-		var operation *mongo.UpdateOneModel
-		var deleteOperation *mongo.DeleteOneModel
-		for _, tokenHolder := range tokenHolders {
-			if tokenHolder.Amount == 0 {
-				deleteOperation = mongo.NewDeleteOneModel()
-				deleteOperation.SetFilter(bsonx.Doc{
-					{"tokenTxHash", bsonx.Binary(0, tokenHolder.TokenTxHash[:])},
-					{"address", bsonx.Binary(0, tokenHolder.Address[:])},
-				})
-				tokenHolderOperations = append(tokenHolderOperations, deleteOperation)
-			} else {
-				operation = mongo.NewUpdateOneModel()
-				operation.SetUpsert(true)
-				operation.SetFilter(bsonx.Doc{
-					{"tokenTxHash", bsonx.Binary(0, tokenHolder.TokenTxHash[:])},
-					{"address", bsonx.Binary(0, tokenHolder.Address[:])},
-				})
-				operation.SetUpdate(bson.M{"$set": tokenHolder})
-				tokenHolderOperations = append(tokenHolderOperations, operation)
-			}
-		}
-		deleteOperation = mongo.NewDeleteOneModel()
-		deleteOperation.SetFilter(bsonx.Doc{
-			{"tokenTxHash", bsonx.Binary(0, transferTokenTx.TokenTxHash[:])},
-			{"txHash", bsonx.Binary(0, transferTokenTx.TxHash[:])},
-		})
-		tokenRelatedTxOperations = append(tokenRelatedTxOperations, deleteOperation)
-
-		deleteOperation = mongo.NewDeleteOneModel()
-		deleteOperation.SetFilter(bsonx.Doc{
-			{"txHash", bsonx.Binary(0, transferTokenTx.TokenTxHash[:])},
-		})
-		transferTokenTxOperations = append(transferTokenTxOperations, deleteOperation)
-	}
-
-	for i := len(tokenTxs) - 1; i >= 0; i-- {
-		tokenTx := tokenTxs[i]
-		tokenHolders := tokenTx.GetTokenHolders()
-
-		var deleteOperation *mongo.DeleteOneModel
-		for _, tokenHolder := range tokenHolders {
-			deleteOperation = mongo.NewDeleteOneModel()
-			deleteOperation.SetFilter(bsonx.Doc{
-				{"tokenTxHash", bsonx.Binary(0, tokenHolder.TokenTxHash[:])},
-				{"address", bsonx.Binary(0, tokenHolder.Address[:])},
-			})
-			tokenHolderOperations = append(tokenHolderOperations, deleteOperation)
-		}
-
-		deleteOperation = mongo.NewDeleteOneModel()
-		deleteOperation.SetFilter(bsonx.Doc{
-			{"txHash", bsonx.Binary(0, tokenTx.TxHash[:])},
-		})
-		tokenTxOperations = append(tokenTxOperations, deleteOperation)
-	}
-
-	AddDeleteOneModelIntoOperations(&blockOperations, b)
-
-	session, err := m.client.StartSession(options.Session())
-	if err != nil {
-		m.log.Error("[RevertLastBlock] failed to start session")
-		return err
-	}
-	defer session.EndSession(m.ctx)
-
-	err = mongo.WithSession(m.ctx, session, func(sctx mongo.SessionContext) error {
-		if err := sctx.StartTransaction(); err != nil {
-			return err
-		}
-
-		if _, err := m.blocksCollection.BulkWrite(sctx, blockOperations); err != nil {
-			m.log.Error("Failed to write in blocksCollection",
-				"total operations", len(blockOperations))
-			return err
-		}
-
-		if len(tokenTxOperations) > 0 {
-			if _, err := m.tokenTxsCollection.BulkWrite(sctx, tokenTxOperations); err != nil {
-				m.log.Error("Failed to write in tokenTxsCollection",
-					"total operations", len(tokenTxOperations))
-				return err
-			}
-		}
-		if len(transferTokenTxOperations) > 0 {
-			if _, err := m.transferTokenTxsCollection.BulkWrite(sctx, transferTokenTxOperations); err != nil {
-				m.log.Error("Failed to write in transferTokenTxsCollection",
-					"total operations", len(transferTokenTxOperations))
-				return err
-			}
-		}
-		if len(tokenHolderOperations) > 0 {
-			if _, err := m.tokenHoldersCollection.BulkWrite(sctx, tokenHolderOperations); err != nil {
-				m.log.Error("Failed to write in tokenHoldersCollection",
-					"total operations", len(tokenHolderOperations))
-				return err
-			}
-		}
-		if len(tokenRelatedTxOperations) > 0 {
-			if _, err := m.tokenRelatedTxsCollection.BulkWrite(sctx, tokenRelatedTxOperations); err != nil {
-				m.log.Error("Failed to write in tokenRelatedTxsCollection",
-					"total operations", len(tokenRelatedTxOperations))
-				return err
-			}
-		}
-
-		return sctx.CommitTransaction(sctx)
-	})
+	err = m.commit(changes)
 	if err != nil {
 		m.log.Info("Failed to Revert",
 			"Block #", b.Number,
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProcessingError is returned by ProcessBlock when the block cannot be applied
+// to the indexed state, as opposed to failing to read or write the store. The
+// block keeps failing until either the state or the block is fixed.
+type ProcessingError struct {
+	Failure *models.ProcessingFailure
+	Err     error
+}
+
+func (e *ProcessingError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ProcessingError) Unwrap() error {
+	return e.Err
+}
+
+func newProcessingError(b *generated.Block, err error) *ProcessingError {
+	f := &models.ProcessingFailure{
+		BlockNumber: int64(b.Header.BlockNumber),
+		BlockHash:   misc.ToSizedHash(b.Header.HashHeader),
+		Error:       err.Error(),
+	}
+	if encoded, encodeErr := proto.Marshal(b); encodeErr == nil {
+		f.Block = encoded
+	} else {
+		f.Error = fmt.Sprintf("%s (block cannot be encoded: %s)", f.Error, encodeErr)
+	}
+	return &ProcessingError{Failure: f, Err: err}
+}
+
+// newTransferProcessingError returns the error of a transfer which cannot be
+// applied to tokenHolders, the states of its holders before the transfer.
+func newTransferProcessingError(b *generated.Block, transferTokenTx *models.TransferTokenTx,
+	tokenHolders []*models.TokenHolder, err error) *ProcessingError {
+	e := newProcessingError(b, err)
+	e.Failure.TxHash = transferTokenTx.TxHash
+	e.Failure.TokenTxHash = transferTokenTx.TokenTxHash
+	e.Failure.TokenHolders = tokenHolders
+	return e
+}
+
+// ProcessingFailureStore keeps the blocks which failed with a
+// ProcessingError. A block has at most one unresolved failure.
+type ProcessingFailureStore interface {
+	// RecordProcessingFailure records a failure of its block, or another
+	// attempt if the block already has an unresolved failure, and returns
+	// the recorded failure. An unresolved failure of another block at the
+	// same height is resolved as replaced.
+	RecordProcessingFailure(f *models.ProcessingFailure) (*models.ProcessingFailure, error)
+	// GetProcessingFailure returns the unresolved failure at blockNumber
+	GetProcessingFailure(blockNumber int64) (*models.ProcessingFailure, error)
+	// GetProcessingFailures returns the unresolved failures by block number
+	GetProcessingFailures() ([]*models.ProcessingFailure, error)
+	ResolveProcessingFailure(blockNumber int64, resolution string) error
+}
+
+func (m *MongoDBProcessor) RecordProcessingFailure(f *models.ProcessingFailure) (*models.ProcessingFailure, error) {
+	now := time.Now().UTC()
+	_, err := m.processingFailuresCollection.UpdateMany(m.ctx,
+		bson.M{
+			"blockNumber": f.BlockNumber,
+			"blockHash":   bson.M{"$ne": f.BlockHash},
+			"resolvedAt":  nil,
+		},
+		bson.M{"$set": bson.M{
+			"resolvedAt": now,
+			"resolution": models.ProcessingFailureResolutionReplaced,
+		}})
+	if err != nil {
+		m.log.Error("[RecordProcessingFailure] Failed to resolve replaced failure",
+			"#", f.BlockNumber,
+			"Error", err.Error())
+		return nil, err
+	}
+
+	o := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+	result := m.processingFailuresCollection.FindOneAndUpdate(m.ctx,
+		bson.M{
+			"blockNumber": f.BlockNumber,
+			"blockHash":   f.BlockHash,
+			"resolvedAt":  nil,
+		},
+		bson.M{
+			"$set": bson.M{
+				"block":        f.Block,
+				"txHash":       f.TxHash,
+				"tokenTxHash":  f.TokenTxHash,
+				"error":        f.Error,
+				"tokenHolders": f.TokenHolders,
+				"lastFailedAt": now,
+			},
+			"$setOnInsert": bson.M{"firstFailedAt": now},
+			"$inc":         bson.M{"attempts": 1},
+		}, o)
+	if result.Err() != nil {
+		m.log.Error("[RecordProcessingFailure] Failed to record failure",
+			"#", f.BlockNumber,
+			"Error", result.Err().Error())
+		return nil, result.Err()
+	}
+	recorded := &models.ProcessingFailure{}
+	if err := result.Decode(recorded); err != nil {
+		return nil, err
+	}
+	return recorded, nil
+}
+
+func (m *MongoDBProcessor) GetProcessingFailure(blockNumber int64) (*models.ProcessingFailure, error) {
+	result := m.processingFailuresCollection.FindOne(m.ctx,
+		bson.M{"blockNumber": blockNumber, "resolvedAt": nil})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	f := &models.ProcessingFailure{}
+	if err := result.Decode(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m *MongoDBProcessor) GetProcessingFailures() ([]*models.ProcessingFailure, error) {
+	o := options.Find().SetSort(bson.D{{Key: "blockNumber", Value: 1}})
+	cursor, err := m.processingFailuresCollection.Find(m.ctx, bson.M{"resolvedAt": nil}, o)
+	if err != nil {
+		return nil, err
+	}
+	var failures []*models.ProcessingFailure
+	if err := cursor.All(m.ctx, &failures); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+func (m *MongoDBProcessor) ResolveProcessingFailure(blockNumber int64, resolution string) error {
+	result, err := m.processingFailuresCollection.UpdateMany(m.ctx,
+		bson.M{"blockNumber": blockNumber, "resolvedAt": nil},
+		bson.M{"$set": bson.M{
+			"resolvedAt": time.Now().UTC(),
+			"resolution": resolution,
+		}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
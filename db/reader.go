@@ -1,7 +1,6 @@
 package db
 
 import (
-	"errors"
 	"github.com/cyyber/qrl-token-indexer/common"
 	"github.com/cyyber/qrl-token-indexer/db/models"
 	"go.mongodb.org/mongo-driver/bson"
@@ -9,12 +8,20 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// notFound translates the driver's ErrNoDocuments into the Store's ErrNotFound
+func notFound(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
 func (m *MongoDBProcessor) GetLastBlock() (*models.Block, error) {
 	o := &options.FindOneOptions{}
 	o.Sort = bson.D{{"number", -1}}
 	result := m.blocksCollection.FindOne(m.ctx, bson.D{{}}, o)
 	if result.Err() != nil {
-		return nil, result.Err()
+		return nil, notFound(result.Err())
 	}
 	b := &models.Block{}
 	err := result.Decode(b)
@@ -30,7 +37,7 @@ func (m *MongoDBProcessor) GetBlockByNumber(number int64) (*models.Block, error)
 	result := m.blocksCollection.FindOne(m.ctx,
 		bson.D{{"number", number}}, o)
 	if result.Err() != nil {
-		return nil, result.Err()
+		return nil, notFound(result.Err())
 	}
 	b := &models.Block{}
 	err := result.Decode(b)
@@ -40,11 +47,37 @@ func (m *MongoDBProcessor) GetBlockByNumber(number int64) (*models.Block, error)
 	return b, nil
 }
 
+func (m *MongoDBProcessor) GetCheckpoint() (*models.Checkpoint, error) {
+	result := m.checkpointsCollection.FindOne(m.ctx, bson.M{"_id": models.CheckpointID})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	c := &models.Checkpoint{}
+	err := result.Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *MongoDBProcessor) GetUndoRecord(blockNumber int64) (*models.UndoRecord, error) {
+	result := m.undoRecordsCollection.FindOne(m.ctx, bson.M{"blockNumber": blockNumber})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	u := &models.UndoRecord{}
+	err := result.Decode(u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
 func (m *MongoDBProcessor) GetTokenTxsByBlockNumber(blockNumber int64) ([]*models.TokenTx, error) {
 	var tokenTxs []*models.TokenTx
 
 	o := &options.FindOptions{}
-	o.Sort = bson.D{{"blockNumber", -1}}
+	o.Sort = bson.D{{"txIndex", 1}}
 	cursor, err := m.tokenTxsCollection.Find(m.ctx,
 		bson.D{{"blockNumber", blockNumber}}, o)
 	if err != nil {
@@ -66,7 +99,7 @@ func (m *MongoDBProcessor) GetTransferTokenTxsByBlockNumber(blockNumber int64) (
 	var transferTokenTxs []*models.TransferTokenTx
 
 	o := &options.FindOptions{}
-	o.Sort = bson.D{{"blockNumber", -1}}
+	o.Sort = bson.D{{"txIndex", 1}}
 	cursor, err := m.transferTokenTxsCollection.Find(m.ctx,
 		bson.D{{"blockNumber", blockNumber}}, o)
 	if err != nil {
@@ -84,6 +117,45 @@ func (m *MongoDBProcessor) GetTransferTokenTxsByBlockNumber(blockNumber int64) (
 	return transferTokenTxs, nil
 }
 
+func (m *MongoDBProcessor) GetTokenTx(txHash common.Hash) (*models.TokenTx, error) {
+	result := m.tokenTxsCollection.FindOne(m.ctx, bson.M{"txHash": txHash})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	t := &models.TokenTx{}
+	err := result.Decode(t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (m *MongoDBProcessor) GetTokenStats(tokenTxHash common.Hash) (*models.TokenStats, error) {
+	result := m.tokenStatsCollection.FindOne(m.ctx, bson.M{"tokenTxHash": tokenTxHash})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	s := &models.TokenStats{}
+	err := result.Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *MongoDBProcessor) GetTransferTokenTx(txHash common.Hash) (*models.TransferTokenTx, error) {
+	result := m.transferTokenTxsCollection.FindOne(m.ctx, bson.M{"txHash": txHash})
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	t := &models.TransferTokenTx{}
+	err := result.Decode(t)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
 func (m *MongoDBProcessor) GetTokenHolder(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error) {
 	o := &options.FindOneOptions{}
 	o.Sort = bson.D{{"tokenTxHash", -1}, {"address", -1}}
@@ -93,7 +165,7 @@ func (m *MongoDBProcessor) GetTokenHolder(tokenTxHash common.Hash, address commo
 			{"address", address},
 		}, o)
 	if result.Err() != nil {
-		return nil, result.Err()
+		return nil, notFound(result.Err())
 	}
 	t := &models.TokenHolder{}
 	err := result.Decode(t)
@@ -115,7 +187,7 @@ func (m *MongoDBProcessor) GetTokenHolders(transferTokenTx *models.TransferToken
 	for _, address := range transferTokenTx.Addresses {
 		tokenHolder, err := m.GetTokenHolder(transferTokenTx.TokenTxHash, address)
 		if err != nil {
-			if err != mongo.ErrNoDocuments {
+			if err != ErrNotFound {
 				return nil, err
 			}
 			tokenHolder = models.NewTokenHolder(transferTokenTx.TokenTxHash, address, 0)
@@ -124,38 +196,3 @@ func (m *MongoDBProcessor) GetTokenHolders(transferTokenTx *models.TransferToken
 	}
 	return tokenHolders, nil
 }
-
-func (m *MongoDBProcessor) GetTokenHoldersWithCache(transferTokenTx *models.TransferTokenTx, cache models.TokenHoldersCache) (models.TokenHolders, error) {
-	if cache == nil {
-		return nil, errors.New("TokenHoldersCache required")
-	}
-	var err error
-
-	tokenHolders := make(models.TokenHolders)
-
-	fromTokenHolder := cache.Get(transferTokenTx.TokenTxHash, transferTokenTx.From)
-	if fromTokenHolder == nil {
-		fromTokenHolder, err = m.GetTokenHolder(transferTokenTx.TokenTxHash, transferTokenTx.From)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	tokenHolders[transferTokenTx.From] = fromTokenHolder
-
-	for _, address := range transferTokenTx.Addresses {
-		tokenHolder := cache.Get(transferTokenTx.TokenTxHash, address)
-		if tokenHolder == nil {
-			tokenHolder, err = m.GetTokenHolder(transferTokenTx.TokenTxHash, address)
-			if err != nil {
-				if err != mongo.ErrNoDocuments {
-					return nil, err
-				}
-				tokenHolder = models.NewTokenHolder(transferTokenTx.TokenTxHash, address, 0)
-			}
-		}
-
-		tokenHolders[address] = tokenHolder
-	}
-	return tokenHolders, nil
-}
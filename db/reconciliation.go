@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (m *MongoDBProcessor) GetTokenHoldersByAddress(address common.Address) ([]*models.TokenHolder, error) {
+	cursor, err := m.tokenHoldersCollection.Find(m.ctx, bson.M{"address": address})
+	if err != nil {
+		return nil, err
+	}
+	var tokenHolders []*models.TokenHolder
+	if err := cursor.All(m.ctx, &tokenHolders); err != nil {
+		return nil, err
+	}
+	return tokenHolders, nil
+}
+
+// SampleTokenHolderAddresses returns up to size distinct addresses picked at
+// random among those holding a token.
+func (m *MongoDBProcessor) SampleTokenHolderAddresses(size int) ([]common.Address, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"amount": bson.M{"$ne": 0}}}},
+		{{Key: "$sample", Value: bson.M{"size": size}}},
+		{{Key: "$group", Value: bson.M{"_id": "$address"}}},
+	}
+	cursor, err := m.tokenHoldersCollection.Aggregate(m.ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var results []struct {
+		Address common.Address `bson:"_id"`
+	}
+	if err := cursor.All(m.ctx, &results); err != nil {
+		return nil, err
+	}
+	addresses := make([]common.Address, 0, len(results))
+	for _, result := range results {
+		addresses = append(addresses, result.Address)
+	}
+	return addresses, nil
+}
+
+func (m *MongoDBProcessor) InsertReconciliationReport(r *models.ReconciliationReport) error {
+	_, err := m.reconciliationReportsCollection.InsertOne(m.ctx, r)
+	if err != nil {
+		m.log.Error("[InsertReconciliationReport] Failed to insert report",
+			"Error", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kinds of records making up the state of a Store, as dumped into and restored
+// from state snapshots
+const (
+	StateTokenTxs         = "tokenTxs"
+	StateTransferTokenTxs = "transferTokenTxs"
+	StateTokenRelatedTxs  = "tokenRelatedTxs"
+	StateTokenHolders     = "tokenHolders"
+	StateBalanceChanges   = "balanceChanges"
+	StateTokenStats       = "tokenStats"
+	StateStateCommitments = "stateCommitments"
+	StateUndoRecords      = "undoRecords"
+	StateBlocks           = "blocks"
+	StateCheckpoint       = "checkpoint"
+)
+
+// StateCollections lists all kinds of records in the order they are
+// restored. The checkpoint comes last, so that a store is only seen as
+// bootstrapped once everything else has been restored.
+var StateCollections = []string{
+	StateTokenTxs,
+	StateTransferTokenTxs,
+	StateTokenRelatedTxs,
+	StateTokenHolders,
+	StateBalanceChanges,
+	StateTokenStats,
+	StateStateCommitments,
+	StateUndoRecords,
+	StateBlocks,
+	StateCheckpoint,
+}
+
+// NewStateRecord returns a new record of the given kind to decode into.
+func NewStateRecord(collection string) (interface{}, error) {
+	switch collection {
+	case StateTokenTxs:
+		return &models.TokenTx{}, nil
+	case StateTransferTokenTxs:
+		return &models.TransferTokenTx{}, nil
+	case StateTokenRelatedTxs:
+		return &models.TokenRelatedTx{}, nil
+	case StateTokenHolders:
+		return &models.TokenHolder{}, nil
+	case StateBalanceChanges:
+		return &models.BalanceChange{}, nil
+	case StateTokenStats:
+		return &models.TokenStats{}, nil
+	case StateStateCommitments:
+		return &models.StateCommitment{}, nil
+	case StateUndoRecords:
+		return &models.UndoRecord{}, nil
+	case StateBlocks:
+		return &models.Block{}, nil
+	case StateCheckpoint:
+		return &models.Checkpoint{}, nil
+	default:
+		return nil, fmt.Errorf("unknown state collection %s", collection)
+	}
+}
+
+// StateDumper streams the records of a store. DumpState must not run
+// concurrently with ProcessBlock or RevertLastBlock, or the dump may mix
+// records from before and after a block.
+type StateDumper interface {
+	DumpState(collection string, fn func(record interface{}) error) error
+}
+
+// StateRestorer writes records dumped by a StateDumper into a store. Records
+// replace those with the same natural key, so that an interrupted restore
+// can be run again.
+type StateRestorer interface {
+	RestoreState(collection string, records []interface{}) error
+}
+
+// StateRepairer deletes records by their natural key, to repair
+// inconsistencies found in a store.
+type StateRepairer interface {
+	DeleteState(collection string, records []interface{}) error
+}
+
+// IsEmpty reports whether nothing has been indexed in r yet.
+func IsEmpty(r StoreReader) (bool, error) {
+	_, err := r.GetCheckpoint()
+	if err == nil {
+		return false, nil
+	} else if err != ErrNotFound {
+		return false, err
+	}
+	_, err = r.GetLastBlock()
+	if err == nil {
+		return false, nil
+	} else if err != ErrNotFound {
+		return false, err
+	}
+	return true, nil
+}
+
+func (m *MongoDBProcessor) stateCollection(collection string) (*mongo.Collection, error) {
+	switch collection {
+	case StateTokenTxs:
+		return m.tokenTxsCollection, nil
+	case StateTransferTokenTxs:
+		return m.transferTokenTxsCollection, nil
+	case StateTokenRelatedTxs:
+		return m.tokenRelatedTxsCollection, nil
+	case StateTokenHolders:
+		return m.tokenHoldersCollection, nil
+	case StateBalanceChanges:
+		return m.balanceChangesCollection, nil
+	case StateTokenStats:
+		return m.tokenStatsCollection, nil
+	case StateStateCommitments:
+		return m.stateCommitmentsCollection, nil
+	case StateUndoRecords:
+		return m.undoRecordsCollection, nil
+	case StateBlocks:
+		return m.blocksCollection, nil
+	case StateCheckpoint:
+		return m.checkpointsCollection, nil
+	default:
+		return nil, fmt.Errorf("unknown state collection %s", collection)
+	}
+}
+
+// DumpState dumps txs in block order, and within a block in the order they
+// appear in the block. Txs indexed before their position was recorded share
+// the index 0, and keep their insertion order.
+func (m *MongoDBProcessor) DumpState(collection string, fn func(record interface{}) error) error {
+	c, err := m.stateCollection(collection)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{}
+	o := options.Find()
+	switch collection {
+	case StateCheckpoint:
+		filter = bson.M{"_id": models.CheckpointID}
+	case StateTokenTxs, StateTransferTokenTxs:
+		o.SetSort(bson.D{
+			{Key: "blockNumber", Value: 1},
+			{Key: "txIndex", Value: 1},
+			{Key: "_id", Value: 1},
+		}).SetAllowDiskUse(true)
+	}
+	cursor, err := c.Find(m.ctx, filter, o)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	for cursor.Next(m.ctx) {
+		record, err := NewStateRecord(collection)
+		if err != nil {
+			return err
+		}
+		if err := cursor.Decode(record); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (m *MongoDBProcessor) RestoreState(collection string, records []interface{}) error {
+	c, err := m.stateCollection(collection)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	var operations []mongo.WriteModel
+	for _, record := range records {
+		AddReplaceOneModelIntoOperations(&operations, record)
+	}
+	_, err = c.BulkWrite(m.ctx, operations)
+	if err != nil {
+		m.log.Error("[RestoreState] Failed to restore records",
+			"Collection", collection,
+			"Error", err.Error())
+	}
+	return err
+}
+
+func (m *MongoDBProcessor) DeleteState(collection string, records []interface{}) error {
+	c, err := m.stateCollection(collection)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	var operations []mongo.WriteModel
+	for _, record := range records {
+		AddDeleteOneModelIntoOperations(&operations, naturalKeyFilter(record))
+	}
+	_, err = c.BulkWrite(m.ctx, operations)
+	if err != nil {
+		m.log.Error("[DeleteState] Failed to delete records",
+			"Collection", collection,
+			"Error", err.Error())
+	}
+	return err
+}
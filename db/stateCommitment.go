@@ -0,0 +1,134 @@
+package db
+
+import (
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetStateHash returns the state hash as of blockNumber, which is the zero
+// hash before any balance was changed.
+func GetStateHash(r StoreReader, blockNumber int64) (common.Hash, error) {
+	c, err := r.GetStateCommitment(blockNumber)
+	if err == ErrNotFound {
+		return common.Hash{}, nil
+	} else if err != nil {
+		return common.Hash{}, err
+	}
+	return c.Hash, nil
+}
+
+func (m *MongoDBProcessor) GetStateCommitment(blockNumber int64) (*models.StateCommitment, error) {
+	o := options.FindOne().SetSort(bson.D{{Key: "blockNumber", Value: -1}})
+	result := m.stateCommitmentsCollection.FindOne(m.ctx,
+		bson.M{"blockNumber": bson.M{"$lte": blockNumber}}, o)
+	if result.Err() != nil {
+		return nil, notFound(result.Err())
+	}
+	c := &models.StateCommitment{}
+	if err := result.Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// backfillStateCommitments computes the state commitments of the blocks
+// indexed before they were tracked from the balance ledger, block by block,
+// and sets the state hash of the retained blocks.
+func (m *MongoDBProcessor) backfillStateCommitments() error {
+	o := options.Find().SetSort(bson.D{{Key: "blockNumber", Value: 1}})
+	cursor, err := m.balanceChangesCollection.Find(m.ctx, bson.M{}, o)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	var operations []mongo.WriteModel
+	write := func() error {
+		if len(operations) == 0 {
+			return nil
+		}
+		_, err := m.stateCommitmentsCollection.BulkWrite(m.ctx, operations)
+		operations = operations[:0]
+		return err
+	}
+
+	var prevHash common.Hash
+	var balanceChanges []*models.BalanceChange
+	commit := func() error {
+		if len(balanceChanges) == 0 {
+			return nil
+		}
+		blockNumber := balanceChanges[0].BlockNumber
+		var blockHash common.Hash
+		if b, err := m.GetBlockByNumber(blockNumber); err == nil {
+			blockHash = b.Hash
+		} else if err != ErrNotFound {
+			return err
+		}
+		c := models.NewStateCommitment(blockNumber, blockHash, prevHash, balanceChanges)
+		AddReplaceOneModelIntoOperations(&operations, c)
+		prevHash = c.Hash
+		balanceChanges = nil
+		if len(operations) == 1000 {
+			return write()
+		}
+		return nil
+	}
+
+	for cursor.Next(m.ctx) {
+		balanceChange := &models.BalanceChange{}
+		if err := cursor.Decode(balanceChange); err != nil {
+			return err
+		}
+		if len(balanceChanges) > 0 && balanceChanges[0].BlockNumber != balanceChange.BlockNumber {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+		balanceChanges = append(balanceChanges, balanceChange)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return m.backfillBlockStateHashes()
+}
+
+func (m *MongoDBProcessor) backfillBlockStateHashes() error {
+	cursor, err := m.blocksCollection.Find(m.ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(m.ctx)
+
+	var operations []mongo.WriteModel
+	for cursor.Next(m.ctx) {
+		b := &models.Block{}
+		if err := cursor.Decode(b); err != nil {
+			return err
+		}
+		stateHash, err := GetStateHash(m, b.Number)
+		if err != nil {
+			return err
+		}
+		operations = append(operations, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"number": b.Number}).
+			SetUpdate(bson.M{"$set": bson.M{"stateHash": stateHash}}))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if len(operations) == 0 {
+		return nil
+	}
+	_, err = m.blocksCollection.BulkWrite(m.ctx, operations)
+	return err
+}
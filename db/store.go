@@ -0,0 +1,75 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// ErrNotFound is returned by Store lookups when no matching record exists.
+var ErrNotFound = errors.New("not found")
+
+// StoreReader is the read side of a Store, which is all the token accounting
+// needs to compute the changes made by a block.
+type StoreReader interface {
+	GetLastBlock() (*models.Block, error)
+	GetBlockByNumber(number int64) (*models.Block, error)
+	GetCheckpoint() (*models.Checkpoint, error)
+	GetTokenTxsByBlockNumber(blockNumber int64) ([]*models.TokenTx, error)
+	GetTransferTokenTxsByBlockNumber(blockNumber int64) ([]*models.TransferTokenTx, error)
+	GetTokenTx(txHash common.Hash) (*models.TokenTx, error)
+	GetTokenHolder(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error)
+	GetUndoRecord(blockNumber int64) (*models.UndoRecord, error)
+	GetTokenStats(tokenTxHash common.Hash) (*models.TokenStats, error)
+	// GetStateCommitment returns the last state commitment at or below
+	// blockNumber
+	GetStateCommitment(blockNumber int64) (*models.StateCommitment, error)
+}
+
+// ErrTimestampUnknown is returned for a balance at a timestamp which
+// predates the block timestamps known to the balance ledger.
+var ErrTimestampUnknown = errors.New("balance at timestamp unknown, as the ledger was backfilled without block timestamps")
+
+// BalanceLedgerReader answers historical balance queries from the balance
+// ledger. An address without ledger entries by then had a balance of 0.
+type BalanceLedgerReader interface {
+	// GetBalanceAtHeight returns the balance after the block blockNumber
+	GetBalanceAtHeight(tokenTxHash common.Hash, address common.Address, blockNumber int64) (common.Amount, error)
+	// GetBalanceAtTimestamp returns the balance after the last block with a
+	// timestamp at or before timestamp
+	GetBalanceAtTimestamp(tokenTxHash common.Hash, address common.Address, timestamp uint64) (common.Amount, error)
+	// GetBalancesAtHeight returns, for every address holding the token after
+	// the block blockNumber, the last ledger entry up to that block
+	GetBalancesAtHeight(tokenTxHash common.Hash, blockNumber int64) ([]*models.BalanceChange, error)
+}
+
+// FinalityReader answers queries whose results carry their finality, counted
+// against the indexed tip.
+type FinalityReader interface {
+	GetTipNumber() (int64, error)
+	GetTokenTxWithFinality(txHash common.Hash) (*models.TokenTx, error)
+	GetTransferTokenTxWithFinality(txHash common.Hash) (*models.TransferTokenTx, error)
+	GetTokenHolderWithFinality(tokenTxHash common.Hash, address common.Address) (*models.TokenHolder, error)
+	// GetTokenHolderBalance returns the balance of address ignoring the
+	// changes of blocks with less than minConfirmations confirmations
+	GetTokenHolderBalance(tokenTxHash common.Hash, address common.Address,
+		minConfirmations uint64) (*models.TokenHolderBalance, error)
+}
+
+// Store persists the indexed chain. ProcessBlock and RevertLastBlock must
+// apply all the changes of a block atomically. ProcessBlock returns a
+// ProcessingError if the block cannot be applied to the indexed state.
+type Store interface {
+	StoreReader
+	BalanceLedgerReader
+	FinalityReader
+	StateDumper
+	StateRestorer
+	StateRepairer
+	ProcessingFailureStore
+
+	ProcessBlock(b *generated.Block) error
+	RevertLastBlock() error
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+)
+
+// ComputeTokenStats computes the stats of every token from the token txs and
+// token holders dumped by d, in the order of the token txs.
+func ComputeTokenStats(d StateDumper) ([]*models.TokenStats, error) {
+	var tokenStats []*models.TokenStats
+	byToken := make(map[common.Hash]*models.TokenStats)
+	err := d.DumpState(StateTokenTxs, func(record interface{}) error {
+		s, err := models.NewTokenStatsFromTokenTx(record.(*models.TokenTx))
+		if err != nil {
+			return err
+		}
+		tokenStats = append(tokenStats, s)
+		byToken[s.TokenTxHash] = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.DumpState(StateTokenHolders, func(record interface{}) error {
+		tokenHolder := record.(*models.TokenHolder)
+		s, ok := byToken[tokenHolder.TokenTxHash]
+		if !ok {
+			return fmt.Errorf("token holder %s of unknown token %s",
+				tokenHolder.Address.ToString(), tokenHolder.TokenTxHash.ToString())
+		}
+		return s.Update(0, tokenHolder.Amount)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenStats, nil
+}
+
+// backfillTokenStats computes the stats of the tokens indexed before they
+// were tracked. Tokens whose supply is already off are only reported, so that
+// processing stops at the next block changing them.
+func (m *MongoDBProcessor) backfillTokenStats() error {
+	tokenStats, err := ComputeTokenStats(m)
+	if err != nil {
+		return err
+	}
+	records := make([]interface{}, 0, len(tokenStats))
+	for _, s := range tokenStats {
+		if err := s.CheckSupply(); err != nil {
+			m.log.Warn("[backfillTokenStats] Supply invariant already broken",
+				"Error", err.Error())
+		}
+		records = append(records, s)
+	}
+	return m.RestoreState(StateTokenStats, records)
+}
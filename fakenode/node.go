@@ -0,0 +1,208 @@
+// Package fakenode is an in-process QRL node serving a scripted chain through
+// the PublicAPI, to test the indexer end to end without a Python node.
+package fakenode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"google.golang.org/grpc"
+)
+
+// GenesisTimestamp is the timestamp of the genesis block. Each following
+// block is a minute later.
+const GenesisTimestamp = 1530004179
+
+// Node serves the blocks of a scripted chain. A block is derived from its
+// parent, number, branch and txs only, so a script always yields the same
+// chain.
+type Node struct {
+	generated.UnimplementedPublicAPIServer
+
+	lock sync.RWMutex
+	// blocks is the canonical chain, by block number
+	blocks []*generated.Block
+	// known are all the blocks ever appended, including those forked away
+	known map[common.Hash]*generated.Block
+	// branch is changed by every fork, so that the blocks appended after a
+	// fork differ from those they replace
+	branch uint64
+
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// NewNode returns a node whose chain only has the genesis block.
+func NewNode() *Node {
+	n := &Node{
+		known: make(map[common.Hash]*generated.Block),
+	}
+	n.Append()
+	return n
+}
+
+// Start serves the PublicAPI on a free local port, returned by Addr.
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	n.server = grpc.NewServer()
+	generated.RegisterPublicAPIServer(n.server, n)
+	go n.server.Serve(listener)
+	return nil
+}
+
+func (n *Node) Addr() string {
+	return n.listener.Addr().String()
+}
+
+func (n *Node) Stop() {
+	n.server.Stop()
+}
+
+// Append adds a block with txs on top of the chain, and returns it.
+func (n *Node) Append(txs ...*generated.Transaction) *generated.Block {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	number := uint64(len(n.blocks))
+	var prevHash []byte
+	if number > 0 {
+		prevHash = n.blocks[number-1].Header.HashHeader
+	}
+
+	h := sha256.New()
+	h.Write(prevHash)
+	binary.Write(h, binary.BigEndian, number)
+	binary.Write(h, binary.BigEndian, n.branch)
+	for _, tx := range txs {
+		h.Write(tx.TransactionHash)
+	}
+
+	b := &generated.Block{
+		Header: &generated.BlockHeader{
+			HashHeader:       h.Sum(nil),
+			BlockNumber:      number,
+			TimestampSeconds: GenesisTimestamp + 60*number,
+			HashHeaderPrev:   prevHash,
+		},
+		Transactions: txs,
+	}
+	n.blocks = append(n.blocks, b)
+	n.known[misc.ToSizedHash(b.Header.HashHeader)] = b
+	return b
+}
+
+// Push adds blocks built elsewhere, e.g. by a chaingen.Generator, on top of
+// the chain. A block replaces the block at its number and those above it, so
+// pushing a fork makes it the chain.
+func (n *Node) Push(blocks ...*generated.Block) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, b := range blocks {
+		number := b.Header.BlockNumber
+		if number > uint64(len(n.blocks)) {
+			return fmt.Errorf("block #%d pushed above height %d", number, len(n.blocks)-1)
+		}
+		if number > 0 && !bytes.Equal(b.Header.HashHeaderPrev, n.blocks[number-1].Header.HashHeader) {
+			return fmt.Errorf("block #%d doesn't extend block #%d", number, number-1)
+		}
+		n.blocks = append(n.blocks[:number], b)
+		n.known[misc.ToSizedHash(b.Header.HashHeader)] = b
+	}
+	return nil
+}
+
+// AppendEmpty adds count blocks without txs on top of the chain.
+func (n *Node) AppendEmpty(count int) {
+	for i := 0; i < count; i++ {
+		n.Append()
+	}
+}
+
+// Fork discards the blocks above height. Blocks appended afterwards differ
+// from the discarded ones, even with the same txs.
+func (n *Node) Fork(height uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if height+1 < uint64(len(n.blocks)) {
+		n.blocks = n.blocks[:height+1]
+	}
+	n.branch++
+}
+
+// Drop discards the last count blocks, keeping at least the genesis block.
+// Appending the same txs again yields the same blocks.
+func (n *Node) Drop(count int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	keep := len(n.blocks) - count
+	if keep < 1 {
+		keep = 1
+	}
+	n.blocks = n.blocks[:keep]
+}
+
+func (n *Node) Height() uint64 {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return uint64(len(n.blocks) - 1)
+}
+
+// Block returns the block at number on the chain, or nil.
+func (n *Node) Block(number uint64) *generated.Block {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if number >= uint64(len(n.blocks)) {
+		return nil
+	}
+	return n.blocks[number]
+}
+
+func (n *Node) GetNodeState(context.Context, *generated.GetNodeStateReq) (*generated.GetNodeStateResp, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	last := n.blocks[len(n.blocks)-1]
+	return &generated.GetNodeStateResp{
+		Info: &generated.NodeInfo{
+			Version:       "fakenode",
+			State:         generated.NodeInfo_SYNCED,
+			BlockHeight:   last.Header.BlockNumber,
+			BlockLastHash: last.Header.HashHeader,
+			NetworkId:     "fakenode",
+		},
+	}, nil
+}
+
+func (n *Node) GetHeight(context.Context, *generated.GetHeightReq) (*generated.GetHeightResp, error) {
+	return &generated.GetHeightResp{Height: n.Height()}, nil
+}
+
+// GetBlock returns any block ever appended, like a node keeps the blocks of
+// forks it has seen.
+func (n *Node) GetBlock(_ context.Context, req *generated.GetBlockReq) (*generated.GetBlockResp, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return &generated.GetBlockResp{Block: n.known[misc.ToSizedHash(req.HeaderHash)]}, nil
+}
+
+func (n *Node) GetBlockByNumber(_ context.Context, req *generated.GetBlockByNumberReq) (*generated.GetBlockByNumberResp, error) {
+	return &generated.GetBlockByNumberResp{Block: n.Block(req.BlockNumber)}, nil
+}
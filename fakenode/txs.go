@@ -0,0 +1,74 @@
+package fakenode
+
+import (
+	"crypto/sha256"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+// NewAddress returns an address derived from seed, with the layout of an
+// XMSS address: a descriptor, a hash and a checksum.
+func NewAddress(seed string) common.Address {
+	var address common.Address
+	address[0] = 0x01
+	address[1] = 0x06
+	hash := sha256.Sum256([]byte(seed))
+	copy(address[3:35], hash[:])
+	checksum := sha256.Sum256(address[:35])
+	copy(address[35:], checksum[28:])
+	return address
+}
+
+// NewTxHash returns a tx hash derived from seed.
+func NewTxHash(seed string) common.Hash {
+	return sha256.Sum256([]byte("tx:" + seed))
+}
+
+// NewTokenTx returns a tx creating a token, whose hash is derived from seed.
+func NewTokenTx(seed string, symbol string, decimals uint64, owner common.Address,
+	holders []common.Address, amounts []uint64) *generated.Transaction {
+	initialBalances := make([]*generated.AddressAmount, len(holders))
+	for i, holder := range holders {
+		initialBalances[i] = &generated.AddressAmount{
+			Address: append([]byte(nil), holder[:]...),
+			Amount:  amounts[i],
+		}
+	}
+	txHash := NewTxHash(seed)
+	return &generated.Transaction{
+		MasterAddr:      append([]byte(nil), owner[:]...),
+		TransactionHash: txHash[:],
+		TransactionType: &generated.Transaction_Token_{
+			Token: &generated.Transaction_Token{
+				Symbol:          []byte(symbol),
+				Name:            []byte(symbol),
+				Owner:           append([]byte(nil), owner[:]...),
+				Decimals:        decimals,
+				InitialBalances: initialBalances,
+			},
+		},
+	}
+}
+
+// NewTransferTokenTx returns a transfer of the token created by tokenTxHash,
+// whose hash is derived from seed.
+func NewTransferTokenTx(seed string, tokenTxHash common.Hash, from common.Address,
+	to []common.Address, amounts []uint64) *generated.Transaction {
+	addrsTo := make([][]byte, len(to))
+	for i, address := range to {
+		addrsTo[i] = append([]byte(nil), address[:]...)
+	}
+	txHash := NewTxHash(seed)
+	return &generated.Transaction{
+		MasterAddr:      append([]byte(nil), from[:]...),
+		TransactionHash: txHash[:],
+		TransactionType: &generated.Transaction_TransferToken_{
+			TransferToken: &generated.Transaction_TransferToken{
+				TokenTxhash: append([]byte(nil), tokenTxHash[:]...),
+				AddrsTo:     addrsTo,
+				Amounts:     amounts,
+			},
+		},
+	}
+}
@@ -3,11 +3,13 @@ module github.com/cyyber/qrl-token-indexer
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	go.mongodb.org/mongo-driver v1.11.7
 	golang.org/x/crypto v0.10.0
 	google.golang.org/genproto v0.0.0-20230306155012-7f2fa6fef1f4
 	google.golang.org/grpc v1.55.0
 	google.golang.org/protobuf v1.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,153 @@
+// Package holders reconstructs the holder set of a token at a given height
+// from the balance ledger, for airdrops and votes.
+package holders
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+)
+
+// Reader is what a snapshot is built from, implemented by every db.Store.
+type Reader interface {
+	db.StoreReader
+	db.BalanceLedgerReader
+}
+
+type Holder struct {
+	Address string `json:"address"`
+	// Balance is in whole tokens, with the decimals of the token applied
+	Balance    string        `json:"balance"`
+	RawBalance common.Amount `json:"rawBalance,string"`
+	// LastChangeBlockNumber is the last block up to the snapshot height in
+	// which the balance changed
+	LastChangeBlockNumber int64 `json:"lastChangeBlockNumber"`
+}
+
+// Checksum lets consumers check a snapshot is complete: the balances of all
+// holders add up to the total supply of the token.
+type Checksum struct {
+	HolderCount    int    `json:"holderCount"`
+	TotalBalance   string `json:"totalBalance"`
+	TotalSupply    string `json:"totalSupply"`
+	RawTotalSupply string `json:"rawTotalSupply"`
+}
+
+// Snapshot is the complete holder set of a token after the block BlockNumber.
+type Snapshot struct {
+	TokenTxHash string    `json:"tokenTxHash"`
+	Name        string    `json:"name"`
+	Decimals    uint64    `json:"decimals"`
+	BlockNumber int64     `json:"blockNumber"`
+	Holders     []*Holder `json:"holders"`
+	Checksum    *Checksum `json:"checksum"`
+}
+
+// NewSnapshot builds the snapshot of the token created by tokenTxHash after
+// the block blockNumber, which must already be indexed. It fails if the
+// balances don't add up to the total supply.
+func NewSnapshot(r Reader, tokenTxHash common.Hash, blockNumber int64) (*Snapshot, error) {
+	checkpoint, err := r.GetCheckpoint()
+	if err == db.ErrNotFound {
+		return nil, fmt.Errorf("block #%d not indexed yet", blockNumber)
+	} else if err != nil {
+		return nil, err
+	}
+	if blockNumber > checkpoint.BlockNumber {
+		return nil, fmt.Errorf("block #%d not indexed yet, last indexed block #%d",
+			blockNumber, checkpoint.BlockNumber)
+	}
+
+	tokenTx, err := r.GetTokenTx(tokenTxHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token %s: %w", tokenTxHash.ToString(), err)
+	}
+	if tokenTx.BlockNumber > blockNumber {
+		return nil, fmt.Errorf("token %s created in block #%d after block #%d",
+			tokenTxHash.ToString(), tokenTx.BlockNumber, blockNumber)
+	}
+	decimals := uint64(tokenTx.Decimals)
+
+	balanceChanges, err := r.GetBalancesAtHeight(tokenTxHash, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(balanceChanges, func(i, j int) bool {
+		return bytes.Compare(balanceChanges[i].Address[:], balanceChanges[j].Address[:]) < 0
+	})
+
+	s := &Snapshot{
+		TokenTxHash: tokenTxHash.ToString(),
+		Name:        string(tokenTx.Name),
+		Decimals:    decimals,
+		BlockNumber: blockNumber,
+	}
+	totalBalance := new(big.Int)
+	for _, balanceChange := range balanceChanges {
+		s.Holders = append(s.Holders, newHolder(balanceChange, decimals))
+		totalBalance.Add(totalBalance, new(big.Int).SetUint64(uint64(balanceChange.Balance)))
+	}
+
+	// Tokens are neither minted nor burnt after creation
+	totalSupply := new(big.Int)
+	for _, amount := range tokenTx.Amounts {
+		totalSupply.Add(totalSupply, new(big.Int).SetUint64(uint64(amount)))
+	}
+	if totalBalance.Cmp(totalSupply) != 0 {
+		return nil, fmt.Errorf("balances of token %s at block #%d add up to %s instead of the total supply %s",
+			tokenTxHash.ToString(), blockNumber, totalBalance, totalSupply)
+	}
+	s.Checksum = &Checksum{
+		HolderCount:    len(s.Holders),
+		TotalBalance:   common.FormatUnits(totalBalance, decimals),
+		TotalSupply:    common.FormatUnits(totalSupply, decimals),
+		RawTotalSupply: totalSupply.String(),
+	}
+	return s, nil
+}
+
+func newHolder(balanceChange *models.BalanceChange, decimals uint64) *Holder {
+	return &Holder{
+		Address:               "Q" + hex.EncodeToString(balanceChange.Address[:]),
+		Balance:               balanceChange.Balance.Format(decimals),
+		RawBalance:            balanceChange.Balance,
+		LastChangeBlockNumber: balanceChange.BlockNumber,
+	}
+}
+
+func (s *Snapshot) WriteJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(s)
+}
+
+// WriteCSV writes a row per holder, followed by the total supply checksum row.
+func (s *Snapshot) WriteCSV(w io.Writer) error {
+	c := csv.NewWriter(w)
+	records := [][]string{{"address", "balance", "raw_balance", "last_change_block_number"}}
+	for _, h := range s.Holders {
+		records = append(records, []string{
+			h.Address,
+			h.Balance,
+			strconv.FormatUint(uint64(h.RawBalance), 10),
+			strconv.FormatInt(h.LastChangeBlockNumber, 10),
+		})
+	}
+	records = append(records, []string{
+		"total_supply",
+		s.Checksum.TotalSupply,
+		s.Checksum.RawTotalSupply,
+		strconv.FormatInt(s.BlockNumber, 10),
+	})
+	return c.WriteAll(records)
+}
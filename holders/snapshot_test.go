@@ -0,0 +1,189 @@
+package holders
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+var (
+	alice = testutil.Alice
+	bob   = testutil.Bob
+	carol = testutil.Carol
+)
+
+// newTokenStore indexes the chain of testutil.NewTokenNode, on which bob sends
+// the remaining 2.00 to carol in block 4.
+func newTokenStore(t *testing.T) (*memory.MemoryStore, common.Hash) {
+	t.Helper()
+	node := testutil.NewTokenNode()
+	node.Append(fakenode.NewTransferTokenTx("transfer-3", testutil.TokenTxHash, bob,
+		[]common.Address{carol}, []uint64{200}))
+
+	s := memory.NewMemoryStore(config.DefaultConfig())
+	testutil.Index(t, s, node)
+	return s, testutil.TokenTxHash
+}
+
+func qAddress(address common.Address) string {
+	return "Q" + hex.EncodeToString(address[:])
+}
+
+func TestNewSnapshot(t *testing.T) {
+	s, tokenTxHash := newTokenStore(t)
+
+	for _, test := range []struct {
+		blockNumber int64
+		want        map[common.Address]Holder
+	}{
+		{1, map[common.Address]Holder{
+			alice: {Balance: "10.00", RawBalance: 1000, LastChangeBlockNumber: 1},
+			carol: {Balance: "0.05", RawBalance: 5, LastChangeBlockNumber: 1},
+		}},
+		{2, map[common.Address]Holder{
+			alice: {Balance: "7.00", RawBalance: 700, LastChangeBlockNumber: 2},
+			bob:   {Balance: "3.00", RawBalance: 300, LastChangeBlockNumber: 2},
+			carol: {Balance: "0.05", RawBalance: 5, LastChangeBlockNumber: 1},
+		}},
+		{3, map[common.Address]Holder{
+			alice: {Balance: "7.00", RawBalance: 700, LastChangeBlockNumber: 2},
+			bob:   {Balance: "2.00", RawBalance: 200, LastChangeBlockNumber: 3},
+			carol: {Balance: "1.05", RawBalance: 105, LastChangeBlockNumber: 3},
+		}},
+		// bob no longer holds any
+		{4, map[common.Address]Holder{
+			alice: {Balance: "7.00", RawBalance: 700, LastChangeBlockNumber: 2},
+			carol: {Balance: "3.05", RawBalance: 305, LastChangeBlockNumber: 4},
+		}},
+	} {
+		snapshot, err := NewSnapshot(s, tokenTxHash, test.blockNumber)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.BlockNumber != test.blockNumber || snapshot.Decimals != 2 || snapshot.Name != "TKN" {
+			t.Fatalf("snapshot of %s with %d decimals at #%d, want TKN with 2 decimals at #%d",
+				snapshot.Name, snapshot.Decimals, snapshot.BlockNumber, test.blockNumber)
+		}
+		if len(snapshot.Holders) != len(test.want) {
+			t.Fatalf("%d holders at #%d, want %d", len(snapshot.Holders), test.blockNumber, len(test.want))
+		}
+		for i, holder := range snapshot.Holders {
+			if i > 0 && snapshot.Holders[i-1].Address >= holder.Address {
+				t.Fatalf("holders at #%d not sorted by address", test.blockNumber)
+			}
+			var want Holder
+			for address, h := range test.want {
+				if qAddress(address) == holder.Address {
+					want = h
+					want.Address = holder.Address
+				}
+			}
+			if *holder != want {
+				t.Errorf("holder at #%d %+v, want %+v", test.blockNumber, *holder, want)
+			}
+		}
+		want := Checksum{HolderCount: len(test.want), TotalBalance: "10.05", TotalSupply: "10.05",
+			RawTotalSupply: "1005"}
+		if *snapshot.Checksum != want {
+			t.Errorf("checksum at #%d %+v, want %+v", test.blockNumber, *snapshot.Checksum, want)
+		}
+	}
+}
+
+func TestNewSnapshotHeight(t *testing.T) {
+	s, tokenTxHash := newTokenStore(t)
+	for _, test := range []struct {
+		blockNumber int64
+		err         string
+	}{
+		{0, "created in block #1 after block #0"},
+		{5, "not indexed yet"},
+	} {
+		if _, err := NewSnapshot(s, tokenTxHash, test.blockNumber); err == nil ||
+			!strings.Contains(err.Error(), test.err) {
+			t.Errorf("snapshot at #%d: %v, want %q", test.blockNumber, err, test.err)
+		}
+	}
+	if _, err := NewSnapshot(s, fakenode.NewTxHash("unknown"), 4); err == nil {
+		t.Error("snapshot of unknown token")
+	}
+}
+
+func TestNewSnapshotInconsistentLedger(t *testing.T) {
+	s, tokenTxHash := newTokenStore(t)
+	// A ledger entry losing what carol received in block 3
+	balanceChange := &models.BalanceChange{TokenTxHash: tokenTxHash, Address: carol, BlockNumber: 3,
+		TxIndex: 100, Sent: 100, Balance: 5}
+	if err := s.RestoreState(db.StateBalanceChanges, []interface{}{balanceChange}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSnapshot(s, tokenTxHash, 3); err == nil || !strings.Contains(err.Error(), "total supply") {
+		t.Fatalf("snapshot of inconsistent ledger: %v", err)
+	}
+	// Earlier heights are unaffected
+	if _, err := NewSnapshot(s, tokenTxHash, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	s, tokenTxHash := newTokenStore(t)
+	snapshot, err := NewSnapshot(s, tokenTxHash, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := snapshot.WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(snapshot.Holders)+2 {
+		t.Fatalf("%d CSV rows, want %d", len(records), len(snapshot.Holders)+2)
+	}
+	if header := strings.Join(records[0], ","); header != "address,balance,raw_balance,last_change_block_number" {
+		t.Errorf("CSV header %s", header)
+	}
+	for i, holder := range snapshot.Holders {
+		want := fmt.Sprintf("%s,%s,%d,%d", holder.Address, holder.Balance, holder.RawBalance,
+			holder.LastChangeBlockNumber)
+		if row := strings.Join(records[i+1], ","); row != want {
+			t.Errorf("CSV row %s, want %s", row, want)
+		}
+	}
+	if row := strings.Join(records[len(records)-1], ","); row != "total_supply,10.05,1005,2" {
+		t.Errorf("CSV checksum row %s", row)
+	}
+
+	b.Reset()
+	if err := snapshot.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	decoded := &Snapshot{}
+	if err := json.Unmarshal(b.Bytes(), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Holders) != len(snapshot.Holders) || *decoded.Checksum != *snapshot.Checksum {
+		t.Fatalf("JSON snapshot decoded as %+v", decoded)
+	}
+	for i, holder := range decoded.Holders {
+		if *holder != *snapshot.Holders[i] {
+			t.Errorf("JSON holder %+v, want %+v", *holder, *snapshot.Holders[i])
+		}
+	}
+}
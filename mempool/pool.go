@@ -0,0 +1,271 @@
+package mempool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/log"
+	"github.com/cyyber/qrl-token-indexer/misc"
+)
+
+// Maximum number of transactions returned by GetLatestData in a single request
+const maxLatestDataQuantity = 100
+
+// PendingTx is a Token or TransferToken transaction that has been seen in the
+// node's unconfirmed transaction pool but not yet in a processed block.
+// Exactly one of TokenTx and TransferTokenTx is set.
+type PendingTx struct {
+	TxHash          common.Hash
+	TokenTx         *models.TokenTx
+	TransferTokenTx *models.TransferTokenTx
+	FirstSeen       time.Time
+}
+
+// Pool tracks unconfirmed token transactions by polling the node.
+type Pool struct {
+	pac generated.PublicAPIClient
+
+	lock sync.RWMutex
+	wg   sync.WaitGroup
+
+	log log.LoggerInterface
+
+	pollInterval time.Duration
+	expiry       time.Duration
+
+	txs map[common.Hash]*PendingTx
+	// tombstones are the hashes of the expired and mined txs. Polls don't add
+	// them again until the node stops reporting them, as the node may keep
+	// reporting a tx for a while after it is mined, or until the block of a
+	// mined tx is reverted.
+	tombstones map[common.Hash]bool
+
+	quit chan struct{}
+}
+
+func NewPool(pac generated.PublicAPIClient, c *config.Config) *Pool {
+	return &Pool{
+		pac:          pac,
+		log:          log.GetLogger(),
+		pollInterval: c.PendingTxPollInterval,
+		expiry:       c.PendingTxExpiry,
+		txs:          make(map[common.Hash]*PendingTx),
+		tombstones:   make(map[common.Hash]bool),
+		quit:         make(chan struct{}),
+	}
+}
+
+func (p *Pool) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *Pool) Stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+func (p *Pool) run() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-time.After(p.pollInterval):
+			err := p.Poll()
+			if err != nil {
+				p.log.Error("[Pool] Failed to poll unconfirmed transactions",
+					"Error", err.Error())
+			}
+			p.RemoveExpired(time.Now())
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Poll requests all unconfirmed transactions from the node and adds the
+// Token and TransferToken transactions not yet known to the pool. Once all of
+// them are read, the tombstones of the txs no longer reported are dropped.
+func (p *Pool) Poll() error {
+	reported := make(map[common.Hash]bool)
+	for offset := uint32(0); ; offset += maxLatestDataQuantity {
+		resp, err := p.pac.GetLatestData(context.Background(),
+			&generated.GetLatestDataReq{
+				Filter:   generated.GetLatestDataReq_TRANSACTIONS_UNCONFIRMED,
+				Offset:   offset,
+				Quantity: maxLatestDataQuantity,
+			})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, txExtended := range resp.TransactionsUnconfirmed {
+			if txExtended.Tx == nil {
+				continue
+			}
+			reported[misc.ToSizedHash(txExtended.Tx.TransactionHash)] = true
+			p.Add(txExtended.Tx, now)
+		}
+
+		if len(resp.TransactionsUnconfirmed) < maxLatestDataQuantity {
+			p.dropTombstones(reported)
+			return nil
+		}
+	}
+}
+
+// dropTombstones drops the tombstones of the txs not in reported.
+func (p *Pool) dropTombstones(reported map[common.Hash]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for txHash := range p.tombstones {
+		if !reported[txHash] {
+			delete(p.tombstones, txHash)
+		}
+	}
+}
+
+// Add decodes protoTX and adds it to the pool if it is a Token or
+// TransferToken transaction which is neither already present nor expired or
+// mined.
+func (p *Pool) Add(protoTX *generated.Transaction, seen time.Time) {
+	if protoTX == nil {
+		return
+	}
+	txHash := misc.ToSizedHash(protoTX.TransactionHash)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.txs[txHash]; ok || p.tombstones[txHash] {
+		return
+	}
+
+	pendingTx := &PendingTx{
+		TxHash:    txHash,
+		FirstSeen: seen,
+	}
+	switch protoTX.TransactionType.(type) {
+	case *generated.Transaction_Token_:
+		pendingTx.TokenTx = models.NewTokenTxFromPBData(common.BLOCKZERO, protoTX)
+	case *generated.Transaction_TransferToken_:
+		pendingTx.TransferTokenTx = models.NewTransferTokenTxFromPBData(common.BLOCKZERO, protoTX)
+	default:
+		return
+	}
+	p.txs[txHash] = pendingTx
+	p.log.Debug("[Pool] Added pending token tx", "txhash", txHash.ToString())
+}
+
+// RemoveMinedTxs evicts all transactions included in the block b.
+func (p *Pool) RemoveMinedTxs(b *generated.Block) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, protoTX := range b.Transactions {
+		switch protoTX.TransactionType.(type) {
+		case *generated.Transaction_Token_, *generated.Transaction_TransferToken_:
+			txHash := misc.ToSizedHash(protoTX.TransactionHash)
+			delete(p.txs, txHash)
+			p.tombstones[txHash] = true
+		}
+	}
+}
+
+// RestoreRevertedTxs drops the tombstones of the txs of a reverted block, so
+// that they are pending again while the node reports them as unconfirmed.
+func (p *Pool) RestoreRevertedTxs(txHashes []common.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, txHash := range txHashes {
+		delete(p.tombstones, txHash)
+	}
+}
+
+// RemoveExpired evicts all transactions first seen more than the configured
+// expiry before now.
+func (p *Pool) RemoveExpired(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for txHash, pendingTx := range p.txs {
+		if now.Sub(pendingTx.FirstSeen) > p.expiry {
+			delete(p.txs, txHash)
+			p.tombstones[txHash] = true
+		}
+	}
+}
+
+func (p *Pool) Get(txHash common.Hash) *PendingTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.txs[txHash]
+}
+
+func (p *Pool) Len() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.txs)
+}
+
+// GetPendingIncomingTransfers returns the pending TransferToken transactions
+// with address as one of the recipients.
+func (p *Pool) GetPendingIncomingTransfers(address common.Address) []*models.TransferTokenTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var transferTokenTxs []*models.TransferTokenTx
+	for _, pendingTx := range p.txs {
+		if pendingTx.TransferTokenTx == nil {
+			continue
+		}
+		for _, to := range pendingTx.TransferTokenTx.Addresses {
+			if to == address {
+				transferTokenTxs = append(transferTokenTxs, pendingTx.TransferTokenTx)
+				break
+			}
+		}
+	}
+	return transferTokenTxs
+}
+
+// GetPendingOutgoingTransfers returns the pending TransferToken transactions
+// sent from address.
+func (p *Pool) GetPendingOutgoingTransfers(address common.Address) []*models.TransferTokenTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var transferTokenTxs []*models.TransferTokenTx
+	for _, pendingTx := range p.txs {
+		if pendingTx.TransferTokenTx == nil {
+			continue
+		}
+		if pendingTx.TransferTokenTx.From == address {
+			transferTokenTxs = append(transferTokenTxs, pendingTx.TransferTokenTx)
+		}
+	}
+	return transferTokenTxs
+}
+
+// GetPendingTokenTxs returns the pending Token creation transactions.
+func (p *Pool) GetPendingTokenTxs() []*models.TokenTx {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var tokenTxs []*models.TokenTx
+	for _, pendingTx := range p.txs {
+		if pendingTx.TokenTx != nil {
+			tokenTxs = append(tokenTxs, pendingTx.TokenTx)
+		}
+	}
+	return tokenTxs
+}
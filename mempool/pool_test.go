@@ -0,0 +1,137 @@
+package mempool
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"google.golang.org/grpc"
+)
+
+// unconfirmedClient reports txs as the unconfirmed txs of the node.
+type unconfirmedClient struct {
+	generated.PublicAPIClient
+	txs []*generated.Transaction
+}
+
+func (c *unconfirmedClient) GetLatestData(_ context.Context, req *generated.GetLatestDataReq,
+	_ ...grpc.CallOption) (*generated.GetLatestDataResp, error) {
+	resp := &generated.GetLatestDataResp{}
+	for i := int(req.Offset); i < len(c.txs) && i < int(req.Offset+req.Quantity); i++ {
+		resp.TransactionsUnconfirmed = append(resp.TransactionsUnconfirmed,
+			&generated.TransactionExtended{Tx: c.txs[i]})
+	}
+	return resp, nil
+}
+
+func newTestPool(t *testing.T, txs ...*generated.Transaction) (*Pool, *unconfirmedClient) {
+	t.Helper()
+	pac := &unconfirmedClient{txs: txs}
+	c := config.DefaultConfig()
+	c.PendingTxExpiry = time.Minute
+	return NewPool(pac, c), pac
+}
+
+func poll(t *testing.T, p *Pool) {
+	t.Helper()
+	if err := p.Poll(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertPending(t *testing.T, p *Pool, txHash common.Hash, want bool) {
+	t.Helper()
+	if got := p.Get(txHash) != nil; got != want {
+		t.Fatalf("tx %s pending %v, want %v", txHash.ToString(), got, want)
+	}
+}
+
+func newTransfer(seed string) *generated.Transaction {
+	return fakenode.NewTransferTokenTx(seed, fakenode.NewTxHash("token"), fakenode.NewAddress("alice"),
+		[]common.Address{fakenode.NewAddress("bob")}, []uint64{1})
+}
+
+func TestPollSkipsMinedTxs(t *testing.T) {
+	tx := newTransfer("mined")
+	txHash := fakenode.NewTxHash("mined")
+	p, pac := newTestPool(t, tx)
+
+	poll(t, p)
+	assertPending(t, p, txHash, true)
+
+	p.RemoveMinedTxs(&generated.Block{Transactions: []*generated.Transaction{tx}})
+	assertPending(t, p, txHash, false)
+
+	// The node still reports the tx for a while after it is mined
+	poll(t, p)
+	assertPending(t, p, txHash, false)
+
+	// Once the node stops reporting it, the tx may be pending again, e.g.
+	// after its block is forked away
+	pac.txs = nil
+	poll(t, p)
+	pac.txs = []*generated.Transaction{tx}
+	poll(t, p)
+	assertPending(t, p, txHash, true)
+}
+
+// TestPollRestoresRevertedTxs checks that a mined tx the node keeps reporting is
+// pending again once its block is reverted.
+func TestPollRestoresRevertedTxs(t *testing.T) {
+	tx := newTransfer("reverted")
+	txHash := fakenode.NewTxHash("reverted")
+	p, _ := newTestPool(t, tx)
+
+	poll(t, p)
+	p.RemoveMinedTxs(&generated.Block{Transactions: []*generated.Transaction{tx}})
+	poll(t, p)
+	assertPending(t, p, txHash, false)
+
+	p.RestoreRevertedTxs([]common.Hash{txHash})
+	assertPending(t, p, txHash, false)
+	poll(t, p)
+	assertPending(t, p, txHash, true)
+}
+
+func TestPollSkipsExpiredTxs(t *testing.T) {
+	tx := newTransfer("expired")
+	txHash := fakenode.NewTxHash("expired")
+	p, pac := newTestPool(t, tx)
+
+	poll(t, p)
+	p.RemoveExpired(time.Now().Add(2 * time.Minute))
+	assertPending(t, p, txHash, false)
+
+	poll(t, p)
+	assertPending(t, p, txHash, false)
+
+	pac.txs = nil
+	poll(t, p)
+	pac.txs = []*generated.Transaction{tx}
+	poll(t, p)
+	assertPending(t, p, txHash, true)
+}
+
+func TestPollPages(t *testing.T) {
+	var txs []*generated.Transaction
+	for i := 0; i < 2*maxLatestDataQuantity+1; i++ {
+		txs = append(txs, newTransfer(fmt.Sprintf("tx-%d", i)))
+	}
+	p, _ := newTestPool(t, txs...)
+	poll(t, p)
+	if p.Len() != len(txs) {
+		t.Fatalf("%d txs pending, want %d", p.Len(), len(txs))
+	}
+
+	// Tombstones reported on a later page are kept
+	p.RemoveMinedTxs(&generated.Block{Transactions: txs[len(txs)-1:]})
+	poll(t, p)
+	if p.Len() != len(txs)-1 {
+		t.Fatalf("%d txs pending, want %d", p.Len(), len(txs)-1)
+	}
+}
@@ -0,0 +1,353 @@
+// Package reconcile compares the token balances indexed for a set of
+// addresses with the balances reported by the node, which is the ground
+// truth of the consensus state.
+package reconcile
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/alert"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/log"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Number of tokens requested per GetTokensByAddress page
+	tokensPerPage = 100
+	// Attempts at reading the balances of an address while the node height
+	// doesn't change
+	maxAttempts = 3
+	// Maximum number of mismatches included in an alert
+	maxAlertedMismatches = 10
+)
+
+// Store is the indexer side of a reconciliation.
+type Store interface {
+	db.StoreReader
+	db.BalanceLedgerReader
+	GetTokenHoldersByAddress(address common.Address) ([]*models.TokenHolder, error)
+	SampleTokenHolderAddresses(size int) ([]common.Address, error)
+	InsertReconciliationReport(r *models.ReconciliationReport) error
+}
+
+type Reconciler struct {
+	pac     generated.PublicAPIClient
+	store   Store
+	alerter alert.Alerter
+
+	log log.LoggerInterface
+
+	interval   time.Duration
+	sampleSize int
+
+	wg   sync.WaitGroup
+	quit chan struct{}
+}
+
+func NewReconciler(pac generated.PublicAPIClient, store Store, alerter alert.Alerter, c *config.Config) *Reconciler {
+	return &Reconciler{
+		pac:        pac,
+		store:      store,
+		alerter:    alerter,
+		log:        log.GetLogger(),
+		interval:   c.ReconcileInterval,
+		sampleSize: c.ReconcileSampleSize,
+		quit:       make(chan struct{}),
+	}
+}
+
+// Start reconciles a sample of token holders every interval.
+func (r *Reconciler) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+func (r *Reconciler) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+func (r *Reconciler) run() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-time.After(r.interval):
+			if _, err := r.ReconcileSample(r.sampleSize); err != nil {
+				r.log.Error("[Reconciler] Failed to reconcile",
+					"Error", err.Error())
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// ReconcileSample reconciles up to size addresses picked at random among
+// the token holders.
+func (r *Reconciler) ReconcileSample(size int) (*models.ReconciliationReport, error) {
+	addresses, err := r.store.SampleTokenHolderAddresses(size)
+	if err != nil {
+		return nil, err
+	}
+	return r.reconcile(addresses, true)
+}
+
+// Reconcile compares the token balances of the given addresses, stores the
+// report and alerts on mismatches.
+func (r *Reconciler) Reconcile(addresses []common.Address) (*models.ReconciliationReport, error) {
+	return r.reconcile(addresses, false)
+}
+
+func (r *Reconciler) reconcile(addresses []common.Address, sampled bool) (*models.ReconciliationReport, error) {
+	report := &models.ReconciliationReport{
+		StartedAt: time.Now().UTC(),
+		Sampled:   sampled,
+	}
+	for _, address := range addresses {
+		a, err := r.reconcileAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reconcile %s: %w", address.ToString(), err)
+		}
+		report.Add(a)
+	}
+	report.FinishedAt = time.Now().UTC()
+
+	if err := r.store.InsertReconciliationReport(report); err != nil {
+		return nil, err
+	}
+	r.log.Info("Reconciled token balances with node",
+		"Matched", report.Matched,
+		"Mismatched", report.Mismatched,
+		"Skipped", report.Skipped)
+	if report.Mismatched > 0 {
+		r.alertMismatches(report)
+	}
+	return report, nil
+}
+
+func (r *Reconciler) alertMismatches(report *models.ReconciliationReport) {
+	var mismatches []string
+	for _, a := range report.Addresses {
+		for _, mismatch := range a.Mismatches {
+			if len(mismatches) == maxAlertedMismatches {
+				break
+			}
+			mismatches = append(mismatches, fmt.Sprintf("address %s token %s at block #%d: node %d, indexer %d",
+				a.Address.ToString(), mismatch.TokenTxHash.ToString(), a.BlockNumber,
+				mismatch.NodeBalance, mismatch.IndexerBalance))
+		}
+	}
+	err := r.alerter.Alert(alert.NewAlert("reconcile", alert.SeverityCritical,
+		"Indexed token balances disagree with the node",
+		map[string]interface{}{
+			"Mismatched": report.Mismatched,
+			"Checked":    len(report.Addresses),
+			"Mismatches": mismatches,
+		}))
+	if err != nil {
+		r.log.Error("[Reconciler] Failed to send alert",
+			"Error", err.Error())
+	}
+}
+
+func skipped(address common.Address, blockNumber int64, detail string) *models.AddressReconciliation {
+	return &models.AddressReconciliation{
+		Address:     address,
+		BlockNumber: blockNumber,
+		Status:      models.ReconciliationStatusSkipped,
+		Detail:      detail,
+	}
+}
+
+func (r *Reconciler) reconcileAddress(address common.Address) (*models.AddressReconciliation, error) {
+	// The balances are only meaningful at a known height, so they are read
+	// again if a block is added meanwhile
+	var nodeBalances map[common.Hash]common.Amount
+	var height uint64
+	stable := false
+	for attempt := 0; attempt < maxAttempts && !stable; attempt++ {
+		before, err := r.getHeight()
+		if err != nil {
+			return nil, err
+		}
+		nodeBalances, err = r.getNodeBalances(address)
+		if err != nil {
+			return nil, err
+		}
+		height, err = r.getHeight()
+		if err != nil {
+			return nil, err
+		}
+		stable = before == height
+	}
+	blockNumber := int64(height)
+	if !stable {
+		return skipped(address, blockNumber, "node height kept changing"), nil
+	}
+
+	checkpoint, err := r.store.GetCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if blockNumber > checkpoint.BlockNumber {
+		return skipped(address, blockNumber,
+			fmt.Sprintf("indexer at block #%d behind node", checkpoint.BlockNumber)), nil
+	}
+	sameChain, err := r.isSameChain(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if !sameChain {
+		return skipped(address, blockNumber, "indexer and node on different chains"), nil
+	}
+
+	tokenHolders, err := r.store.GetTokenHoldersByAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	indexerBalances := make(map[common.Hash]common.Amount)
+	for _, tokenHolder := range tokenHolders {
+		indexerBalances[tokenHolder.TokenTxHash] = tokenHolder.Amount
+		if blockNumber < checkpoint.BlockNumber {
+			// The indexer is ahead, so the balance at the node height is
+			// read from the ledger
+			balance, err := r.store.GetBalanceAtHeight(tokenHolder.TokenTxHash, address, blockNumber)
+			if err != nil {
+				return nil, err
+			}
+			indexerBalances[tokenHolder.TokenTxHash] = balance
+		}
+	}
+
+	a := &models.AddressReconciliation{
+		Address:     address,
+		BlockNumber: blockNumber,
+		Status:      models.ReconciliationStatusMatch,
+	}
+	tokens := make(map[common.Hash]bool)
+	for tokenTxHash := range nodeBalances {
+		tokens[tokenTxHash] = true
+	}
+	for tokenTxHash := range indexerBalances {
+		tokens[tokenTxHash] = true
+	}
+	for tokenTxHash := range tokens {
+		// Missing balances on either side are 0
+		nodeBalance := nodeBalances[tokenTxHash]
+		indexerBalance := indexerBalances[tokenTxHash]
+		a.Tokens++
+		if nodeBalance != indexerBalance {
+			a.Status = models.ReconciliationStatusMismatch
+			a.Mismatches = append(a.Mismatches, &models.BalanceMismatch{
+				TokenTxHash:    tokenTxHash,
+				NodeBalance:    nodeBalance,
+				IndexerBalance: indexerBalance,
+			})
+		}
+	}
+	return a, nil
+}
+
+// isSameChain reports whether the block indexed at blockNumber is the one on
+// the node. Blocks pruned by the indexer are beyond the reorg limit, and so
+// assumed to be the same.
+func (r *Reconciler) isSameChain(blockNumber int64) (bool, error) {
+	b, err := r.store.GetBlockByNumber(blockNumber)
+	if err == db.ErrNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp, err := r.pac.GetBlockByNumber(context.Background(),
+		&generated.GetBlockByNumberReq{BlockNumber: uint64(blockNumber)})
+	if err != nil {
+		return false, err
+	}
+	if resp.Block == nil || resp.Block.Header == nil {
+		return false, nil
+	}
+	return misc.ToSizedHash(resp.Block.Header.HashHeader) == b.Hash, nil
+}
+
+func (r *Reconciler) getHeight() (uint64, error) {
+	resp, err := r.pac.GetHeight(context.Background(), &generated.GetHeightReq{})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Height, nil
+}
+
+// getNodeBalances returns the non zero token balances of address on the node.
+func (r *Reconciler) getNodeBalances(address common.Address) (map[common.Hash]common.Amount, error) {
+	resp, err := r.pac.GetOptimizedAddressState(context.Background(),
+		&generated.GetAddressStateReq{Address: address[:]})
+	if status.Code(err) == codes.Unimplemented {
+		return r.getNodeBalancesFromAddressState(address)
+	} else if err != nil {
+		return nil, err
+	}
+	balances := make(map[common.Hash]common.Amount)
+	if resp.State == nil || resp.State.TokensCount == 0 {
+		return balances, nil
+	}
+
+	for page := uint64(1); ; page++ {
+		tokensResp, err := r.pac.GetTokensByAddress(context.Background(),
+			&generated.GetTransactionsByAddressReq{
+				Address:     address[:],
+				ItemPerPage: tokensPerPage,
+				PageNumber:  page,
+			})
+		if err != nil {
+			return nil, err
+		}
+		for _, tokenDetail := range tokensResp.TokensDetail {
+			if tokenDetail.Balance != 0 {
+				balances[misc.ToSizedHash(tokenDetail.TokenTxhash)] = common.Amount(tokenDetail.Balance)
+			}
+		}
+		if len(tokensResp.TokensDetail) < tokensPerPage {
+			return balances, nil
+		}
+	}
+}
+
+// getNodeBalancesFromAddressState reads the balances from the full address
+// state, for nodes without the optimized address state.
+func (r *Reconciler) getNodeBalancesFromAddressState(address common.Address) (map[common.Hash]common.Amount, error) {
+	resp, err := r.pac.GetAddressState(context.Background(),
+		&generated.GetAddressStateReq{
+			Address:                  address[:],
+			ExcludeOtsBitfield:       true,
+			ExcludeTransactionHashes: true,
+		})
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[common.Hash]common.Amount)
+	if resp.State == nil {
+		return balances, nil
+	}
+	// Tokens are keyed by the hex encoded token tx hash
+	for tokenTxHash, balance := range resp.State.Tokens {
+		decoded, err := hex.DecodeString(tokenTxHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token tx hash %s in address state: %w", tokenTxHash, err)
+		}
+		if balance != 0 {
+			balances[misc.ToSizedHash(decoded)] = common.Amount(balance)
+		}
+	}
+	return balances, nil
+}
@@ -0,0 +1,283 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/alert"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/generated"
+	"github.com/cyyber/qrl-token-indexer/misc"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var _ Store = (*memory.MemoryStore)(nil)
+
+var (
+	alice = testutil.Alice
+	bob   = testutil.Bob
+	carol = testutil.Carol
+)
+
+// nodeClient serves the chain of a fakenode.Node, with the token balances
+// set by the test as the address states of the node.
+type nodeClient struct {
+	generated.PublicAPIClient
+	node     *fakenode.Node
+	balances map[common.Address]map[common.Hash]uint64
+	// Set if the node has the optimized address state
+	optimized bool
+	// Set if a block is added every time the height is read
+	growing bool
+}
+
+func (c *nodeClient) GetHeight(ctx context.Context, req *generated.GetHeightReq,
+	_ ...grpc.CallOption) (*generated.GetHeightResp, error) {
+	if c.growing {
+		c.node.AppendEmpty(1)
+	}
+	return c.node.GetHeight(ctx, req)
+}
+
+func (c *nodeClient) GetBlockByNumber(ctx context.Context, req *generated.GetBlockByNumberReq,
+	_ ...grpc.CallOption) (*generated.GetBlockByNumberResp, error) {
+	return c.node.GetBlockByNumber(ctx, req)
+}
+
+// tokens returns the token balances of address, sorted by token tx hash.
+func (c *nodeClient) tokens(address []byte) []*generated.TokenDetail {
+	var tokens []*generated.TokenDetail
+	for tokenTxHash, balance := range c.balances[misc.ToSizedAddress(address)] {
+		tokenTxHash := tokenTxHash
+		tokens = append(tokens, &generated.TokenDetail{TokenTxhash: tokenTxHash[:], Balance: balance})
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return bytes.Compare(tokens[i].TokenTxhash, tokens[j].TokenTxhash) < 0
+	})
+	return tokens
+}
+
+func (c *nodeClient) GetOptimizedAddressState(_ context.Context, req *generated.GetAddressStateReq,
+	_ ...grpc.CallOption) (*generated.GetOptimizedAddressStateResp, error) {
+	if !c.optimized {
+		return nil, status.Error(codes.Unimplemented, "GetOptimizedAddressState")
+	}
+	return &generated.GetOptimizedAddressStateResp{
+		State: &generated.OptimizedAddressState{
+			Address:     req.Address,
+			TokensCount: uint64(len(c.tokens(req.Address))),
+		},
+	}, nil
+}
+
+func (c *nodeClient) GetTokensByAddress(_ context.Context, req *generated.GetTransactionsByAddressReq,
+	_ ...grpc.CallOption) (*generated.GetTokensByAddressResp, error) {
+	tokens := c.tokens(req.Address)
+	start := (req.PageNumber - 1) * req.ItemPerPage
+	if start > uint64(len(tokens)) {
+		start = uint64(len(tokens))
+	}
+	end := start + req.ItemPerPage
+	if end > uint64(len(tokens)) {
+		end = uint64(len(tokens))
+	}
+	return &generated.GetTokensByAddressResp{TokensDetail: tokens[start:end]}, nil
+}
+
+func (c *nodeClient) GetAddressState(_ context.Context, req *generated.GetAddressStateReq,
+	_ ...grpc.CallOption) (*generated.GetAddressStateResp, error) {
+	state := &generated.AddressState{Address: req.Address, Tokens: make(map[string]uint64)}
+	for _, token := range c.tokens(req.Address) {
+		state.Tokens[hex.EncodeToString(token.TokenTxhash)] = token.Balance
+	}
+	return &generated.GetAddressStateResp{State: state}, nil
+}
+
+type recordingAlerter struct {
+	alerts []*alert.Alert
+}
+
+func (r *recordingAlerter) Alert(a *alert.Alert) error {
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+// testChain indexes the chain of testutil.NewTokenNode.
+type testChain struct {
+	client      *nodeClient
+	store       *memory.MemoryStore
+	alerter     *recordingAlerter
+	reconciler  *Reconciler
+	tokenTxHash common.Hash
+}
+
+func newTestChain(t *testing.T) *testChain {
+	t.Helper()
+	c := &testChain{
+		client:      &nodeClient{node: testutil.NewTokenNode(), optimized: true},
+		store:       memory.NewMemoryStore(config.DefaultConfig()),
+		alerter:     &recordingAlerter{},
+		tokenTxHash: testutil.TokenTxHash,
+	}
+	testutil.Index(t, c.store, c.client.node)
+	c.setBalances(map[common.Address]uint64{alice: 700, bob: 200, carol: 105})
+	c.reconciler = NewReconciler(c.client, c.store, c.alerter, config.DefaultConfig())
+	return c
+}
+
+// setBalances sets the balances of the token on the node.
+func (c *testChain) setBalances(balances map[common.Address]uint64) {
+	c.client.balances = make(map[common.Address]map[common.Hash]uint64)
+	for address, balance := range balances {
+		c.client.balances[address] = map[common.Hash]uint64{c.tokenTxHash: balance}
+	}
+}
+
+func (c *testChain) reconcile(t *testing.T, addresses ...common.Address) *models.ReconciliationReport {
+	t.Helper()
+	report, err := c.reconciler.Reconcile(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Addresses) != len(addresses) {
+		t.Fatalf("%d addresses reconciled, want %d", len(report.Addresses), len(addresses))
+	}
+	return report
+}
+
+func assertStatus(t *testing.T, a *models.AddressReconciliation, status string, blockNumber int64) {
+	t.Helper()
+	if a.Status != status || a.BlockNumber != blockNumber {
+		t.Fatalf("%s reconciled as %s at #%d (%s), want %s at #%d", a.Address.ToString(), a.Status,
+			a.BlockNumber, a.Detail, status, blockNumber)
+	}
+}
+
+func TestReconcileMatch(t *testing.T) {
+	for _, optimized := range []bool{true, false} {
+		c := newTestChain(t)
+		c.client.optimized = optimized
+		report := c.reconcile(t, alice, bob, carol)
+		if report.Matched != 3 || report.Mismatched != 0 || report.Skipped != 0 || report.Sampled {
+			t.Fatalf("report %+v, want 3 matched", report)
+		}
+		for _, a := range report.Addresses {
+			assertStatus(t, a, models.ReconciliationStatusMatch, 3)
+			if a.Tokens != 1 {
+				t.Fatalf("%d tokens of %s compared, want 1", a.Tokens, a.Address.ToString())
+			}
+		}
+		if len(c.alerter.alerts) != 0 {
+			t.Fatalf("alerted %+v", c.alerter.alerts[0])
+		}
+	}
+}
+
+func TestReconcileMismatch(t *testing.T) {
+	c := newTestChain(t)
+	c.setBalances(map[common.Address]uint64{alice: 700, bob: 199, carol: 105})
+	// A token the indexer doesn't know of
+	otherTokenTxHash := fakenode.NewTxHash("other token")
+	c.client.balances[alice][otherTokenTxHash] = 10
+
+	report := c.reconcile(t, alice, bob, carol)
+	if report.Matched != 1 || report.Mismatched != 2 {
+		t.Fatalf("report %+v, want 1 matched and 2 mismatched", report)
+	}
+	for _, test := range []struct {
+		a    *models.AddressReconciliation
+		want models.BalanceMismatch
+	}{
+		{report.Addresses[0], models.BalanceMismatch{TokenTxHash: otherTokenTxHash, NodeBalance: 10}},
+		{report.Addresses[1], models.BalanceMismatch{TokenTxHash: c.tokenTxHash, NodeBalance: 199,
+			IndexerBalance: 200}},
+	} {
+		assertStatus(t, test.a, models.ReconciliationStatusMismatch, 3)
+		if len(test.a.Mismatches) != 1 || *test.a.Mismatches[0] != test.want {
+			t.Fatalf("mismatches of %s %+v, want %+v", test.a.Address.ToString(), test.a.Mismatches, test.want)
+		}
+	}
+	assertStatus(t, report.Addresses[2], models.ReconciliationStatusMatch, 3)
+
+	if len(c.alerter.alerts) != 1 {
+		t.Fatalf("%d alerts, want 1", len(c.alerter.alerts))
+	}
+	a := c.alerter.alerts[0]
+	if a.Severity != alert.SeverityCritical || a.Details["Mismatched"] != 2 {
+		t.Fatalf("alert %+v, want critical with 2 mismatched", a)
+	}
+}
+
+func TestReconcileIndexerAhead(t *testing.T) {
+	c := newTestChain(t)
+	// The node hasn't got the last indexed block yet, so the balances after
+	// block 2 are compared
+	c.client.node.Drop(1)
+	c.setBalances(map[common.Address]uint64{alice: 700, bob: 300, carol: 5})
+
+	report := c.reconcile(t, alice, bob, carol)
+	if report.Matched != 3 {
+		t.Fatalf("report %+v, want 3 matched", report)
+	}
+	for _, a := range report.Addresses {
+		assertStatus(t, a, models.ReconciliationStatusMatch, 2)
+	}
+}
+
+func TestReconcileSkipped(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		change      func(c *nodeClient)
+		blockNumber int64
+		detail      string
+	}{
+		{"behind", func(c *nodeClient) { c.node.AppendEmpty(1) }, 4, "behind node"},
+		{"fork", func(c *nodeClient) {
+			c.node.Fork(2)
+			c.node.AppendEmpty(1)
+		}, 3, "different chains"},
+		{"growing", func(c *nodeClient) { c.growing = true }, 3 + 2*maxAttempts, "kept changing"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestChain(t)
+			test.change(c.client)
+			report := c.reconcile(t, bob)
+			if report.Skipped != 1 {
+				t.Fatalf("report %+v, want 1 skipped", report)
+			}
+			a := report.Addresses[0]
+			assertStatus(t, a, models.ReconciliationStatusSkipped, test.blockNumber)
+			if !strings.Contains(a.Detail, test.detail) {
+				t.Fatalf("skipped as %q, want %q", a.Detail, test.detail)
+			}
+			if len(c.alerter.alerts) != 0 {
+				t.Fatalf("alerted %+v", c.alerter.alerts[0])
+			}
+		})
+	}
+}
+
+func TestReconcileSample(t *testing.T) {
+	c := newTestChain(t)
+	report, err := c.reconciler.ReconcileSample(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Sampled || report.Matched != 2 {
+		t.Fatalf("report %+v, want 2 sampled and matched", report)
+	}
+	if report.Addresses[0].Address == report.Addresses[1].Address {
+		t.Fatalf("%s sampled twice", report.Addresses[0].Address.ToString())
+	}
+}
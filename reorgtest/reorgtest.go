@@ -0,0 +1,254 @@
+// Package reorgtest checks that the indexer ends in the same state whether it
+// follows a chain through its forks or indexes the winning chain directly:
+// processing blocks A, reverting to the fork point and processing B must give
+// the same state as processing B.
+package reorgtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/client"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/misc"
+)
+
+// Scenario is a chain the indexer follows segment by segment. Each segment
+// after the first is a fork replacing the blocks at its heights.
+type Scenario struct {
+	Name  string
+	Chain *chaingen.Chain
+}
+
+// NewForkScenario generates a chain up to height, then a fork of each of the
+// given depths, each fork growing one block past the branch it abandons.
+func NewForkScenario(name string, c *chaingen.Config, height uint64, depths ...uint64) (*Scenario, error) {
+	g, err := chaingen.NewGenerator(c)
+	if err != nil {
+		return nil, err
+	}
+	for g.Height() < height {
+		g.Next()
+	}
+	for _, depth := range depths {
+		tip := g.Height()
+		g.Fork(depth)
+		for g.Height() <= tip {
+			g.Next()
+		}
+	}
+	return &Scenario{Name: name, Chain: g.Chain()}, nil
+}
+
+// NewRandomScenario generates a chain forking at random as configured.
+func NewRandomScenario(name string, c *chaingen.Config) (*Scenario, error) {
+	g, err := chaingen.NewGenerator(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Scenario{Name: name, Chain: g.Generate()}, nil
+}
+
+// Divergence is a record found in only one of the compared stores.
+type Divergence struct {
+	Collection string `json:"collection"`
+	// Store is either "replayed", the store which followed the forks, or
+	// "fresh", the store which indexed the winning chain directly
+	Store  string `json:"store"`
+	Record string `json:"record"`
+}
+
+func (d *Divergence) String() string {
+	return fmt.Sprintf("%s only in %s store: %s", d.Collection, d.Store, d.Record)
+}
+
+type Result struct {
+	Scenario    string        `json:"scenario"`
+	Segments    int           `json:"segments"`
+	Height      uint64        `json:"height"`
+	Divergences []*Divergence `json:"divergences"`
+}
+
+// Harness runs scenarios through an indexer reading from a fakenode.Node.
+type Harness struct {
+	// NewStore returns an empty store, by default a memory.MemoryStore
+	NewStore func(c *config.Config) (db.Store, error)
+	// SyncTimeout bounds the wait for the indexer to reach the tip of each
+	// segment
+	SyncTimeout time.Duration
+}
+
+func NewHarness() *Harness {
+	return &Harness{
+		NewStore: func(c *config.Config) (db.Store, error) {
+			return memory.NewMemoryStore(c), nil
+		},
+		SyncTimeout: 30 * time.Second,
+	}
+}
+
+// Run has an indexer follow the segments of the scenario pushed one after
+// the other to a node, then compares the resulting store against a fresh
+// index of the winning chain.
+func (h *Harness) Run(s *Scenario) (*Result, error) {
+	c := config.DefaultConfig()
+	c.BlockPollInterval = time.Millisecond
+
+	replayed, err := h.NewStore(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.replay(c, replayed, s.Chain); err != nil {
+		return nil, fmt.Errorf("scenario %s: %w", s.Name, err)
+	}
+
+	fresh, err := h.NewStore(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range s.Chain.Blocks {
+		if err := fresh.ProcessBlock(b); err != nil {
+			return nil, fmt.Errorf("scenario %s: failed to process block #%d: %w",
+				s.Name, b.Header.BlockNumber, err)
+		}
+	}
+
+	divergences, err := Compare(replayed, fresh)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Scenario:    s.Name,
+		Segments:    len(s.Chain.Segments),
+		Height:      s.Chain.Height(),
+		Divergences: divergences,
+	}, nil
+}
+
+func (h *Harness) replay(c *config.Config, m db.Store, chain *chaingen.Chain) error {
+	node := fakenode.NewNode()
+	// The node must serve the genesis block of the chain before the indexer
+	// asks for it
+	if err := node.Push(chain.Segments[0]...); err != nil {
+		return err
+	}
+	if err := node.Start(); err != nil {
+		return err
+	}
+	defer node.Stop()
+
+	src, err := blocksource.NewGRPCBlockSource(node.Addr())
+	if err != nil {
+		return err
+	}
+	qi := client.NewQRLIndexer(src, m, c)
+	qi.Start()
+	defer qi.Stop()
+
+	for i, segment := range chain.Segments {
+		if i > 0 {
+			if err := node.Push(segment...); err != nil {
+				return err
+			}
+		}
+		if err := h.waitForSync(m, node); err != nil {
+			return fmt.Errorf("segment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// waitForSync waits until the last block of m is the last block of node.
+func (h *Harness) waitForSync(m db.Store, node *fakenode.Node) error {
+	want := misc.ToSizedHash(node.Block(node.Height()).Header.HashHeader)
+	deadline := time.Now().Add(h.SyncTimeout)
+	for {
+		b, err := m.GetLastBlock()
+		if err == nil && b.Hash == want {
+			return nil
+		}
+		if err != nil && err != db.ErrNotFound {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("indexer didn't reach block #%d %s in %s",
+				node.Height(), want.ToString(), h.SyncTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Compare returns the records of every state collection found in only one of
+// the stores.
+func Compare(replayed db.StateDumper, fresh db.StateDumper) ([]*Divergence, error) {
+	var divergences []*Divergence
+	for _, collection := range db.StateCollections {
+		a, err := CanonicalDump(replayed, collection)
+		if err != nil {
+			return nil, err
+		}
+		b, err := CanonicalDump(fresh, collection)
+		if err != nil {
+			return nil, err
+		}
+		for len(a) > 0 || len(b) > 0 {
+			switch {
+			case len(b) == 0 || (len(a) > 0 && a[0] < b[0]):
+				divergences = append(divergences, &Divergence{collection, "replayed", a[0]})
+				a = a[1:]
+			case len(a) == 0 || b[0] < a[0]:
+				divergences = append(divergences, &Divergence{collection, "fresh", b[0]})
+				b = b[1:]
+			default:
+				a, b = a[1:], b[1:]
+			}
+		}
+	}
+	return divergences, nil
+}
+
+// CanonicalDump returns the records of a collection as sorted JSON documents,
+// so that two stores holding the same state have equal dumps. Fields that
+// depend on when or in which order records were written are normalized.
+func CanonicalDump(d db.StateDumper, collection string) ([]string, error) {
+	var records []string
+	err := d.DumpState(collection, func(record interface{}) error {
+		switch t := record.(type) {
+		case *models.Checkpoint:
+			checkpoint := *t
+			checkpoint.UpdatedAt = time.Time{}
+			record = &checkpoint
+		case *models.UndoRecord:
+			undoRecord := *t
+			undoRecord.TokenHolders = append([]*models.TokenHolderBeforeImage(nil), t.TokenHolders...)
+			sort.Slice(undoRecord.TokenHolders, func(i, j int) bool {
+				a, b := undoRecord.TokenHolders[i], undoRecord.TokenHolders[j]
+				if c := bytes.Compare(a.TokenTxHash[:], b.TokenTxHash[:]); c != 0 {
+					return c < 0
+				}
+				return bytes.Compare(a.Address[:], b.Address[:]) < 0
+			})
+			record = &undoRecord
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		records = append(records, string(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(records)
+	return records, nil
+}
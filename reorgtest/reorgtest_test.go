@@ -0,0 +1,73 @@
+package reorgtest
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+)
+
+func TestForkScenarios(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		depths []uint64
+	}{
+		{"depth-1", []uint64{1}},
+		{"depth-2", []uint64{2}},
+		{"depth-5", []uint64{5}},
+		{"depth-20", []uint64{20}},
+		{"to-genesis", []uint64{40}},
+		{"successive", []uint64{3, 1, 7, 2}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := chaingen.DefaultConfig()
+			c.Seed = int64(len(test.depths))*100 + int64(test.depths[0])
+			s, err := NewForkScenario(test.name, c, 40, test.depths...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runScenario(t, s)
+		})
+	}
+}
+
+func TestRandomForks(t *testing.T) {
+	c := chaingen.DefaultConfig()
+	c.Blocks = 300
+	c.ForkRatio = 0.2
+	c.MaxForkDepth = 10
+	s, err := NewRandomScenario("random", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Chain.Segments) < 5 {
+		t.Fatalf("only %d segments generated", len(s.Chain.Segments))
+	}
+	runScenario(t, s)
+}
+
+func TestRepeatedRecipientForks(t *testing.T) {
+	c := chaingen.DefaultConfig()
+	c.Seed = 7
+	c.Blocks = 200
+	c.RepeatedRecipientRatio = 0.5
+	c.SelfTransferRatio = 0.5
+	c.ForkRatio = 0.2
+	c.MaxForkDepth = 10
+	s, err := NewRandomScenario("repeated-recipients", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runScenario(t, s)
+}
+
+func runScenario(t *testing.T, s *Scenario) {
+	t.Helper()
+
+	result, err := NewHarness().Run(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range result.Divergences {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,456 @@
+// Package snapshot writes and restores state snapshots, portable archives of
+// the whole state of a db.Store at a given block, so that a new indexer can
+// be bootstrapped without replaying the chain from genesis.
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyyber/qrl-token-indexer/blocksource"
+	"github.com/cyyber/qrl-token-indexer/db"
+)
+
+const (
+	// FormatVersion is the version of the archive layout and record encoding
+	FormatVersion = 1
+
+	ManifestFileName = "manifest.json"
+	// Extension of the JSON lines file of each state collection
+	RecordsExtension = ".jsonl"
+
+	filePrefix    = "snapshot-"
+	fileExtension = ".tar.gz"
+
+	restoreBatchSize = 1000
+)
+
+// Source is a store a snapshot can be created from.
+type Source interface {
+	db.StoreReader
+	db.StateDumper
+}
+
+// Target is a store a snapshot can be restored into.
+type Target interface {
+	db.StoreReader
+	db.StateRestorer
+}
+
+// Manifest is the first entry of a snapshot archive. It is followed by a
+// file of JSON encoded records for each state collection.
+type Manifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	BlockNumber   int64     `json:"blockNumber"`
+	BlockHash     string    `json:"blockHash"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Files         []*File   `json:"files"`
+	// ContentHash is the SHA256 of the name and SHA256 of every file, one
+	// "<name> <sha256>" line per file, identifying the content of the snapshot
+	ContentHash string `json:"contentHash"`
+}
+
+type File struct {
+	Name       string `json:"name"`
+	Collection string `json:"collection"`
+	Records    int64  `json:"records"`
+	SHA256     string `json:"sha256"` // Checksum of the uncompressed file
+}
+
+func (m *Manifest) computeContentHash() string {
+	hasher := sha256.New()
+	for _, file := range m.Files {
+		fmt.Fprintf(hasher, "%s %s\n", file.Name, file.SHA256)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// FileName returns the name of the snapshot archive at blockNumber.
+func FileName(blockNumber int64) string {
+	return fmt.Sprintf("%s%012d%s", filePrefix, blockNumber, fileExtension)
+}
+
+// Create writes a snapshot of the state of s as of its checkpoint into dir,
+// and returns the path of the archive. It must not run concurrently with
+// block processing.
+func Create(s Source, dir string) (string, error) {
+	checkpoint, err := s.GetCheckpoint()
+	if err != nil {
+		return "", fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmpDir, err := os.MkdirTemp(dir, ".snapshot-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manifest := &Manifest{
+		FormatVersion: FormatVersion,
+		BlockNumber:   checkpoint.BlockNumber,
+		BlockHash:     hex.EncodeToString(checkpoint.BlockHash[:]),
+		CreatedAt:     time.Now().UTC(),
+	}
+	for _, collection := range db.StateCollections {
+		file, err := dumpCollection(s, collection, tmpDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to dump %s: %w", collection, err)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	manifest.ContentHash = manifest.computeContentHash()
+
+	path := filepath.Join(dir, FileName(manifest.BlockNumber))
+	if err := writeArchive(path, tmpDir, manifest); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func dumpCollection(s Source, collection string, dir string) (*File, error) {
+	file := &File{
+		Name:       collection + RecordsExtension,
+		Collection: collection,
+	}
+	f, err := os.Create(filepath.Join(dir, file.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	e := json.NewEncoder(io.MultiWriter(f, hasher))
+	err = s.DumpState(collection, func(record interface{}) error {
+		file.Records++
+		return e.Encode(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	file.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return file, f.Close()
+}
+
+func writeArchive(path string, dir string, manifest *Manifest) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    ManifestFileName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		if err := addFile(tw, filepath.Join(dir, file.Name), file.Name, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func addFile(tw *tar.Writer, path string, name string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Prune removes all but the retained most recent snapshot archives in dir.
+func Prune(dir string, retained int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileExtension) {
+			names = append(names, name)
+		}
+	}
+	// Names sort by block number, as the block number is zero padded
+	sort.Strings(names)
+	for i := 0; i < len(names)-retained; i++ {
+		if err := os.Remove(filepath.Join(dir, names[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveReader reads the entries of a snapshot archive in order.
+type archiveReader struct {
+	f  *os.File
+	gr *gzip.Reader
+	tr *tar.Reader
+
+	manifest *Manifest
+}
+
+func openArchive(path string) (*archiveReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &archiveReader{f: f, gr: gr, tr: tar.NewReader(gr)}
+
+	header, err := a.tr.Next()
+	if err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if header.Name != ManifestFileName {
+		a.Close()
+		return nil, fmt.Errorf("expected %s as first entry, found %s", ManifestFileName, header.Name)
+	}
+	a.manifest = &Manifest{}
+	if err := json.NewDecoder(a.tr).Decode(a.manifest); err != nil {
+		a.Close()
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if a.manifest.FormatVersion != FormatVersion {
+		a.Close()
+		return nil, fmt.Errorf("unsupported snapshot format version %d", a.manifest.FormatVersion)
+	}
+	return a, nil
+}
+
+// next returns the next file of the archive, whose content is read from the
+// archive reader.
+func (a *archiveReader) next(i int) (*File, error) {
+	if i >= len(a.manifest.Files) {
+		return nil, io.EOF
+	}
+	file := a.manifest.Files[i]
+	header, err := a.tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file.Name, err)
+	}
+	if header.Name != file.Name {
+		return nil, fmt.Errorf("expected %s, found %s", file.Name, header.Name)
+	}
+	return file, nil
+}
+
+func (a *archiveReader) Close() error {
+	a.gr.Close()
+	return a.f.Close()
+}
+
+// ReadManifest returns the manifest of the snapshot archive at path.
+func ReadManifest(path string) (*Manifest, error) {
+	a, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.manifest, nil
+}
+
+// Verify checks the checksum of every file of the snapshot archive at path
+// and its content hash, and returns its manifest.
+func Verify(path string) (*Manifest, error) {
+	a, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	if a.manifest.computeContentHash() != a.manifest.ContentHash {
+		return nil, errors.New("content hash mismatch")
+	}
+	for i := range a.manifest.Files {
+		file, err := a.next(i)
+		if err != nil {
+			return nil, err
+		}
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, a.tr); err != nil {
+			return nil, err
+		}
+		if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != file.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s, expected %s found %s",
+				file.Name, file.SHA256, checksum)
+		}
+	}
+	return a.manifest, nil
+}
+
+// CheckBlockHash checks that the block at which the snapshot was taken is
+// part of the chain of src.
+func CheckBlockHash(src blocksource.BlockSource, manifest *Manifest) error {
+	block, err := src.GetBlockByNumber(uint64(manifest.BlockNumber))
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("block #%d of the snapshot not found", manifest.BlockNumber)
+	}
+	if hash := hex.EncodeToString(block.Header.HashHeader); hash != manifest.BlockHash {
+		return fmt.Errorf("block #%d of the snapshot has hash %s, but %s on chain",
+			manifest.BlockNumber, manifest.BlockHash, hash)
+	}
+	return nil
+}
+
+// Restore writes the state of the snapshot archive at path into t, which
+// must be empty. With resume, a restore that was interrupted before its
+// checkpoint was written is completed. The archive is verified while being
+// restored, but checksums only fail after records have been written, so it
+// should be verified beforehand with Verify.
+func Restore(path string, t Target, resume bool) (*Manifest, error) {
+	if err := checkRestoreTarget(t, resume); err != nil {
+		return nil, err
+	}
+
+	a, err := openArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+
+	restored := make(map[string]bool)
+	for i := range a.manifest.Files {
+		file, err := a.next(i)
+		if err != nil {
+			return nil, err
+		}
+		// The checkpoint is restored last, once the snapshot has proven
+		// complete
+		if file.Collection == db.StateCheckpoint {
+			for _, collection := range db.StateCollections {
+				if collection != db.StateCheckpoint && !restored[collection] {
+					return nil, fmt.Errorf("snapshot lacks %s", collection)
+				}
+			}
+		}
+		restored[file.Collection] = true
+		if err := restoreFile(t, a.tr, file); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", file.Name, err)
+		}
+	}
+	return a.manifest, nil
+}
+
+func checkRestoreTarget(t Target, resume bool) error {
+	if resume {
+		_, err := t.GetCheckpoint()
+		if err == nil {
+			return errors.New("store already has a checkpoint, restore has completed")
+		} else if err != db.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	empty, err := db.IsEmpty(t)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("store is not empty")
+	}
+	return nil
+}
+
+func restoreFile(t Target, r io.Reader, file *File) error {
+	hasher := sha256.New()
+	tee := io.TeeReader(r, hasher)
+	d := json.NewDecoder(tee)
+	records := make([]interface{}, 0, restoreBatchSize)
+	var count int64
+	for d.More() {
+		record, err := db.NewStateRecord(file.Collection)
+		if err != nil {
+			return err
+		}
+		if err := d.Decode(record); err != nil {
+			return err
+		}
+		records = append(records, record)
+		count++
+		if len(records) == restoreBatchSize {
+			if err := t.RestoreState(file.Collection, records); err != nil {
+				return err
+			}
+			records = make([]interface{}, 0, restoreBatchSize)
+		}
+	}
+	// Hash whatever the decoder left unread, such as the trailing newline
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return err
+	}
+	if count != file.Records {
+		return fmt.Errorf("expected %d records, found %d", file.Records, count)
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != file.SHA256 {
+		return fmt.Errorf("checksum mismatch, expected %s found %s", file.SHA256, checksum)
+	}
+	return t.RestoreState(file.Collection, records)
+}
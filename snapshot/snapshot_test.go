@@ -0,0 +1,209 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+func newGeneratedStore(t *testing.T) *memory.MemoryStore {
+	t.Helper()
+	s := memory.NewMemoryStore(config.DefaultConfig())
+	testutil.Process(t, s, testutil.GenerateBlocks(t, 13, 150)...)
+	return s
+}
+
+// dumpJSON returns the records of collection dumped by d as sorted JSON
+// documents, as they are written into snapshots.
+func dumpJSON(t *testing.T, d db.StateDumper, collection string) []string {
+	t.Helper()
+	var records []string
+	for _, record := range testutil.Dump(t, d, collection) {
+		data, err := json.Marshal(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, string(data))
+	}
+	sort.Strings(records)
+	return records
+}
+
+func assertSameState(t *testing.T, restored db.StateDumper, s db.StateDumper, collections ...string) {
+	t.Helper()
+	for _, collection := range collections {
+		got, want := dumpJSON(t, restored, collection), dumpJSON(t, s, collection)
+		if len(got) != len(want) {
+			t.Fatalf("%d %s restored, want %d", len(got), collection, len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%s restored as %s, want %s", collection, got[i], want[i])
+			}
+		}
+	}
+}
+
+// rewriteArchive rewrites the snapshot archive at path, keeping its manifest
+// but passing the content of every file through rewrite, which drops the file
+// by returning false.
+func rewriteArchive(t *testing.T, path string, rewrite func(file *File, data []byte) ([]byte, bool)) {
+	t.Helper()
+	a, err := openArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	dir := t.TempDir()
+	manifest := *a.manifest
+	manifest.Files = nil
+	for i := range a.manifest.Files {
+		file, err := a.next(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(a.tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, keep := rewrite(file, data)
+		if !keep {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, file.Name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	manifest.ContentHash = manifest.computeContentHash()
+	if err := writeArchive(path, dir, &manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	s := newGeneratedStore(t)
+	path, err := Create(s, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := s.GetCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.BlockNumber != checkpoint.BlockNumber || filepath.Base(path) != FileName(checkpoint.BlockNumber) {
+		t.Fatalf("snapshot %s of block #%d, want block #%d", path, manifest.BlockNumber, checkpoint.BlockNumber)
+	}
+	if len(manifest.Files) != len(db.StateCollections) {
+		t.Fatalf("%d files in snapshot, want %d", len(manifest.Files), len(db.StateCollections))
+	}
+	for i, file := range manifest.Files {
+		records := len(dumpJSON(t, s, db.StateCollections[i]))
+		if file.Collection != db.StateCollections[i] || file.Records != int64(records) {
+			t.Fatalf("file %s of %d %s, want %d %s", file.Name, file.Records, file.Collection,
+				records, db.StateCollections[i])
+		}
+	}
+
+	restored := memory.NewMemoryStore(config.DefaultConfig())
+	if _, err := Restore(path, restored, false); err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, restored, s, db.StateCollections...)
+}
+
+func TestRestoreTarget(t *testing.T) {
+	s := newGeneratedStore(t)
+	path, err := Create(s, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A store which has processed blocks is not restored into
+	if _, err := Restore(path, s, false); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("restore into a non empty store: %v", err)
+	}
+
+	// An interrupted restore is resumed, records written twice being
+	// replaced
+	restored := memory.NewMemoryStore(config.DefaultConfig())
+	var records []interface{}
+	err = s.DumpState(db.StateTokenTxs, func(record interface{}) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreState(db.StateTokenTxs, records[:len(records)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(path, restored, true); err != nil {
+		t.Fatal(err)
+	}
+	assertSameState(t, restored, s, db.StateCollections...)
+
+	// Once the checkpoint is restored there is nothing to resume
+	if _, err := Restore(path, restored, true); err == nil {
+		t.Fatal("resumed a completed restore")
+	}
+}
+
+func TestVerifyCorruptedSnapshot(t *testing.T) {
+	s := newGeneratedStore(t)
+	path, err := Create(s, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriteArchive(t, path, func(file *File, data []byte) ([]byte, bool) {
+		if file.Collection == db.StateTokenHolders {
+			data = append(append([]byte(nil), data...), "\n"...)
+		}
+		return data, true
+	})
+
+	if _, err := Verify(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("verify corrupted snapshot: %v", err)
+	}
+	restored := memory.NewMemoryStore(config.DefaultConfig())
+	if _, err := Restore(path, restored, false); err == nil {
+		t.Fatal("restored corrupted snapshot")
+	}
+	if _, err := restored.GetCheckpoint(); err != db.ErrNotFound {
+		t.Fatalf("checkpoint of corrupted snapshot restored: %v", err)
+	}
+}
+
+func TestRestoreIncompleteSnapshot(t *testing.T) {
+	s := newGeneratedStore(t)
+	path, err := Create(s, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewriteArchive(t, path, func(file *File, data []byte) ([]byte, bool) {
+		return data, file.Collection != db.StateTokenStats
+	})
+
+	restored := memory.NewMemoryStore(config.DefaultConfig())
+	if _, err := Restore(path, restored, false); err == nil || !strings.Contains(err.Error(), "lacks") {
+		t.Fatalf("restore of a snapshot without token stats: %v", err)
+	}
+	if _, err := restored.GetCheckpoint(); err != db.ErrNotFound {
+		t.Fatalf("checkpoint of incomplete snapshot restored: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package testutil holds the setup shared by the tests of the stores and of
+// the packages reading them: a token chain scripted on a fakenode.Node, the
+// indexing of chains into a store and assertions on the indexed state.
+package testutil
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/chaingen"
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/generated"
+)
+
+var (
+	Alice = fakenode.NewAddress("alice")
+	Bob   = fakenode.NewAddress("bob")
+	Carol = fakenode.NewAddress("carol")
+
+	// TokenTxHash is the token created by the chain of NewTokenNode
+	TokenTxHash = fakenode.NewTxHash("token")
+)
+
+// NewTokenNode returns a node whose chain creates in block #1 a token TKN of
+// 10.05 with 2 decimals, held by alice (1000) and carol (5). Alice sends 300
+// to bob in block #2, and bob sends 100 to carol in block #3.
+func NewTokenNode() *fakenode.Node {
+	node := fakenode.NewNode()
+	node.Append(fakenode.NewTokenTx("token", "TKN", 2, Alice,
+		[]common.Address{Alice, Carol}, []uint64{1000, 5}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-1", TokenTxHash, Alice,
+		[]common.Address{Bob}, []uint64{300}))
+	node.Append(fakenode.NewTransferTokenTx("transfer-2", TokenTxHash, Bob,
+		[]common.Address{Carol}, []uint64{100}))
+	return node
+}
+
+// Index processes the chain of node, from the genesis block to its height,
+// into s.
+func Index(t testing.TB, s db.Store, node *fakenode.Node) {
+	t.Helper()
+	for n := uint64(0); n <= node.Height(); n++ {
+		Process(t, s, node.Block(n))
+	}
+}
+
+// Process processes blocks into s, failing the test on the first error.
+func Process(t testing.TB, s db.Store, blocks ...*generated.Block) {
+	t.Helper()
+	for _, b := range blocks {
+		if err := s.ProcessBlock(b); err != nil {
+			t.Fatalf("process block #%d: %v", b.Header.BlockNumber, err)
+		}
+	}
+}
+
+// GenerateBlocks returns the blocks of a synthetic chain without forks, in
+// which some transfers list a recipient twice or pay their sender.
+func GenerateBlocks(t testing.TB, seed int64, blocks uint64) []*generated.Block {
+	t.Helper()
+	c := chaingen.DefaultConfig()
+	c.Seed = seed
+	c.Blocks = blocks
+	c.ForkRatio = 0
+	c.RepeatedRecipientRatio = 0.2
+	c.SelfTransferRatio = 0.2
+	g, err := chaingen.NewGenerator(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g.Generate().Blocks
+}
+
+// Dump returns the records of collection dumped by d.
+func Dump(t testing.TB, d db.StateDumper, collection string) []interface{} {
+	t.Helper()
+	var records []interface{}
+	err := d.DumpState(collection, func(record interface{}) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// AssertBalance checks the amount of the holder address of the token, a
+// holder which isn't stored having none.
+func AssertBalance(t testing.TB, s db.StoreReader, tokenTxHash common.Hash, address common.Address,
+	want common.Amount) {
+	t.Helper()
+	holder, err := s.GetTokenHolder(tokenTxHash, address)
+	if err == db.ErrNotFound {
+		if want != 0 {
+			t.Fatalf("holder %s not found, want %d", address.ToString(), want)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder.Amount != want {
+		t.Fatalf("holder %s has %d, want %d", address.ToString(), holder.Amount, want)
+	}
+}
+
+// AssertSupply checks the supply and holder count tracked for the token.
+func AssertSupply(t testing.TB, s db.StoreReader, tokenTxHash common.Hash, supply common.Amount,
+	holderCount int64) {
+	t.Helper()
+	stats, err := s.GetTokenStats(tokenTxHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Supply != supply || stats.HolderCount != holderCount {
+		t.Fatalf("token stats %+v, want supply %d and %d holders", stats, supply, holderCount)
+	}
+}
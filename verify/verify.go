@@ -0,0 +1,513 @@
+// Package verify checks the consistency of an index by replaying every
+// stored token tx and comparing the result with the stored token holders and
+// token stats.
+package verify
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+)
+
+// Kinds of discrepancies
+const (
+	// A tx stored in a block after the checkpoint, left behind by a revert
+	KindTxBeyondCheckpoint = "txBeyondCheckpoint"
+	// A transfer of a token which isn't stored
+	KindUnknownToken = "unknownToken"
+	// A transfer which cannot be applied to the replayed balances
+	KindInvalidTransfer = "invalidTransfer"
+	// A tx of another block than the one indexed at its height, or a transfer
+	// without its tokenRelatedTx whose block cannot be checked, left behind by
+	// a revert
+	KindOrphanTx = "orphanTx"
+	// A transfer of the indexed block at its height without its tokenRelatedTx
+	KindMissingTokenRelatedTx = "missingTokenRelatedTx"
+	// A tokenRelatedTx without its transfer
+	KindOrphanTokenRelatedTx = "orphanTokenRelatedTx"
+	// A holder found by the replay which isn't stored
+	KindMissingTokenHolder = "missingTokenHolder"
+	// A stored holder not found by the replay
+	KindUnexpectedTokenHolder = "unexpectedTokenHolder"
+	// A stored holder whose amount or last changed block differs from the replay
+	KindTokenHolderMismatch = "tokenHolderMismatch"
+	// A token whose stats aren't stored
+	KindMissingTokenStats = "missingTokenStats"
+	// Stored stats of a token not found by the replay
+	KindUnexpectedTokenStats = "unexpectedTokenStats"
+	// Stored stats whose supply or holder count differs from the replay
+	KindTokenStatsMismatch = "tokenStatsMismatch"
+)
+
+// Discrepancy is an inconsistency found in the index.
+type Discrepancy struct {
+	Kind        string         `json:"kind"`
+	TokenTxHash common.Hash    `json:"tokenTxHash"`
+	TxHashes    []common.Hash  `json:"txHashes,omitempty"`
+	Address     common.Address `json:"address,omitempty"`
+	Expected    string         `json:"expected,omitempty"`
+	Found       string         `json:"found,omitempty"`
+	Detail      string         `json:"detail,omitempty"`
+	// Repairable is set if Repair can fix the discrepancy
+	Repairable bool `json:"repairable"`
+
+	// records to replace or delete on repair
+	replace interface{}
+	delete  interface{}
+}
+
+func (d *Discrepancy) String() string {
+	s := fmt.Sprintf("%s token=%s", d.Kind, d.TokenTxHash.ToString())
+	for _, txHash := range d.TxHashes {
+		s += " tx=" + txHash.ToString()
+	}
+	if d.Address != (common.Address{}) {
+		s += " address=" + d.Address.ToString()
+	}
+	if d.Expected != "" || d.Found != "" {
+		s += fmt.Sprintf(" expected=%s found=%s", d.Expected, d.Found)
+	}
+	if d.Detail != "" {
+		s += " (" + d.Detail + ")"
+	}
+	return s
+}
+
+// Store is what the verifier reads from and repairs.
+type Store interface {
+	db.StoreReader
+	db.StateDumper
+	db.StateRestorer
+	db.StateRepairer
+}
+
+// Report lists the discrepancies found by Verify.
+type Report struct {
+	CheckpointBlockNumber int64          `json:"checkpointBlockNumber"`
+	TokenTxs              int            `json:"tokenTxs"`
+	TransferTokenTxs      int            `json:"transferTokenTxs"`
+	TokenHolders          int            `json:"tokenHolders"`
+	Discrepancies         []*Discrepancy `json:"discrepancies"`
+}
+
+func (r *Report) add(d *Discrepancy) {
+	r.Discrepancies = append(r.Discrepancies, d)
+}
+
+// state is everything loaded from the store.
+type state struct {
+	tokenTxs         []*models.TokenTx
+	transferTokenTxs []*models.TransferTokenTx
+	tokenRelatedTxs  []*models.TokenRelatedTx
+	tokenHolders     []*models.TokenHolder
+	tokenStats       []*models.TokenStats
+	// blockHashes are the hashes of the indexed blocks by number, down to the
+	// oldest block kept for reorgs
+	blockHashes map[int64]common.Hash
+}
+
+func load(s db.StateDumper) (*state, error) {
+	st := &state{blockHashes: make(map[int64]common.Hash)}
+	collect := map[string]func(record interface{}){
+		db.StateTokenTxs: func(record interface{}) {
+			st.tokenTxs = append(st.tokenTxs, record.(*models.TokenTx))
+		},
+		db.StateTransferTokenTxs: func(record interface{}) {
+			st.transferTokenTxs = append(st.transferTokenTxs, record.(*models.TransferTokenTx))
+		},
+		db.StateTokenRelatedTxs: func(record interface{}) {
+			st.tokenRelatedTxs = append(st.tokenRelatedTxs, record.(*models.TokenRelatedTx))
+		},
+		db.StateTokenHolders: func(record interface{}) {
+			st.tokenHolders = append(st.tokenHolders, record.(*models.TokenHolder))
+		},
+		db.StateTokenStats: func(record interface{}) {
+			st.tokenStats = append(st.tokenStats, record.(*models.TokenStats))
+		},
+		db.StateBlocks: func(record interface{}) {
+			block := record.(*models.Block)
+			st.blockHashes[block.Number] = block.Hash
+		},
+	}
+	for _, collection := range []string{db.StateTokenTxs, db.StateTransferTokenTxs,
+		db.StateTokenRelatedTxs, db.StateTokenHolders, db.StateTokenStats, db.StateBlocks} {
+		err := s.DumpState(collection, func(record interface{}) error {
+			collect[collection](record)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", collection, err)
+		}
+	}
+
+	// Txs are replayed in the order they appear in the chain. Those indexed
+	// before their position was recorded keep the dump order within a block
+	sort.SliceStable(st.tokenTxs, func(i, j int) bool {
+		return txBefore(st.tokenTxs[i].BlockNumber, st.tokenTxs[i].TxIndex,
+			st.tokenTxs[j].BlockNumber, st.tokenTxs[j].TxIndex)
+	})
+	sort.SliceStable(st.transferTokenTxs, func(i, j int) bool {
+		return txBefore(st.transferTokenTxs[i].BlockNumber, st.transferTokenTxs[i].TxIndex,
+			st.transferTokenTxs[j].BlockNumber, st.transferTokenTxs[j].TxIndex)
+	})
+	return st, nil
+}
+
+func txBefore(blockNumber int64, txIndex int, otherBlockNumber int64, otherTxIndex int) bool {
+	if blockNumber != otherBlockNumber {
+		return blockNumber < otherBlockNumber
+	}
+	return txIndex < otherTxIndex
+}
+
+// inIndexedBlock reports whether the tx of block blockNumber and blockHash is
+// known to be in the indexed block at its height. known is unset when the
+// block hash isn't recorded on the tx, or the block was pruned.
+func (st *state) inIndexedBlock(blockNumber int64, blockHash common.Hash) (in bool, known bool) {
+	indexedHash, ok := st.blockHashes[blockNumber]
+	if !ok || blockHash == (common.Hash{}) {
+		return false, false
+	}
+	return blockHash == indexedHash, true
+}
+
+// Verify replays all the token txs of s up to its checkpoint through
+// TokenHolders.Apply, and reports every difference with the stored token
+// holders and tokenRelatedTxs. It must not run while the indexer is writing
+// to s.
+func Verify(s Store) (*Report, error) {
+	checkpoint, err := s.GetCheckpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkpoint: %w", err)
+	}
+	st, err := load(s)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{
+		CheckpointBlockNumber: checkpoint.BlockNumber,
+		TokenTxs:              len(st.tokenTxs),
+		TransferTokenTxs:      len(st.transferTokenTxs),
+		TokenHolders:          len(st.tokenHolders),
+	}
+
+	expected := make(models.TokenHoldersCache)
+	tokens := make(map[common.Hash]bool)
+	var expectedTokenStats []*models.TokenStats
+	for _, tokenTx := range st.tokenTxs {
+		if tokenTx.BlockNumber > checkpoint.BlockNumber {
+			r.add(&Discrepancy{
+				Kind:        KindTxBeyondCheckpoint,
+				TokenTxHash: tokenTx.TxHash,
+				TxHashes:    []common.Hash{tokenTx.TxHash},
+				Detail:      "block #" + strconv.FormatInt(tokenTx.BlockNumber, 10),
+				Repairable:  true,
+				delete:      tokenTx,
+			})
+			continue
+		}
+		if in, known := st.inIndexedBlock(tokenTx.BlockNumber, tokenTx.BlockHash); known && !in {
+			r.add(&Discrepancy{
+				Kind:        KindOrphanTx,
+				TokenTxHash: tokenTx.TxHash,
+				TxHashes:    []common.Hash{tokenTx.TxHash},
+				Detail:      "block #" + strconv.FormatInt(tokenTx.BlockNumber, 10) + " " + tokenTx.BlockHash.ToString(),
+				Repairable:  true,
+				delete:      tokenTx,
+			})
+			continue
+		}
+		tokenStats, err := models.NewTokenStatsFromTokenTx(tokenTx)
+		if err != nil {
+			return nil, err
+		}
+		tokenHolders, err := tokenTx.GetTokenHolders()
+		if err != nil {
+			return nil, err
+		}
+		tokens[tokenTx.TxHash] = true
+		expectedTokenStats = append(expectedTokenStats, tokenStats)
+		expected.PutFromTokenHolders(tokenHolders)
+	}
+
+	related := make(map[models.TokenRelatedTx]bool)
+	for _, tokenRelatedTx := range st.tokenRelatedTxs {
+		related[*tokenRelatedTx] = true
+	}
+
+	// transfers are the canonical transfers, whose tokenRelatedTxs are kept
+	transfers := make(map[models.TokenRelatedTx]bool)
+	for _, transferTokenTx := range st.transferTokenTxs {
+		if transferTokenTx.BlockNumber > checkpoint.BlockNumber {
+			r.add(&Discrepancy{
+				Kind:        KindTxBeyondCheckpoint,
+				TokenTxHash: transferTokenTx.TokenTxHash,
+				TxHashes:    []common.Hash{transferTokenTx.TxHash},
+				Detail:      "block #" + strconv.FormatInt(transferTokenTx.BlockNumber, 10),
+				Repairable:  true,
+				delete:      transferTokenTx,
+			})
+			continue
+		}
+		// Processing a block stores a transfer along with its tokenRelatedTx,
+		// so a transfer without it is only canonical if its block says so
+		tokenRelatedTx := *transferTokenTx.GetTokenRelatedTx()
+		in, known := st.inIndexedBlock(transferTokenTx.BlockNumber, transferTokenTx.BlockHash)
+		if (known && !in) || (!known && !related[tokenRelatedTx]) {
+			detail := "block #" + strconv.FormatInt(transferTokenTx.BlockNumber, 10)
+			if known {
+				detail += " " + transferTokenTx.BlockHash.ToString()
+			} else {
+				detail += ", no tokenRelatedTx"
+			}
+			r.add(&Discrepancy{
+				Kind:        KindOrphanTx,
+				TokenTxHash: transferTokenTx.TokenTxHash,
+				TxHashes:    []common.Hash{transferTokenTx.TxHash},
+				Detail:      detail,
+				Repairable:  true,
+				delete:      transferTokenTx,
+			})
+			continue
+		}
+		transfers[tokenRelatedTx] = true
+		if !tokens[transferTokenTx.TokenTxHash] {
+			r.add(&Discrepancy{
+				Kind:        KindUnknownToken,
+				TokenTxHash: transferTokenTx.TokenTxHash,
+				TxHashes:    []common.Hash{transferTokenTx.TxHash},
+			})
+			continue
+		}
+		if err := replay(expected, transferTokenTx); err != nil {
+			r.add(&Discrepancy{
+				Kind:        KindInvalidTransfer,
+				TokenTxHash: transferTokenTx.TokenTxHash,
+				TxHashes:    []common.Hash{transferTokenTx.TxHash},
+				Detail:      err.Error(),
+			})
+		}
+	}
+
+	checkTokenRelatedTxs(r, st, related, transfers)
+	if err := checkTokenStats(r, st, expectedTokenStats, expected); err != nil {
+		return nil, err
+	}
+	checkTokenHolders(r, st, expected)
+	return r, nil
+}
+
+// replay applies the transfer to the expected holders, leaving them unchanged
+// if it fails.
+func replay(expected models.TokenHoldersCache, transferTokenTx *models.TransferTokenTx) error {
+	tokenHolders := make(models.TokenHolders)
+	addresses := append([]common.Address{transferTokenTx.From}, transferTokenTx.Addresses...)
+	for _, address := range addresses {
+		if _, ok := tokenHolders[address]; ok {
+			continue
+		}
+		tokenHolder := expected.Get(transferTokenTx.TokenTxHash, address)
+		if tokenHolder == nil {
+			if address == transferTokenTx.From {
+				return fmt.Errorf("sender %s holds none of the token", address.ToString())
+			}
+			tokenHolder = models.NewTokenHolder(transferTokenTx.TokenTxHash, address, 0)
+		}
+		// Applied to copies so that a failed transfer changes nothing
+		c := *tokenHolder
+		tokenHolders[address] = &c
+	}
+	if err := tokenHolders.Apply(transferTokenTx); err != nil {
+		return err
+	}
+	expected.PutFromTokenHolders(tokenHolders)
+	return nil
+}
+
+func checkTokenRelatedTxs(r *Report, st *state, related, transfers map[models.TokenRelatedTx]bool) {
+	for _, tokenRelatedTx := range st.tokenRelatedTxs {
+		if !transfers[*tokenRelatedTx] {
+			r.add(&Discrepancy{
+				Kind:        KindOrphanTokenRelatedTx,
+				TokenTxHash: tokenRelatedTx.TokenTxHash,
+				TxHashes:    []common.Hash{tokenRelatedTx.TxHash},
+				Repairable:  true,
+				delete:      tokenRelatedTx,
+			})
+		}
+	}
+	for _, transferTokenTx := range st.transferTokenTxs {
+		tokenRelatedTx := transferTokenTx.GetTokenRelatedTx()
+		if transfers[*tokenRelatedTx] && !related[*tokenRelatedTx] {
+			r.add(&Discrepancy{
+				Kind:        KindMissingTokenRelatedTx,
+				TokenTxHash: tokenRelatedTx.TokenTxHash,
+				TxHashes:    []common.Hash{tokenRelatedTx.TxHash},
+				Repairable:  true,
+				replace:     tokenRelatedTx,
+			})
+		}
+	}
+}
+
+func checkTokenStats(r *Report, st *state, expectedTokenStats []*models.TokenStats,
+	expected models.TokenHoldersCache) error {
+	byToken := make(map[common.Hash]*models.TokenStats)
+	for _, tokenStats := range expectedTokenStats {
+		byToken[tokenStats.TokenTxHash] = tokenStats
+	}
+	for _, tokenHolder := range expected {
+		if err := byToken[tokenHolder.TokenTxHash].Update(0, tokenHolder.Amount); err != nil {
+			return err
+		}
+	}
+
+	stored := make(map[common.Hash]*models.TokenStats)
+	for _, tokenStats := range st.tokenStats {
+		stored[tokenStats.TokenTxHash] = tokenStats
+		if _, ok := byToken[tokenStats.TokenTxHash]; !ok {
+			r.add(&Discrepancy{
+				Kind:        KindUnexpectedTokenStats,
+				TokenTxHash: tokenStats.TokenTxHash,
+				Found:       formatTokenStats(tokenStats),
+				Repairable:  true,
+				delete:      tokenStats,
+			})
+		}
+	}
+	for _, tokenStats := range expectedTokenStats {
+		s, ok := stored[tokenStats.TokenTxHash]
+		if !ok {
+			r.add(&Discrepancy{
+				Kind:        KindMissingTokenStats,
+				TokenTxHash: tokenStats.TokenTxHash,
+				Expected:    formatTokenStats(tokenStats),
+				Repairable:  true,
+				replace:     tokenStats,
+			})
+		} else if *s != *tokenStats {
+			r.add(&Discrepancy{
+				Kind:        KindTokenStatsMismatch,
+				TokenTxHash: tokenStats.TokenTxHash,
+				Expected:    formatTokenStats(tokenStats),
+				Found:       formatTokenStats(s),
+				Repairable:  true,
+				replace:     tokenStats,
+			})
+		}
+	}
+	return nil
+}
+
+func formatTokenStats(s *models.TokenStats) string {
+	return fmt.Sprintf("%d/%d supply, %d holders", s.Supply, s.TotalSupply, s.HolderCount)
+}
+
+func checkTokenHolders(r *Report, st *state, expected models.TokenHoldersCache) {
+	for _, stored := range st.tokenHolders {
+		tokenHolder := expected.Get(stored.TokenTxHash, stored.Address)
+		if tokenHolder == nil {
+			r.add(&Discrepancy{
+				Kind:        KindUnexpectedTokenHolder,
+				TokenTxHash: stored.TokenTxHash,
+				Address:     stored.Address,
+				Found:       strconv.FormatUint(uint64(stored.Amount), 10),
+				Repairable:  true,
+				delete:      stored,
+			})
+			continue
+		}
+		expected.Delete(tokenHolder.TokenTxHash, tokenHolder.Address)
+
+		// The block of the last change is unset on holders stored before it
+		// was tracked
+		if stored.Amount != tokenHolder.Amount ||
+			(stored.BlockNumber != common.BLOCKZERO && stored.BlockNumber != tokenHolder.BlockNumber) {
+			r.add(&Discrepancy{
+				Kind:        KindTokenHolderMismatch,
+				TokenTxHash: stored.TokenTxHash,
+				Address:     stored.Address,
+				Expected:    fmt.Sprintf("%d@#%d", tokenHolder.Amount, tokenHolder.BlockNumber),
+				Found:       fmt.Sprintf("%d@#%d", stored.Amount, stored.BlockNumber),
+				Repairable:  true,
+				replace:     tokenHolder,
+			})
+		}
+	}
+
+	// Whatever is left wasn't stored
+	var missing []*models.TokenHolder
+	for _, tokenHolder := range expected {
+		missing = append(missing, tokenHolder)
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if c := bytes.Compare(missing[i].TokenTxHash[:], missing[j].TokenTxHash[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(missing[i].Address[:], missing[j].Address[:]) < 0
+	})
+	for _, tokenHolder := range missing {
+		r.add(&Discrepancy{
+			Kind:        KindMissingTokenHolder,
+			TokenTxHash: tokenHolder.TokenTxHash,
+			Address:     tokenHolder.Address,
+			Expected:    strconv.FormatUint(uint64(tokenHolder.Amount), 10),
+			Repairable:  true,
+			replace:     tokenHolder,
+		})
+	}
+}
+
+// Repair fixes the repairable discrepancies of the report, and returns the
+// number of discrepancies repaired.
+func Repair(s Store, r *Report) (int, error) {
+	repaired := 0
+	for _, d := range r.Discrepancies {
+		if !d.Repairable {
+			continue
+		}
+		if d.delete != nil {
+			collection, err := stateCollection(d.delete)
+			if err != nil {
+				return repaired, err
+			}
+			if err := s.DeleteState(collection, []interface{}{d.delete}); err != nil {
+				return repaired, err
+			}
+		}
+		if d.replace != nil {
+			collection, err := stateCollection(d.replace)
+			if err != nil {
+				return repaired, err
+			}
+			if err := s.RestoreState(collection, []interface{}{d.replace}); err != nil {
+				return repaired, err
+			}
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+func stateCollection(record interface{}) (string, error) {
+	switch record.(type) {
+	case *models.TokenTx:
+		return db.StateTokenTxs, nil
+	case *models.TransferTokenTx:
+		return db.StateTransferTokenTxs, nil
+	case *models.TokenRelatedTx:
+		return db.StateTokenRelatedTxs, nil
+	case *models.TokenHolder:
+		return db.StateTokenHolders, nil
+	case *models.TokenStats:
+		return db.StateTokenStats, nil
+	default:
+		return "", fmt.Errorf("no state collection for %T", record)
+	}
+}
@@ -0,0 +1,198 @@
+package verify
+
+import (
+	"testing"
+
+	"github.com/cyyber/qrl-token-indexer/common"
+	"github.com/cyyber/qrl-token-indexer/config"
+	"github.com/cyyber/qrl-token-indexer/db"
+	"github.com/cyyber/qrl-token-indexer/db/memory"
+	"github.com/cyyber/qrl-token-indexer/db/models"
+	"github.com/cyyber/qrl-token-indexer/fakenode"
+	"github.com/cyyber/qrl-token-indexer/testutil"
+)
+
+var (
+	alice = testutil.Alice
+	bob   = testutil.Bob
+)
+
+// transferChain indexes the chain of testutil.NewTokenNode up to the transfer
+// of 300 from alice to bob in block 2.
+type transferChain struct {
+	node        *fakenode.Node
+	store       *memory.MemoryStore
+	tokenTxHash common.Hash
+	// transfer is the stored transfer
+	transfer *models.TransferTokenTx
+}
+
+func newTransferChain(t *testing.T) *transferChain {
+	t.Helper()
+	c := &transferChain{
+		node:        testutil.NewTokenNode(),
+		store:       memory.NewMemoryStore(config.DefaultConfig()),
+		tokenTxHash: testutil.TokenTxHash,
+	}
+	c.node.Drop(1)
+	testutil.Index(t, c.store, c.node)
+
+	for _, record := range testutil.Dump(t, c.store, db.StateTransferTokenTxs) {
+		c.transfer = record.(*models.TransferTokenTx)
+	}
+	if c.transfer == nil || c.transfer.BlockHash == (common.Hash{}) {
+		t.Fatalf("transfer stored without its block: %+v", c.transfer)
+	}
+	return c
+}
+
+// forkTransferAway replaces the block of the transfer with an empty block.
+func (c *transferChain) forkTransferAway(t *testing.T) {
+	t.Helper()
+	if err := c.store.RevertLastBlock(); err != nil {
+		t.Fatal(err)
+	}
+	c.node.Fork(1)
+	testutil.Process(t, c.store, c.node.Append())
+}
+
+func (c *transferChain) restore(t *testing.T, collection string, records ...interface{}) {
+	t.Helper()
+	if err := c.store.RestoreState(collection, records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *transferChain) assertBalance(t *testing.T, address common.Address, want common.Amount) {
+	t.Helper()
+	testutil.AssertBalance(t, c.store, c.tokenTxHash, address, want)
+}
+
+func kinds(r *Report) map[string]int {
+	kinds := make(map[string]int)
+	for _, d := range r.Discrepancies {
+		kinds[d.Kind]++
+	}
+	return kinds
+}
+
+func verifyAndRepair(t *testing.T, s Store, want map[string]int) {
+	t.Helper()
+	r, err := Verify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := kinds(r)
+	if len(got) != len(want) {
+		t.Fatalf("found %v, want %v", got, want)
+	}
+	for kind, count := range want {
+		if got[kind] != count {
+			t.Fatalf("found %v, want %v", got, want)
+		}
+	}
+	repaired, err := Repair(s, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != len(r.Discrepancies) {
+		t.Fatalf("repaired %d of %d discrepancies", repaired, len(r.Discrepancies))
+	}
+
+	r, err = Verify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range r.Discrepancies {
+		t.Errorf("left after repair: %s", d)
+	}
+}
+
+func TestVerifyConsistent(t *testing.T) {
+	c := newTransferChain(t)
+	verifyAndRepair(t, c.store, nil)
+	c.assertBalance(t, alice, 700)
+	c.assertBalance(t, bob, 300)
+}
+
+func TestRepairOrphanTransfer(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// legacy clears the block hash, as on transfers indexed before it
+		// was recorded
+		legacy         bool
+		tokenRelatedTx bool
+		want           map[string]int
+	}{
+		{
+			name: "forked block",
+			want: map[string]int{KindOrphanTx: 1},
+		},
+		{
+			name:           "forked block with tokenRelatedTx",
+			tokenRelatedTx: true,
+			want:           map[string]int{KindOrphanTx: 1, KindOrphanTokenRelatedTx: 1},
+		},
+		{
+			name:   "legacy without tokenRelatedTx",
+			legacy: true,
+			want:   map[string]int{KindOrphanTx: 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTransferChain(t)
+			c.forkTransferAway(t)
+
+			// Left behind by a revert, as a revert failing halfway used to
+			orphan := *c.transfer
+			if test.legacy {
+				orphan.BlockHash = common.Hash{}
+			}
+			c.restore(t, db.StateTransferTokenTxs, &orphan)
+			if test.tokenRelatedTx {
+				c.restore(t, db.StateTokenRelatedTxs, orphan.GetTokenRelatedTx())
+			}
+
+			verifyAndRepair(t, c.store, test.want)
+			c.assertBalance(t, alice, 1000)
+			c.assertBalance(t, bob, 0)
+		})
+	}
+}
+
+func TestRepairOrphanTransferWithHolders(t *testing.T) {
+	c := newTransferChain(t)
+	c.forkTransferAway(t)
+
+	// The orphan along with the holders it produced, as the revert bug
+	// replaying it on repair used to leave them
+	orphan := *c.transfer
+	orphan.BlockHash = common.Hash{}
+	c.restore(t, db.StateTransferTokenTxs, &orphan)
+	c.restore(t, db.StateTokenHolders,
+		&models.TokenHolder{TokenTxHash: c.tokenTxHash, Address: alice, Amount: 700, BlockNumber: 2},
+		&models.TokenHolder{TokenTxHash: c.tokenTxHash, Address: bob, Amount: 300, BlockNumber: 2})
+
+	verifyAndRepair(t, c.store, map[string]int{
+		KindOrphanTx:              1,
+		KindTokenHolderMismatch:   1,
+		KindUnexpectedTokenHolder: 1,
+	})
+	c.assertBalance(t, alice, 1000)
+	c.assertBalance(t, bob, 0)
+}
+
+func TestRepairMissingTokenRelatedTx(t *testing.T) {
+	c := newTransferChain(t)
+	err := c.store.DeleteState(db.StateTokenRelatedTxs,
+		[]interface{}{c.transfer.GetTokenRelatedTx()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transfer is in the indexed block, so only its tokenRelatedTx is
+	// missing
+	verifyAndRepair(t, c.store, map[string]int{KindMissingTokenRelatedTx: 1})
+	c.assertBalance(t, alice, 700)
+	c.assertBalance(t, bob, 300)
+}